@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/AnthonyHewins/imgscrape/internal/cmdline"
+	"github.com/spf13/cobra"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the configuration read from --config-file, IMGSCRAPE_* environment variables and flags",
+}
+
+var configPrintCmd = &cobra.Command{
+	Use:   "print [command]",
+	Short: "Print the effective configuration of a command (the root command by default) with secrets redacted",
+	Long: `Prints every flag of the command as YAML, usable as a config file, with where its value came from:
+flag, env, file or default. Precedence is in that order`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		target := rootCmd
+		if len(args) > 0 {
+			found, _, err := rootCmd.Find(args)
+			if err != nil {
+				return err
+			}
+
+			target = found
+		}
+
+		// persistent flags are shared, so the ones passed to this command count for target
+		config, err := cmdline.LoadCobraConfig(target)
+		if err != nil {
+			return err
+		}
+
+		return config.Print(os.Stdout)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configPrintCmd)
+}
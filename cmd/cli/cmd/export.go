@@ -0,0 +1,175 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/AnthonyHewins/imgscrape/internal/cmdline"
+	"github.com/AnthonyHewins/imgscrape/internal/corpus"
+	"github.com/AnthonyHewins/imgscrape/internal/export"
+	"github.com/spf13/cobra"
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export a downloaded corpus into formats trainers can read directly",
+}
+
+var webdatasetCmd = &cobra.Command{
+	Use:   "webdataset",
+	Short: "Pack the corpus into WebDataset .tar shards with a wids shard index",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f := cmd.Flags()
+
+		app, err := cmdline.NewAppFromCobra("", cmd)
+		if err != nil {
+			return err
+		}
+
+		dir, _ := f.GetString("dir")
+		out, _ := f.GetString("out")
+		prefix, _ := f.GetString("prefix")
+		maxCount, _ := f.GetInt("max-count")
+		maxSize, _ := f.GetInt64("max-size")
+
+		items, err := corpus.Load(dir)
+		if err != nil {
+			return err
+		}
+
+		if len(items) == 0 {
+			return fmt.Errorf("no items found in %s; nothing to do", dir)
+		}
+
+		var seed *int64
+		if shuffle, _ := f.GetBool("shuffle"); shuffle {
+			s, _ := f.GetInt64("seed")
+			export.Shuffle(items, s)
+			seed = &s
+		}
+
+		idx, err := export.NewWebDatasetWriter(app.Logger(), out, prefix, maxCount, maxSize).Write(cmd.Context(), items, seed)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("wrote %d samples into %d shards in %s\n", len(items), len(idx.ShardList), out)
+		return nil
+	},
+}
+
+var manifestCmd = &cobra.Command{
+	Use:   "manifest",
+	Short: "Write a JSONL or Parquet manifest with one record per image",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f := cmd.Flags()
+
+		dir, _ := f.GetString("dir")
+		out, _ := f.GetString("out")
+		format, _ := f.GetString("format")
+		if format == "" {
+			format = strings.TrimPrefix(filepath.Ext(out), ".")
+		}
+
+		var write func(io.Writer, []export.Record) error
+		switch format {
+		case "jsonl", "ndjson":
+			write = export.WriteJSONL
+		case "parquet":
+			write = export.WriteParquet
+		default:
+			return fmt.Errorf("invalid manifest format %q; use jsonl or parquet", format)
+		}
+
+		items, err := corpus.Load(dir)
+		if err != nil {
+			return err
+		}
+
+		records, err := export.Records(dir, items)
+		if err != nil {
+			return err
+		}
+
+		if out == "-" {
+			return write(os.Stdout, records)
+		}
+
+		file, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		if err = write(file, records); err != nil {
+			return err
+		}
+
+		return file.Close()
+	},
+}
+
+var cocoCmd = &cobra.Command{
+	Use:   "coco",
+	Short: "Write a COCO captions JSON file built from captions, alt, title and figcaption text",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f := cmd.Flags()
+
+		dir, _ := f.GetString("dir")
+		out, _ := f.GetString("out")
+
+		items, err := corpus.Load(dir)
+		if err != nil {
+			return err
+		}
+
+		coco, err := export.NewCOCO(dir, items)
+		if err != nil {
+			return err
+		}
+
+		buf, err := json.Marshal(coco)
+		if err != nil {
+			return err
+		}
+
+		if out == "-" {
+			_, err = os.Stdout.Write(buf)
+			return err
+		}
+
+		if err = os.WriteFile(out, buf, 0644); err != nil {
+			return err
+		}
+
+		fmt.Printf("wrote %d images and %d captions to %s\n", len(coco.Images), len(coco.Annotations), out)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportCmd.AddCommand(webdatasetCmd, manifestCmd, cocoCmd)
+
+	pf := exportCmd.PersistentFlags()
+	pf.String("dir", "images", "Corpus directory to read, laid out as <dir>/<id>/{image.*,metadata.json}")
+
+	f := webdatasetCmd.Flags()
+	f.String("out", "shards", "Directory to write shards and the shard index to")
+	f.String("prefix", "shard", "Shard name prefix; shards are named <prefix>-000000.tar and so on")
+	f.Int("max-count", 10000, "Maximum samples per shard. 0 for no limit")
+	f.Int64("max-size", 1<<30, "Maximum bytes per shard. 0 for no limit")
+	f.Bool("shuffle", false, "Shuffle samples before sharding")
+	f.Int64("seed", 0, "Seed to use when shuffling")
+
+	f = manifestCmd.Flags()
+	f.String("out", "manifest.parquet", "File to write the manifest to, or - for stdout")
+	f.String("format", "", "Manifest format: jsonl | parquet. Blank infers it from the --out extension")
+
+	f = cocoCmd.Flags()
+	f.String("out", "captions.json", "File to write the COCO captions to, or - for stdout")
+}
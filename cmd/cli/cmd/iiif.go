@@ -33,5 +33,4 @@ func init() {
 	f := iiifCmd.Flags()
 
 	f.String("host", "https://api.nga.gov/iiif", "The host to hit for the IIIF request")
-	f.String("")
 }
@@ -4,12 +4,17 @@ Copyright © 2023 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"time"
 
+	"github.com/AnthonyHewins/imgscrape/internal/canon"
 	"github.com/AnthonyHewins/imgscrape/internal/cmdline"
+	"github.com/AnthonyHewins/imgscrape/internal/crawler"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"go.opentelemetry.io/otel"
 )
 
 // build vars
@@ -22,16 +27,27 @@ var rootCmd = &cobra.Command{
 	Use:   "imgscrape",
 	Short: "Scrape images for ML purposes",
 	Long:  `Scrape images via webscraping or following the IIIF protocol`,
+	Args:  cobra.ArbitraryArgs,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		// config print loads the config of the command it's printing
+		for c := cmd; c != nil; c = c.Parent() {
+			if c == configCmd {
+				return nil
+			}
+		}
+
+		_, err := cmdline.LoadCobraConfig(cmd)
+		return err
+	},
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
-	RunE: func(cmd *cobra.Command, args []string) error {
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
 		if v, _ := cmd.Flags().GetBool("version"); v {
 			fmt.Println(version)
 			return nil
 		}
 
-		n := len(args)
-		if n == 0 {
+		if len(args) == 0 {
 			return fmt.Errorf("not enough args; no URLs to hit")
 		}
 
@@ -40,10 +56,86 @@ var rootCmd = &cobra.Command{
 			return err
 		}
 
-		if err = app.AddURLString(args...); err != nil {
+		exporter, err := cmdline.NewExporterFromCobra(app.Logger(), cmd.Flags())
+		if err != nil {
+			return err
+		}
+
+		ctx, stop := context.WithCancel(cmd.Context())
+		defer stop()
+
+		go exporter.Run(ctx)
+		defer func() { exporter.Finish(context.Background(), err) }()
+
+		traceOpts, err := cmdline.TracerOptionsFromCobra(cmd.Flags())
+		if err != nil {
+			return err
+		}
+
+		tp, err := app.CreateTracer(ctx, traceOpts)
+		if err != nil {
 			return err
 		}
 
+		otel.SetTracerProvider(tp)
+		defer func() {
+			if err := tp.Shutdown(context.Background()); err != nil {
+				app.Logger().Error("failed flushing traces", "err", err)
+			}
+		}()
+
+		f := cmd.Flags()
+		maxDepth, _ := f.GetInt("max-depth")
+		workers, _ := f.GetInt("workers")
+
+		stripParams, _ := f.GetStringSlice("strip-params")
+		canonicalizer := canon.Default.With(stripParams...)
+
+		c := crawler.New("", app.Logger(), app.HTTPClient()).
+			WithMaxDepth(maxDepth).
+			WithWorkers(workers).
+			WithCanonicalizer(canonicalizer).
+			WithFrontier(crawler.NewMemoryFrontier(canonicalizer))
+
+		if sitemaps, _ := f.GetBool("sitemaps"); sitemaps {
+			images, _ := f.GetBool("sitemap-images")
+			c.WithSitemaps(images)
+		}
+
+		if path, _ := f.GetString("frontier"); path != "" {
+			retryFailed, _ := f.GetBool("retry-failed")
+			frontier, err := crawler.OpenFileFrontier(path, retryFailed, canonicalizer)
+			if err != nil {
+				return err
+			}
+			defer frontier.Close()
+
+			c.WithFrontier(frontier)
+		}
+
+		if err = c.AddURLString(args...); err != nil {
+			return err
+		}
+
+		var failed, n int
+		for page := range c.Stream(ctx) {
+			n++
+			if page.Err != nil {
+				failed++
+				fmt.Fprintf(os.Stderr, "failed crawling %s: %v\n", page.URL, page.Err)
+				continue
+			}
+
+			for _, ref := range page.Refs {
+				fmt.Println(ref.URL)
+			}
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("%d of %d pages failed", failed, n)
+		}
+
+		return nil
 	},
 }
 
@@ -57,26 +149,56 @@ func Execute() {
 }
 
 func init() {
-	// Here you will define your flags and configuration settings.
-	// Cobra supports persistent flags, which, if defined here,
-	// will be global for your application.
-
-	// rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.cli.yaml)")
+	rootCmd.SetGlobalNormalizationFunc(renamedFlags)
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	f := rootCmd.Flags()
 	f.BoolP("toggle", "t", false, "Help message for toggle")
 	f.BoolP("version", "v", false, "Print version")
+	f.Int("max-depth", 0, "Follow same-host links this many hops from the URLs passed. 0 only crawls the URLs passed")
+	f.Int("workers", 8, "How many pages to fetch concurrently")
+	f.String("frontier", "", "Journal the crawl frontier to this file so the crawl can be resumed by rerunning the same command. Blank keeps it in memory")
+	f.Bool("retry-failed", false, "When resuming from a frontier file, retry URLs that failed last time")
+	f.Bool("sitemaps", false, "Seed the crawl with every page in each site's sitemaps (found via robots.txt or /sitemap.xml)")
+	f.Bool("sitemap-images", false, "With --sitemaps, output <image:loc> entries from image sitemaps directly instead of waiting to crawl their pages")
+	f.StringSlice("strip-params", nil, "Extra query parameters to strip when canonicalizing URLs, on top of utm_*, fbclid, session IDs and the like. A trailing * matches by prefix")
 
 	pf := rootCmd.PersistentFlags()
 
+	pf.String(cmdline.ConfigFile, "", "YAML (.yaml/.yml) or TOML (.toml) file of flag names to values. Environment variables named IMGSCRAPE_<FLAG_NAME> override it, and flags override both")
+
 	pf.String(cmdline.LogLevel, "", "Log level to use. None for no logs, or debug, warn/warning, info, error/err")
 	pf.String(cmdline.LogExporter, "", "Log exporter to use. By default, it goes off log level: info/debug go to STDOUT, warn/error to STDERR. Specify 'stderr' to write to stderr, and anything else opens a file")
 	pf.String(cmdline.LogFmt, "", "Log format to use. Blank or 'json' will create a json logger, or you can use logfmt/text")
 	pf.Bool(cmdline.LogSource, false, "Make all logging show where the log occurred")
 
-	pf.String("trace-exporter", "", "Export data using this exporter. Options are stdout (can be configured to go to a file using trace-exporter-arg), otlp with gRPC, jaegar. Use 'none' or leave blank to skip tracing")
-	pf.String("trace-exporter-arg", "", "Export data using this URI. For otlp and jaegar this will point to the collector of tracing, for stdout this will point to a file rather than stdout")
-	pf.Duration("trace-exporter-timeout", time.Second*5, "How long the tracer will try to export before it abandons the whole process (not supported for all trace exporters)")
+	pf.Duration(cmdline.HTTPTimeout, time.Second*30, "Timeout for each HTTP request")
+	pf.String(cmdline.HTTPCacheDir, "", "Cache HTTP responses in this directory, revalidating them with ETag/Last-Modified on re-crawls. Blank disables caching")
+	pf.String(cmdline.HTTPCacheMode, "default", "How the HTTP cache is used: default serves fresh responses from cache, revalidate checks every response with the server, changed-only also skips images and pages that haven't changed")
+
+	pf.String(cmdline.MetricsPushURL, "", "Push the run's metrics to this Pushgateway. Blank disables pushing")
+	pf.String(cmdline.MetricsPushJob, "imgscrape", "Job label to push metrics under")
+	pf.String(cmdline.MetricsTextfile, "", "Write the run's metrics to this file for node_exporter's textfile collector. Blank disables it")
+	pf.Duration(cmdline.MetricsPushInterval, time.Minute, "How often to export metrics while running, on top of once at the end. 0 only exports at the end")
+
+	pf.String(cmdline.TraceExporter, "", "Export data using this exporter. Options are stdout (can be configured to go to a file using trace-export-url), otlp with gRPC, otlp-http, jaeger. Use 'none' or leave blank to skip tracing")
+	pf.String(cmdline.TraceExportURL, "", "Export data using this URI. For otlp and jaeger this will point to the collector of tracing, for stdout this will point to a file rather than stdout")
+	pf.Duration(cmdline.TraceExporterTimeout, time.Second*5, "How long the tracer will try to export before it abandons the whole process (not supported for all trace exporters)")
+	pf.String(cmdline.TraceExporterHeaders, "", "Headers sent with every OTLP export, as key1=value1,key2=value2 with URL encoded values")
+	pf.Bool(cmdline.TraceExporterInsecure, false, "Send OTLP exports in plaintext instead of TLS")
+	pf.String(cmdline.TraceExporterCAFile, "", "PEM file of CAs to verify the OTLP collector's certificate with. Blank uses the system roots")
+	pf.Float64(cmdline.TraceSampleRatio, 1, "Fraction of traces to sample, 0 to 1")
+}
+
+// renamedFlags keeps flags renamed to match the server's working under their old names
+func renamedFlags(f *pflag.FlagSet, name string) pflag.NormalizedName {
+	switch name {
+	case "trace-exporter-arg":
+		name = "trace-export-url"
+	case "http-timeout":
+		name = cmdline.HTTPTimeout
+	}
+
+	return pflag.NormalizedName(name)
 }
@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/AnthonyHewins/imgscrape/internal/corpus"
+	"github.com/AnthonyHewins/imgscrape/internal/split"
+	"github.com/spf13/cobra"
+)
+
+var splitCmd = &cobra.Command{
+	Use:   "split",
+	Short: "Deterministically assign the corpus to train/validation/test splits without leaking groups across them",
+	Long: `Assigns whole groups of images to splits using a stable hash of the seed and group key.
+Writes splits.jsonl (id, group, split) and summary.json to the output directory.
+Groups keep their split as the corpus grows, except with near-duplicate: an image joining or
+merging clusters can change a cluster's key, and so its split`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f := cmd.Flags()
+
+		dir, _ := f.GetString("dir")
+		out, _ := f.GetString("out")
+		seed, _ := f.GetInt64("seed")
+
+		ratioStr, _ := f.GetString("ratios")
+		ratios, err := split.ParseRatios(ratioStr)
+		if err != nil {
+			return err
+		}
+
+		items, err := corpus.Load(dir)
+		if err != nil {
+			return err
+		}
+
+		groupBy, _ := f.GetString("group-by")
+		if groupBy == "near-duplicate" || strings.HasPrefix(groupBy, "near-duplicate:") {
+			// cache the hashes in the sidecars so reruns don't decode every image again
+			hashed, failed := split.HashItems(items)
+			for _, i := range hashed {
+				if err = corpus.WriteMetadata(items[i].Dir, &items[i].Meta); err != nil {
+					return err
+				}
+			}
+
+			if failed > 0 {
+				fmt.Fprintf(os.Stderr, "%d images couldn't be decoded to hash; each is grouped alone\n", failed)
+			}
+		}
+
+		grouper, err := split.GroupBy(groupBy, items)
+		if err != nil {
+			return err
+		}
+
+		assignments, summary := split.Assign(items, grouper, ratios, seed)
+
+		if err = os.MkdirAll(out, 0755); err != nil {
+			return err
+		}
+
+		file, err := os.Create(filepath.Join(out, "splits.jsonl"))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		enc := json.NewEncoder(file)
+		for i := range assignments {
+			if err = enc.Encode(&assignments[i]); err != nil {
+				return err
+			}
+		}
+
+		if err = file.Close(); err != nil {
+			return err
+		}
+
+		buf, err := json.MarshalIndent(summary, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		if err = os.WriteFile(filepath.Join(out, "summary.json"), buf, 0644); err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "split\ttarget\tactual\tgroups\titems\n")
+		for _, c := range summary.Splits {
+			fmt.Fprintf(w, "%s\t%.3f\t%.3f\t%d\t%d\n", c.Split, c.Target, c.Actual, c.Groups, c.Items)
+		}
+		fmt.Fprintf(w, "total\t\t\t%d\t%d\n", summary.Groups, summary.Items)
+		return w.Flush()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(splitCmd)
+
+	f := splitCmd.Flags()
+	f.String("dir", "images", "Corpus directory to read, laid out as <dir>/<id>/{image.*,metadata.json}")
+	f.String("out", "splits", "Directory to write splits.jsonl and summary.json to")
+	f.String("ratios", "train=0.8,val=0.1,test=0.1", "Comma separated split=weight pairs; weights are normalized")
+	f.String("group-by", "object", "What keeps images together: object | domain | checksum | near-duplicate[:<bits>] | attr:<key> | id. near-duplicate clusters images whose perceptual hashes differ in at most bits of 64 bits (default 6), caching each hash in its sidecar's dhash attribute; only JPEG, PNG and GIF images can be hashed")
+	f.Int64("seed", 0, "Seed for the group hash. Changing it reshuffles every group")
+}
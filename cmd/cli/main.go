@@ -3,7 +3,7 @@ Copyright © 2023 NAME HERE <EMAIL ADDRESS>
 */
 package main
 
-import "github.com/AnthonyHewins/gofast/cmd/cli/cmd"
+import "github.com/AnthonyHewins/imgscrape/cmd/cli/cmd"
 
 func main() {
 	cmd.Execute()
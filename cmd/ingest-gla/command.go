@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/AnthonyHewins/imgscrape/internal/cmdline"
+	"github.com/AnthonyHewins/imgscrape/internal/secret"
+)
+
+const usage = `usage: ingest-gla [flags] [command]
+
+With no command, ingests -file. Commands:
+  migrate up              apply pending schema migrations
+  migrate down [steps]    revert the last steps migrations (default 1)
+  migrate status          list migrations and when they were applied
+  config print            print the effective config, with secrets redacted`
+
+// command runs a one-off subcommand instead of the ingest and returns the exit code
+func command(app *cmdline.App, config *cmdline.Config, args []string) int {
+	switch {
+	case args[0] == "config" && len(args) == 2 && args[1] == "print":
+		if err := config.Print(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		return 0
+	case args[0] != "migrate":
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	password, err := secret.Resolve(context.Background(), *dbWriterPassword, *dbWriterPasswordFile, *dbWriterPasswordSecret)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed reading the database writer's password:", err)
+		return 1
+	}
+
+	db, err := app.ConnectDB(*dbHost, *dbName, *dbWriterUser, password, uint16(*dbPort))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	if err = app.Migrate(context.Background(), db, os.Stdout, args[1:]...); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
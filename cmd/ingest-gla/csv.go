@@ -2,8 +2,13 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/AnthonyHewins/csvscan"
+	"github.com/AnthonyHewins/imgscrape/internal/corpus"
 	"golang.org/x/exp/slog"
 )
 
@@ -22,6 +27,44 @@ type row struct {
 	AssistiveText      string `csv:"11"`
 }
 
+// source is recorded in every sidecar written by this ingester
+const source = "gla"
+
+// metadata converts the row into the sidecar stored next to its image. The raw
+// columns are kept as attributes so nothing from the CSV is lost
+func (r *row) metadata(imageURL, contentType string, image []byte) *corpus.Metadata {
+	width, _ := strconv.Atoi(r.Width)
+	height, _ := strconv.Atoi(r.Height)
+
+	return &corpus.Metadata{
+		ID:          r.ID,
+		Source:      source,
+		SourceURL:   imageURL,
+		Caption:     r.AssistiveText,
+		GroupID:     r.DepictSTMSObjectID,
+		Width:       width,
+		Height:      height,
+		ContentType: contentType,
+		Size:        int64(len(image)),
+		SHA256:      fmt.Sprintf("%x", sha256.Sum256(image)),
+		Retrieved:   time.Now().UTC(),
+		Attributes: map[string]string{
+			"uuid":               r.ID,
+			"iiifurl":            r.ImageURL,
+			"iiifthumburl":       r.ThumbURL,
+			"viewtype":           r.ViewType,
+			"sequence":           r.Sequence,
+			"width":              r.Width,
+			"height":             r.Height,
+			"maxpixels":          r.MaxPixels,
+			"created":            r.Created,
+			"modified":           r.Modified,
+			"depictstmsobjectid": r.DepictSTMSObjectID,
+			"assistivetext":      r.AssistiveText,
+		},
+	}
+}
+
 func csv(ctx context.Context, logger *slog.Logger, filename string) ([]row, error) {
 	reader := csvscan.Reader[row]{IgnoreHeader: true}
 
@@ -2,79 +2,174 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/AnthonyHewins/imgscrape/internal/cmdline"
+	"github.com/AnthonyHewins/imgscrape/internal/corpus"
+	"github.com/AnthonyHewins/imgscrape/internal/download"
+	"github.com/AnthonyHewins/imgscrape/internal/httpcache"
+	"github.com/AnthonyHewins/imgscrape/internal/metrics"
 	_ "github.com/lib/pq"
-	"github.com/namsral/flag"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/sdk/trace"
 )
 
 const appName = "backend"
 
 // CLI vars
 var (
-	envStr = flag.String("env", "local", "which env: local | dev | stage | prod")
+	flags = cmdline.NewFlagSet()
+
+	envStr = flags.String("env", "local", "which env: local | dev | stage | prod")
+
+	// read by cmdline.LoadFlagConfig
+	_ = flags.String(cmdline.ConfigFile, "", "YAML (.yaml/.yml) or TOML (.toml) file of flag names to values. Environment variables (IMGSCRAPE_DB_HOST for -db-host) override it, and flags override both")
 
 	// logging
-	logExporter = flag.String("log-exporter", "", "File to log to. Blank for stdout")
-	logLevel    = flag.String("log-level", "INFO", "Log level to use: DEBUG | INFO | WARN | ERROR")
-	logFmt      = flag.String("log-format", "json", "Log format to use: json | logfmt")
+	logExporter = flags.String("log-exporter", "", "File to log to. Blank for stdout")
+	logLevel    = flags.String("log-level", "INFO", "Log level to use: DEBUG | INFO | WARN | ERROR")
+	logFmt      = flags.String("log-format", "json", "Log format to use: json | logfmt")
 
 	// db plaintext config
-	dbHost = flag.String("db-host", "localhost", "the database host to connect to. If localhost, sslmode=disable; for any other host, sslmode=require")
-	dbPort = flag.Uint("db-port", 5432, "what port to connect to the DB on")
-	dbName = flag.String("db-name", "aq", "what database to connect to")
+	dbHost = flags.String("db-host", "localhost", "the database host to connect to. If localhost, sslmode=disable; for any other host, sslmode=require")
+	dbPort = flags.Uint("db-port", 5432, "what port to connect to the DB on")
+	dbName = flags.String("db-name", "aq", "what database to connect to")
 
 	// timeouts
-	httpTimeout    = flag.Duration("http-client-timeout", time.Second*5, "Timeout for HTTP client")
-	processTimeout = flag.Duration("process-timeout", time.Hour*3, "Time before the entire process times out")
+	httpTimeout    = flags.Duration("http-client-timeout", time.Second*5, "Timeout for HTTP client")
+	processTimeout = flags.Duration("process-timeout", time.Hour*3, "Time before the entire process times out")
+
+	// http cache
+	httpCacheDir  = flags.String("http-cache-dir", "", "Cache image responses in this directory and revalidate them on reruns. Blank disables caching")
+	httpCacheMode = flags.String("http-cache-mode", "default", "default | revalidate | changed-only. changed-only re-checks images that were already downloaded and rewrites only the ones that changed")
 
 	// db reader user
-	dbReaderUser     = flag.String("db-reader-user", "dbreader", "The database reader username")
-	dbReaderPassword = flag.String("db-reader-password", "", "database reader's password")
+	dbReaderUser           = flags.String("db-reader-user", "dbreader", "The database reader username")
+	dbReaderPassword       = flags.String("db-reader-password", "", "database reader's password. Shows up in ps output; prefer IMGSCRAPE_DB_READER_PASSWORD, -db-reader-password-file or -db-reader-password-secret")
+	dbReaderPasswordFile   = flags.String("db-reader-password-file", "", "File holding the database reader's password, like a mounted Docker or Kubernetes secret")
+	dbReaderPasswordSecret = flags.String("db-reader-password-secret", "", "Where to look up the database reader's password: env:VAR, file:PATH or scheme:name of a registered secret provider")
 
 	// db writer user
-	dbWriterUser     = flag.String("db-writer-user", "dbwriter", "The database writer username")
-	dbWriterPassword = flag.String("db-writer-password", "", "database writer's password")
+	dbWriterUser           = flags.String("db-writer-user", "dbwriter", "The database writer username")
+	dbWriterPassword       = flags.String("db-writer-password", "", "database writer's password. Shows up in ps output; prefer IMGSCRAPE_DB_WRITER_PASSWORD, -db-writer-password-file or -db-writer-password-secret")
+	dbWriterPasswordFile   = flags.String("db-writer-password-file", "", "File holding the database writer's password, like a mounted Docker or Kubernetes secret")
+	dbWriterPasswordSecret = flags.String("db-writer-password-secret", "", "Where to look up the database writer's password: env:VAR, file:PATH or scheme:name of a registered secret provider")
 
 	// input
-	fileSrc = flag.String("file", "", "File to read from")
+	fileSrc = flags.String("file", "", "File to read from")
 
 	// output
-	outDir = flag.String("out-dir", "images", "Directory to place files")
+	outDir  = flags.String("out-dir", "images", "Directory to place files")
+	license = flags.String("license", "CC0-1.0", "License recorded in the metadata of every image")
+
+	// download limits
+	maxBytes     = flags.Int64("max-bytes", download.DefaultMaxBytes, "Abort any image bigger than this many bytes. 0 for no limit")
+	allowedTypes = flags.String("allowed-types", "image/*", "Comma separated MIME types to accept; type/* matches a whole family")
+
+	// tracing
+	traceExporter         = flags.String("trace-exporter", "none", "Export trace data. Options: stdout | jaeger | otlp (gRPC) | otlp-http | none")
+	traceExporterURL      = flags.String("trace-export-url", "", "URL to use for your trace export option. For stdout, a file to append to instead")
+	traceExporterTimeout  = flags.Duration("trace-exporter-timeout", time.Second*5, "How long the tracer will try to export before it abandons the whole process (not supported for all trace exporters)")
+	traceExporterHeaders  = flags.String("trace-exporter-headers", "", "Headers sent with every OTLP export, as key1=value1,key2=value2 with URL encoded values")
+	traceExporterInsecure = flags.Bool("trace-exporter-insecure", false, "Send OTLP exports in plaintext instead of TLS")
+	traceExporterCAFile   = flags.String("trace-exporter-ca-file", "", "PEM file of CAs to verify the OTLP collector's certificate with. Blank uses the system roots")
+	traceSampleRatio      = flags.Float64("trace-sample-ratio", 1, "Fraction of runs to trace, 0 to 1")
+
+	// metrics
+	metricsPushURL      = flags.String("metrics-push-url", "", "Push run metrics to this Pushgateway. Blank disables pushing")
+	metricsPushJob      = flags.String("metrics-push-job", "ingest-gla", "Job label to push metrics under")
+	metricsTextfile     = flags.String("metrics-textfile", "", "Write run metrics to this file for node_exporter's textfile collector. Blank disables it")
+	metricsPushInterval = flags.Duration("metrics-push-interval", time.Minute, "How often to export metrics while running, on top of once at the end. 0 only exports at the end")
 )
 
 func main() {
+	flags.Parse(os.Args[1:])
+	config, err := cmdline.LoadFlagConfig(flags, os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
 	app, err := cmdline.NewApp(appName, *logLevel, *logFmt, *logExporter, true)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if flags.NArg() > 0 {
+		os.Exit(command(app, config, flags.Args()))
+	}
+
 	logger := app.Logger()
 	ctx, cancel := context.WithTimeout(context.Background(), *processTimeout)
 	defer cancel()
 	logger.InfoContext(ctx, "Starting process", "times out in", *processTimeout)
 
+	exporter := metrics.NewExporter(logger, metrics.ExportOptions{
+		PushURL:  *metricsPushURL,
+		Job:      *metricsPushJob,
+		Textfile: *metricsTextfile,
+		Interval: *metricsPushInterval,
+	})
+	go exporter.Run(ctx)
+
+	tp, err := newTracer(ctx, app)
+	if err != nil {
+		fmt.Println(err)
+		exporter.Finish(context.Background(), err)
+		os.Exit(1)
+	}
+
+	otel.SetTracerProvider(tp)
+
+	// finish reports the run and flushes its spans; os.Exit skips defers
+	finish := func(runErr error) {
+		exporter.Finish(context.Background(), runErr)
+		if err := tp.Shutdown(context.Background()); err != nil {
+			logger.Error("failed flushing traces", "err", err)
+		}
+	}
+
+	ctx, span := otel.Tracer(appName).Start(ctx, "ingest-gla")
+
 	var rows []row
 	switch {
-	case *fileSrc == "":
+	case *fileSrc != "":
 		rows, err = csv(ctx, logger, *fileSrc)
 		if err != nil {
 			fmt.Println(err)
+			span.End()
+			finish(err)
 			os.Exit(1)
 		}
 	default:
 		logger.Error("no source specified; exiting")
 		fmt.Println("no source specified; exiting")
+		span.End()
+		finish(errors.New("no source specified"))
+		os.Exit(1)
+	}
+
+	httpClient, err := cmdline.NewHTTPClient(*httpTimeout, *httpCacheDir, *httpCacheMode)
+	if err != nil {
+		logger.ErrorContext(ctx, "failed creating HTTP client", "err", err)
+		span.End()
+		finish(err)
 		os.Exit(1)
 	}
 
-	httpClient := &http.Client{Timeout: *httpTimeout}
+	limits := download.Limits{MaxBytes: *maxBytes, AllowedTypes: strings.Split(*allowedTypes, ",")}
+
+	// with a cache, existing outputs can be refreshed cheaply
+	refresh := *httpCacheDir != "" && *httpCacheMode == "changed-only"
 	for i, v := range rows {
 		l := logger.With("index", i, "row", v)
 		if v.ImageURL == "" || v.ID == "" {
@@ -85,14 +180,14 @@ func main() {
 		dir := fmt.Sprintf("%s/%s", *outDir, v.ID)
 		info, err := os.Stat(dir)
 		switch {
-		case err == nil:
-			if !info.IsDir() {
-				l.InfoContext(ctx, "output already exists")
-			} else {
-				l.ErrorContext(ctx, "output directory for this ID exists as a file already")
-			}
-
+		case err == nil && !info.IsDir():
+			l.ErrorContext(ctx, "output directory for this ID exists as a file already")
+			continue
+		case err == nil && !refresh:
+			l.InfoContext(ctx, "output already exists")
 			continue
+		case err == nil:
+			// refreshing; only rewritten if it changed
 		case os.IsNotExist(err):
 			// doesn't exist; proceed
 		case err != nil:
@@ -114,21 +209,91 @@ func main() {
 		}
 
 		if code := resp.StatusCode; code >= 300 || code < 200 {
+			resp.Body.Close()
+			metrics.Rejected(metrics.ReasonBadStatus)
 			l.ErrorContext(ctx, "request failed", "code", code, "resp", resp)
 			continue
 		}
 
-		buf, err := io.ReadAll(resp.Body)
+		if httpcache.Unchanged(resp) {
+			resp.Body.Close()
+			l.DebugContext(ctx, "image unchanged since last run")
+			continue
+		}
+
+		body, err := limits.Body(resp)
+		if err != nil {
+			l.ErrorContext(ctx, "rejected response", "err", err)
+			continue
+		}
+
+		buf, err := io.ReadAll(body)
+		body.Close()
 		if err != nil {
 			l.ErrorContext(ctx, "failed reading body", "err", err)
 			continue
 		}
 
-		err = os.WriteFile(dir+"/image.jpg", buf, 0700)
+		contentType := resp.Header.Get("Content-Type")
+		if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "" || mediaType == "application/octet-stream" {
+			contentType = http.DetectContentType(buf)
+		}
+
+		ext, ok := download.Extension(contentType)
+		if !ok {
+			ext = ".jpg" // what was asked for
+		}
+
+		if err = os.MkdirAll(dir, 0700); err != nil {
+			l.ErrorContext(ctx, "failed creating output directory", "err", err)
+			continue
+		}
+
+		// a refreshed image may have changed type; the old one mustn't be left next to it
+		old, _ := filepath.Glob(filepath.Join(dir, corpus.ImageBase+".*"))
+		for _, f := range old {
+			if filepath.Ext(f) != ext {
+				os.Remove(f)
+			}
+		}
+
+		err = os.WriteFile(filepath.Join(dir, corpus.ImageBase+ext), buf, 0600)
 		if err != nil {
-			l.ErrorContext(ctx, "failed writing image")
+			l.ErrorContext(ctx, "failed writing image", "err", err)
+			continue
+		}
+
+		meta := v.metadata(path, contentType, buf)
+		meta.License = *license
+		if err = corpus.WriteMetadata(dir, meta); err != nil {
+			l.ErrorContext(ctx, "failed writing metadata", "err", err)
+			continue
 		}
+
+		metrics.ImagesDownloaded.WithLabelValues("gla").Inc()
 	}
+
+	// hitting the process timeout is the only way the run as a whole fails
+	span.End()
+	finish(ctx.Err())
+}
+
+// newTracer creates the tracer provider the trace flags describe
+func newTracer(ctx context.Context, app *cmdline.App) (*trace.TracerProvider, error) {
+	headers, err := cmdline.ParseHeaders(*traceExporterHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	return app.CreateTracer(ctx, cmdline.TracerOptions{
+		Exporter:    *traceExporter,
+		URL:         *traceExporterURL,
+		Timeout:     *traceExporterTimeout,
+		Headers:     headers,
+		Insecure:    *traceExporterInsecure,
+		CAFile:      *traceExporterCAFile,
+		SampleRatio: *traceSampleRatio,
+	})
 }
 
 /*
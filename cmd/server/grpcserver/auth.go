@@ -0,0 +1,101 @@
+package grpcserver
+
+import (
+	"context"
+	"strings"
+
+	imgscrapev1 "github.com/AnthonyHewins/imgscrape/gen/go/imgscrape/v1"
+	"github.com/AnthonyHewins/imgscrape/internal/auth"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// methodScopes is the scope each RPC requires. RPCs missing from here are denied
+var methodScopes = map[string]auth.Scope{
+	imgscrapev1.ScrapeService_SubmitCrawlJob_FullMethodName: auth.ScopeWrite,
+	imgscrapev1.ScrapeService_SubmitIIIFJob_FullMethodName:  auth.ScopeWrite,
+	imgscrapev1.ScrapeService_CancelJob_FullMethodName:      auth.ScopeWrite,
+	imgscrapev1.ScrapeService_GetJob_FullMethodName:         auth.ScopeRead,
+	imgscrapev1.ScrapeService_ListJobs_FullMethodName:       auth.ScopeRead,
+	imgscrapev1.ScrapeService_WatchJob_FullMethodName:       auth.ScopeRead,
+	imgscrapev1.ScrapeService_ListImages_FullMethodName:     auth.ScopeRead,
+}
+
+// requiredScope is the scope needed to call method
+func requiredScope(method string) (auth.Scope, bool) {
+	if strings.HasPrefix(method, "/grpc.reflection.") {
+		return auth.ScopeRead, true
+	}
+
+	scope, ok := methodScopes[method]
+	return scope, ok
+}
+
+// authorize authenticates the bearer token in ctx's metadata and checks it grants the
+// scope method needs, returning ctx with the caller in it
+func authorize(ctx context.Context, l *slog.Logger, a *auth.Authenticator, method string) (context.Context, error) {
+	scope, ok := requiredScope(method)
+	if !ok {
+		l.WarnContext(ctx, "denied call to an RPC with no scope mapped", "rpc", method)
+		return nil, status.Error(codes.PermissionDenied, "permission denied")
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	header, err := fetchKey(md, "authorization")
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := a.Authenticate(header)
+	if err != nil {
+		l.InfoContext(ctx, "rejected credentials", "rpc", method, "err", err)
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	ctx = auth.NewContext(ctx, id)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("enduser.id", id.Subject))
+
+	if !id.Has(scope) {
+		l.WarnContext(ctx, "caller lacks scope", "rpc", method, "scope", scope)
+		return nil, status.Errorf(codes.PermissionDenied, "%s requires the %s scope", method, scope)
+	}
+
+	return ctx, nil
+}
+
+func authUnaryInterceptor(l *slog.Logger, a *auth.Authenticator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := authorize(ctx, l, a, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+func authStreamInterceptor(l *slog.Logger, a *auth.Authenticator) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authorize(ss.Context(), l, a, info.FullMethod)
+		if err != nil {
+			return err
+		}
+
+		return handler(srv, &authedStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// authedStream swaps in a context carrying the caller
+type authedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authedStream) Context() context.Context {
+	return s.ctx
+}
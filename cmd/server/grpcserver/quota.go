@@ -0,0 +1,167 @@
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	imgscrapev1 "github.com/AnthonyHewins/imgscrape/gen/go/imgscrape/v1"
+	"github.com/AnthonyHewins/imgscrape/internal/auth"
+	"github.com/AnthonyHewins/imgscrape/internal/quota"
+	"golang.org/x/exp/slog"
+	"golang.org/x/time/rate"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// limiters unused for this long are dropped
+const limiterIdle = 10 * time.Minute
+
+// submitMethods are the RPCs that create jobs, checked against daily quotas. The
+// concurrent job quota is checked by the job manager as it inserts the job
+var submitMethods = map[string]bool{
+	imgscrapev1.ScrapeService_SubmitCrawlJob_FullMethodName: true,
+	imgscrapev1.ScrapeService_SubmitIIIFJob_FullMethodName:  true,
+}
+
+type callerLimiter struct {
+	*rate.Limiter
+	lastUsed time.Time
+}
+
+// rateLimiter keeps a token bucket per caller
+type rateLimiter struct {
+	quotas *quota.Store
+
+	mu        sync.Mutex
+	callers   map[string]*callerLimiter
+	lastSweep time.Time
+}
+
+func newRateLimiter(quotas *quota.Store) *rateLimiter {
+	return &rateLimiter{quotas: quotas, callers: map[string]*callerLimiter{}, lastSweep: time.Now()}
+}
+
+// allow takes a token from subject's bucket. If there isn't one, it returns how long
+// until there will be
+func (r *rateLimiter) allow(ctx context.Context, subject string) (time.Duration, bool) {
+	limits := r.quotas.Limits(ctx, subject)
+	if limits.RequestsPerSecond <= 0 {
+		return 0, true
+	}
+
+	burst := limits.Burst
+	if burst < 1 {
+		burst = 1
+	}
+
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now.Sub(r.lastSweep) > limiterIdle {
+		for k, v := range r.callers {
+			if now.Sub(v.lastUsed) > limiterIdle {
+				delete(r.callers, k)
+			}
+		}
+
+		r.lastSweep = now
+	}
+
+	l, ok := r.callers[subject]
+	if !ok {
+		l = &callerLimiter{Limiter: rate.NewLimiter(rate.Limit(limits.RequestsPerSecond), burst)}
+		r.callers[subject] = l
+	}
+
+	// pick up changes to the caller's quotas
+	if l.Limit() != rate.Limit(limits.RequestsPerSecond) {
+		l.SetLimitAt(now, rate.Limit(limits.RequestsPerSecond))
+	}
+
+	if l.Burst() != burst {
+		l.SetBurstAt(now, burst)
+	}
+
+	l.lastUsed = now
+	res := l.ReserveN(now, 1)
+	if delay := res.DelayFrom(now); delay > 0 {
+		res.CancelAt(now)
+		return delay, false
+	}
+
+	return 0, true
+}
+
+// exhausted is a ResourceExhausted status telling the client when to retry
+func exhausted(subject, msg string, retryAfter time.Duration) error {
+	st := status.New(codes.ResourceExhausted, msg)
+	withDetails, err := st.WithDetails(
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)},
+		&errdetails.QuotaFailure{Violations: []*errdetails.QuotaFailure_Violation{
+			{Subject: subject, Description: msg},
+		}},
+	)
+	if err != nil {
+		return st.Err()
+	}
+
+	return withDetails.Err()
+}
+
+// limit applies the caller's rate limit to every call and their daily quotas to submissions
+func limit(ctx context.Context, l *slog.Logger, quotas *quota.Store, limiter *rateLimiter, method string) error {
+	var subject string
+	if id := auth.FromContext(ctx); id != nil {
+		subject = id.Subject
+	}
+
+	if delay, ok := limiter.allow(ctx, subject); !ok {
+		l.InfoContext(ctx, "rate limited", "rpc", method, "retry_after", delay)
+		return exhausted(subject, "rate limit exceeded", delay)
+	}
+
+	if !submitMethods[method] {
+		return nil
+	}
+
+	var exceeded *quota.ExceededError
+	switch err := quotas.CheckDaily(ctx, subject); {
+	case errors.As(err, &exceeded):
+		l.InfoContext(ctx, "job quota exceeded", "rpc", method, "quota", exceeded.Quota, "used", exceeded.Used, "max", exceeded.Max)
+		return exhausted(subject, exceeded.Error(), exceeded.RetryAfter)
+	case err != nil:
+		l.ErrorContext(ctx, "failed checking job quotas", "err", err)
+		return status.Error(codes.Internal, "failed checking job quotas")
+	}
+
+	return nil
+}
+
+// quotaUnaryInterceptor and quotaStreamInterceptor share limiter, so a caller has one
+// bucket whatever kind of RPCs they make
+func quotaUnaryInterceptor(l *slog.Logger, quotas *quota.Store, limiter *rateLimiter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := limit(ctx, l, quotas, limiter, info.FullMethod); err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+func quotaStreamInterceptor(l *slog.Logger, quotas *quota.Store, limiter *rateLimiter) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := limit(ss.Context(), l, quotas, limiter, info.FullMethod); err != nil {
+			return err
+		}
+
+		return handler(srv, ss)
+	}
+}
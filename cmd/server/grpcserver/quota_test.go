@@ -0,0 +1,95 @@
+package grpcserver
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	imgscrapev1 "github.com/AnthonyHewins/imgscrape/gen/go/imgscrape/v1"
+	"github.com/AnthonyHewins/imgscrape/internal/auth"
+	"github.com/AnthonyHewins/imgscrape/internal/quota"
+	"golang.org/x/exp/slog"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRateLimiter(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits quota.Limits
+		calls  int
+		want   int // allowed of calls
+	}{
+		{name: "unlimited", limits: quota.Limits{}, calls: 100, want: 100},
+		{name: "burst", limits: quota.Limits{RequestsPerSecond: 0.1, Burst: 3}, calls: 5, want: 3},
+		{name: "no burst allows one", limits: quota.Limits{RequestsPerSecond: 0.1}, calls: 5, want: 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newRateLimiter(quota.New(nil, nil, tc.limits))
+			ctx := context.Background()
+
+			allowed := 0
+			for i := 0; i < tc.calls; i++ {
+				delay, ok := r.allow(ctx, "team-a")
+				if ok {
+					allowed++
+					continue
+				}
+
+				// one token per 10s
+				if delay <= 0 || delay > 10*time.Second {
+					t.Fatalf("denied with a delay of %v", delay)
+				}
+			}
+
+			if allowed != tc.want {
+				t.Fatalf("allowed %d of %d calls, want %d", allowed, tc.calls, tc.want)
+			}
+
+			// callers don't share a bucket
+			if _, ok := r.allow(ctx, "team-b"); !ok {
+				t.Fatal("another caller was limited")
+			}
+		})
+	}
+}
+
+func TestLimit(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	quotas := quota.New(logger, nil, quota.Limits{RequestsPerSecond: 0.1, Burst: 1})
+	limiter := newRateLimiter(quotas)
+	ctx := auth.NewContext(context.Background(), &auth.Identity{Subject: "team-a"})
+
+	if err := limit(ctx, logger, quotas, limiter, imgscrapev1.ScrapeService_SubmitCrawlJob_FullMethodName); err != nil {
+		t.Fatalf("first call: %v", err)
+	}
+
+	err := limit(ctx, logger, quotas, limiter, imgscrapev1.ScrapeService_GetJob_FullMethodName)
+	st, _ := status.FromError(err)
+	if st.Code() != codes.ResourceExhausted {
+		t.Fatalf("got %v, want ResourceExhausted", err)
+	}
+
+	var retry *errdetails.RetryInfo
+	var failure *errdetails.QuotaFailure
+	for _, d := range st.Details() {
+		switch d := d.(type) {
+		case *errdetails.RetryInfo:
+			retry = d
+		case *errdetails.QuotaFailure:
+			failure = d
+		}
+	}
+
+	if retry == nil || retry.RetryDelay.AsDuration() <= 0 {
+		t.Fatalf("no retry delay in %v", st.Details())
+	}
+
+	if failure == nil || len(failure.Violations) != 1 || failure.Violations[0].Subject != "team-a" {
+		t.Fatalf("no quota failure for the caller in %v", st.Details())
+	}
+}
@@ -0,0 +1,272 @@
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	imgscrapev1 "github.com/AnthonyHewins/imgscrape/gen/go/imgscrape/v1"
+	"github.com/AnthonyHewins/imgscrape/internal/auth"
+	"github.com/AnthonyHewins/imgscrape/internal/jobs"
+	"github.com/AnthonyHewins/imgscrape/internal/quota"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	defaultJobPageSize   = 50
+	defaultImagePageSize = 100
+	maxPageSize          = 1000
+)
+
+var (
+	jobKinds = map[jobs.Kind]imgscrapev1.JobKind{
+		jobs.KindCrawl: imgscrapev1.JobKind_JOB_KIND_CRAWL,
+		jobs.KindIIIF:  imgscrapev1.JobKind_JOB_KIND_IIIF,
+	}
+
+	jobStates = map[jobs.State]imgscrapev1.JobState{
+		jobs.StateQueued:    imgscrapev1.JobState_JOB_STATE_QUEUED,
+		jobs.StateRunning:   imgscrapev1.JobState_JOB_STATE_RUNNING,
+		jobs.StateSucceeded: imgscrapev1.JobState_JOB_STATE_SUCCEEDED,
+		jobs.StateFailed:    imgscrapev1.JobState_JOB_STATE_FAILED,
+		jobs.StateCanceled:  imgscrapev1.JobState_JOB_STATE_CANCELED,
+	}
+)
+
+func (s *server) SubmitCrawlJob(ctx context.Context, in *imgscrapev1.SubmitCrawlJobRequest) (*imgscrapev1.Job, error) {
+	spec := in.GetSpec()
+	if spec == nil {
+		return nil, status.Error(codes.InvalidArgument, "spec is required")
+	}
+
+	j, err := s.jobs.SubmitCrawl(ctx, jobs.CrawlSpec{
+		URLs:          spec.Urls,
+		MaxDepth:      int(spec.MaxDepth),
+		Sitemaps:      spec.Sitemaps,
+		SitemapImages: spec.SitemapImages,
+		StripParams:   spec.StripParams,
+	})
+	if err != nil {
+		return nil, s.jobErr(ctx, "failed submitting crawl job", err)
+	}
+
+	return jobToProto(j), nil
+}
+
+func (s *server) SubmitIIIFJob(ctx context.Context, in *imgscrapev1.SubmitIIIFJobRequest) (*imgscrapev1.Job, error) {
+	spec := in.GetSpec()
+	if spec == nil {
+		return nil, status.Error(codes.InvalidArgument, "spec is required")
+	}
+
+	j, err := s.jobs.SubmitIIIF(ctx, jobs.IIIFSpec{
+		BaseURL:     spec.BaseUrl,
+		Identifiers: spec.Identifiers,
+		Region:      spec.Region,
+		Size:        spec.Size,
+		Format:      spec.Format,
+	})
+	if err != nil {
+		return nil, s.jobErr(ctx, "failed submitting IIIF job", err)
+	}
+
+	return jobToProto(j), nil
+}
+
+func (s *server) GetJob(ctx context.Context, in *imgscrapev1.GetJobRequest) (*imgscrapev1.Job, error) {
+	j, err := s.jobs.Get(ctx, in.GetId())
+	if err != nil {
+		return nil, s.jobErr(ctx, "failed getting job", err)
+	}
+
+	return jobToProto(j), nil
+}
+
+func (s *server) ListJobs(ctx context.Context, in *imgscrapev1.ListJobsRequest) (*imgscrapev1.ListJobsResponse, error) {
+	offset, limit, err := page(in.GetPageToken(), in.GetPageSize(), defaultJobPageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var f jobs.Filter
+	for state, v := range jobStates {
+		if v == in.GetState() {
+			f.State = state
+		}
+	}
+
+	for kind, v := range jobKinds {
+		if v == in.GetKind() {
+			f.Kind = kind
+		}
+	}
+
+	list, next, err := s.jobs.List(ctx, f, offset, limit)
+	if err != nil {
+		return nil, s.jobErr(ctx, "failed listing jobs", err)
+	}
+
+	resp := &imgscrapev1.ListJobsResponse{
+		Jobs:          make([]*imgscrapev1.Job, len(list)),
+		NextPageToken: pageToken(next),
+	}
+
+	for i := range list {
+		resp.Jobs[i] = jobToProto(&list[i])
+	}
+
+	return resp, nil
+}
+
+func (s *server) CancelJob(ctx context.Context, in *imgscrapev1.CancelJobRequest) (*imgscrapev1.Job, error) {
+	j, err := s.jobs.Cancel(ctx, in.GetId())
+	if err != nil {
+		return nil, s.jobErr(ctx, "failed canceling job", err)
+	}
+
+	return jobToProto(j), nil
+}
+
+func (s *server) ListImages(ctx context.Context, in *imgscrapev1.ListImagesRequest) (*imgscrapev1.ListImagesResponse, error) {
+	offset, limit, err := page(in.GetPageToken(), in.GetPageSize(), defaultImagePageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	images, next, err := s.jobs.Images(ctx, in.GetJobId(), offset, limit)
+	if err != nil {
+		return nil, s.jobErr(ctx, "failed listing images", err)
+	}
+
+	resp := &imgscrapev1.ListImagesResponse{
+		Images:        make([]*imgscrapev1.Image, len(images)),
+		NextPageToken: pageToken(next),
+	}
+
+	for i, img := range images {
+		resp.Images[i] = &imgscrapev1.Image{
+			Id:         img.ID,
+			JobId:      img.JobID,
+			Url:        img.URL,
+			PageUrl:    img.PageURL,
+			Alt:        img.Alt,
+			Title:      img.Title,
+			Figcaption: img.Figcaption,
+			Extractor:  img.Extractor,
+			Path:       img.Path,
+			FoundAt:    timestamppb.New(img.FoundAt),
+		}
+	}
+
+	return resp, nil
+}
+
+// jobErr logs err and converts it to a gRPC status
+func (s *server) jobErr(ctx context.Context, msg string, err error) error {
+	var exceeded *quota.ExceededError
+	switch {
+	case errors.As(err, &exceeded):
+		var subject string
+		if id := auth.FromContext(ctx); id != nil {
+			subject = id.Subject
+		}
+
+		s.logger.InfoContext(ctx, "job quota exceeded", "quota", exceeded.Quota, "used", exceeded.Used, "max", exceeded.Max)
+		return exhausted(subject, exceeded.Error(), exceeded.RetryAfter)
+	case errors.Is(err, jobs.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, jobs.ErrInvalidSpec):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, jobs.ErrFinished):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	s.logger.ErrorContext(ctx, msg, "err", err)
+	return status.Error(codes.Internal, msg)
+}
+
+// page turns a page token and size into an offset and limit. Tokens are opaque to
+// clients, but they're just the offset
+func page(token string, size int32, defaultSize int) (offset, limit int, err error) {
+	limit = int(size)
+	switch {
+	case limit <= 0:
+		limit = defaultSize
+	case limit > maxPageSize:
+		limit = maxPageSize
+	}
+
+	if token == "" {
+		return 0, limit, nil
+	}
+
+	offset, err = strconv.Atoi(token)
+	if err != nil || offset < 0 {
+		return 0, 0, status.Errorf(codes.InvalidArgument, "invalid page token %q", token)
+	}
+
+	return offset, limit, nil
+}
+
+func pageToken(next int) string {
+	if next == 0 {
+		return ""
+	}
+
+	return strconv.Itoa(next)
+}
+
+func jobToProto(j *jobs.Job) *imgscrapev1.Job {
+	out := &imgscrapev1.Job{
+		Id:         j.ID,
+		Kind:       jobKinds[j.Kind],
+		State:      jobStates[j.State],
+		Progress:   progressToProto(&j.Progress),
+		Error:      j.Error,
+		CreatedAt:  timestamppb.New(j.CreatedAt),
+		StartedAt:  timestamp(j.StartedAt),
+		FinishedAt: timestamp(j.FinishedAt),
+	}
+
+	switch {
+	case j.Crawl != nil:
+		out.Spec = &imgscrapev1.Job_Crawl{Crawl: &imgscrapev1.CrawlSpec{
+			Urls:          j.Crawl.URLs,
+			MaxDepth:      int32(j.Crawl.MaxDepth),
+			Sitemaps:      j.Crawl.Sitemaps,
+			SitemapImages: j.Crawl.SitemapImages,
+			StripParams:   j.Crawl.StripParams,
+		}}
+	case j.IIIF != nil:
+		out.Spec = &imgscrapev1.Job_Iiif{Iiif: &imgscrapev1.IIIFSpec{
+			BaseUrl:     j.IIIF.BaseURL,
+			Identifiers: j.IIIF.Identifiers,
+			Region:      j.IIIF.Region,
+			Size:        j.IIIF.Size,
+			Format:      j.IIIF.Format,
+		}}
+	}
+
+	return out
+}
+
+func progressToProto(p *jobs.Progress) *imgscrapev1.JobProgress {
+	return &imgscrapev1.JobProgress{
+		PagesDone:        p.PagesDone,
+		PagesFailed:      p.PagesFailed,
+		ImagesFound:      p.ImagesFound,
+		ImagesDownloaded: p.ImagesDownloaded,
+		ImagesFailed:     p.ImagesFailed,
+	}
+}
+
+func timestamp(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+
+	return timestamppb.New(*t)
+}
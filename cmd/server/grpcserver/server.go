@@ -3,6 +3,10 @@ package grpcserver
 import (
 	"time"
 
+	imgscrapev1 "github.com/AnthonyHewins/imgscrape/gen/go/imgscrape/v1"
+	"github.com/AnthonyHewins/imgscrape/internal/auth"
+	"github.com/AnthonyHewins/imgscrape/internal/jobs"
+	"github.com/AnthonyHewins/imgscrape/internal/quota"
 	"github.com/jmoiron/sqlx"
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"go.opentelemetry.io/otel"
@@ -17,7 +21,8 @@ import (
 )
 
 var (
-	unaryMiddlewares = []grpc.UnaryServerInterceptor{}
+	unaryMiddlewares  = []grpc.UnaryServerInterceptor{}
+	streamMiddlewares = []grpc.StreamServerInterceptor{otelgrpc.StreamServerInterceptor()}
 )
 
 func fetchKey(m metadata.MD, key string) (string, error) {
@@ -37,15 +42,19 @@ type server struct {
 
 	reader *sqlx.DB
 	writer *sqlx.DB
+
+	jobs *jobs.Manager
 }
 
-// NewServer creates a new server. Pass an empty string to traceName to not add any trace middleware
-func NewServer(traceName string, l *slog.Logger, reader, writer *sqlx.DB) *grpc.Server {
+// NewServer creates a new server. Pass an empty string to traceName to not add any trace middleware.
+// Pass a nil authenticator to let every call through unauthenticated, and nil quotas to not limit callers
+func NewServer(traceName string, l *slog.Logger, reader, writer *sqlx.DB, jobManager *jobs.Manager, authenticator *auth.Authenticator, quotas *quota.Store) *grpc.Server {
 	s := &server{
 		logger: l,
 		tracer: otel.Tracer(traceName),
 		reader: reader,
 		writer: writer,
+		jobs:   jobManager,
 	}
 
 	// only if tracing was specified should you add this
@@ -53,6 +62,19 @@ func NewServer(traceName string, l *slog.Logger, reader, writer *sqlx.DB) *grpc.
 		unaryMiddlewares = append(unaryMiddlewares, otelgrpc.UnaryServerInterceptor())
 	}
 
+	// after tracing, so rejected calls are traced too
+	if authenticator != nil {
+		unaryMiddlewares = append(unaryMiddlewares, authUnaryInterceptor(l, authenticator))
+		streamMiddlewares = append(streamMiddlewares, authStreamInterceptor(l, authenticator))
+	}
+
+	// after auth, so limits apply per caller
+	if quotas != nil {
+		limiter := newRateLimiter(quotas)
+		unaryMiddlewares = append(unaryMiddlewares, quotaUnaryInterceptor(l, quotas, limiter))
+		streamMiddlewares = append(streamMiddlewares, quotaStreamInterceptor(l, quotas, limiter))
+	}
+
 	grpcServer := grpc.NewServer(
 		grpc.KeepaliveParams(keepalive.ServerParameters{
 			MaxConnectionIdle: 5 * time.Second,
@@ -63,10 +85,11 @@ func NewServer(traceName string, l *slog.Logger, reader, writer *sqlx.DB) *grpc.
 		grpc.ChainUnaryInterceptor(unaryMiddlewares...),
 
 		// Stream requests
-		grpc.StreamInterceptor(otelgrpc.StreamServerInterceptor()),
+		grpc.ChainStreamInterceptor(streamMiddlewares...),
 	)
 
 	// add server implementations below
+	imgscrapev1.RegisterScrapeServiceServer(grpcServer, s)
 
 	reflection.Register(grpcServer)
 	return grpcServer
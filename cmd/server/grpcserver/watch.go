@@ -0,0 +1,129 @@
+package grpcserver
+
+import (
+	"time"
+
+	imgscrapev1 "github.com/AnthonyHewins/imgscrape/gen/go/imgscrape/v1"
+	"github.com/AnthonyHewins/imgscrape/internal/jobs"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// how often WatchJob checks for new events
+	watchPollInterval = time.Second
+
+	// how many events WatchJob reads at a time
+	watchBatchSize = 500
+
+	defaultProgressInterval = 5 * time.Second
+	minProgressInterval     = time.Second
+	maxProgressInterval     = time.Minute
+)
+
+var eventTypes = map[jobs.EventType]imgscrapev1.JobEventType{
+	jobs.EventPageFetched:     imgscrapev1.JobEventType_JOB_EVENT_TYPE_PAGE_FETCHED,
+	jobs.EventPageFailed:      imgscrapev1.JobEventType_JOB_EVENT_TYPE_PAGE_FAILED,
+	jobs.EventImageDiscovered: imgscrapev1.JobEventType_JOB_EVENT_TYPE_IMAGE_DISCOVERED,
+	jobs.EventImageDownloaded: imgscrapev1.JobEventType_JOB_EVENT_TYPE_IMAGE_DOWNLOADED,
+	jobs.EventImageRejected:   imgscrapev1.JobEventType_JOB_EVENT_TYPE_IMAGE_REJECTED,
+	jobs.EventImageFailed:     imgscrapev1.JobEventType_JOB_EVENT_TYPE_IMAGE_FAILED,
+	jobs.EventJobState:        imgscrapev1.JobEventType_JOB_EVENT_TYPE_JOB_STATE,
+}
+
+func (s *server) WatchJob(in *imgscrapev1.WatchJobRequest, stream imgscrapev1.ScrapeService_WatchJobServer) error {
+	ctx := stream.Context()
+
+	cursor := in.GetCursor()
+	if cursor < 0 {
+		return status.Errorf(codes.InvalidArgument, "invalid cursor %d", cursor)
+	}
+
+	interval := defaultProgressInterval
+	if d := in.GetProgressInterval(); d != nil {
+		if err := d.CheckValid(); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid progress interval: %v", err)
+		}
+
+		switch interval = d.AsDuration(); {
+		case interval < minProgressInterval:
+			interval = minProgressInterval
+		case interval > maxProgressInterval:
+			interval = maxProgressInterval
+		}
+	}
+
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+
+	var lastProgress time.Time
+	for {
+		// read the job before its events: once it's finished, every event it will
+		// ever have is already visible
+		j, err := s.jobs.Get(ctx, in.GetId())
+		if err != nil {
+			return s.jobErr(ctx, "failed getting job to watch", err)
+		}
+
+		for {
+			events, err := s.jobs.Events(ctx, j.ID, cursor, watchBatchSize)
+			if err != nil {
+				return s.jobErr(ctx, "failed reading job events", err)
+			}
+
+			for i := range events {
+				if err = stream.Send(eventToProto(&events[i])); err != nil {
+					return err
+				}
+
+				cursor = events[i].Seq
+			}
+
+			if len(events) < watchBatchSize {
+				break
+			}
+		}
+
+		if j.State.Finished() {
+			return stream.Send(progressEvent(j, cursor))
+		}
+
+		if time.Since(lastProgress) >= interval {
+			if err = stream.Send(progressEvent(j, cursor)); err != nil {
+				return err
+			}
+
+			lastProgress = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func eventToProto(e *jobs.Event) *imgscrapev1.JobEvent {
+	return &imgscrapev1.JobEvent{
+		Cursor: e.Seq,
+		Type:   eventTypes[e.Type],
+		At:     timestamppb.New(e.At),
+		Url:    e.URL,
+		Path:   e.Path,
+		Error:  e.Error,
+		State:  jobStates[e.State],
+	}
+}
+
+func progressEvent(j *jobs.Job, cursor int64) *imgscrapev1.JobEvent {
+	return &imgscrapev1.JobEvent{
+		Cursor:   cursor,
+		Type:     imgscrapev1.JobEventType_JOB_EVENT_TYPE_PROGRESS,
+		At:       timestamppb.Now(),
+		Error:    j.Error,
+		State:    jobStates[j.State],
+		Progress: progressToProto(&j.Progress),
+	}
+}
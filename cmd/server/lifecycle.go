@@ -2,57 +2,161 @@ package main
 
 import (
 	"context"
-	"os"
+	"fmt"
+	"io"
+	"net/http"
 
+	"github.com/AnthonyHewins/imgscrape/internal/auth"
 	"github.com/AnthonyHewins/imgscrape/internal/cmdline"
-	"github.com/namsral/flag"
+	"github.com/AnthonyHewins/imgscrape/internal/download"
+	"github.com/AnthonyHewins/imgscrape/internal/health"
+	"github.com/AnthonyHewins/imgscrape/internal/jobs"
+	"github.com/AnthonyHewins/imgscrape/internal/metrics"
+	"github.com/AnthonyHewins/imgscrape/internal/quota"
+	"github.com/AnthonyHewins/imgscrape/internal/secret"
+	"github.com/AnthonyHewins/imgscrape/internal/tracing"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/propagation"
+	"golang.org/x/exp/slog"
+	grpchealth "google.golang.org/grpc/health"
 )
 
 func bootstrap(ctx context.Context) {
-	flag.Parse()
-
 	app, err := cmdline.NewApp(appName, *logLevel, *logFmt, *logExporter, true)
 	if err != nil {
 		panic(err)
 	}
 
 	// logging
-	logger = app.Logger()
+	logger = slog.New(auth.NewLogHandler(app.Logger().Handler()))
+
+	// auth
+	if *disableAuth {
+		logger.Warn("auth disabled; every API call is let through unauthenticated")
+	} else {
+		authenticator, err = auth.New(auth.Options{
+			JWKSFile:    *authJWKSFile,
+			JWKSURL:     *authJWKSURL,
+			Issuer:      *authJWTIssuer,
+			Audience:    *authJWTAudience,
+			Leeway:      *authJWTLeeway,
+			APIKeysFile: *authAPIKeysFile,
+		})
+		if err != nil {
+			panic(fmt.Errorf("failed setting up auth (pass -disable-auth to run without it): %w", err))
+		}
+	}
 
 	// database
-	dbReader, err = app.ConnectDBWithOTEL(*dbHost, *dbName, *dbReaderUser, *dbReaderPassword, uint16(*dbPort))
+	readerPassword, err := secret.Resolve(ctx, *dbReaderPassword, *dbReaderPasswordFile, *dbReaderPasswordSecret)
+	if err != nil {
+		panic(fmt.Errorf("failed reading the database reader's password: %w", err))
+	}
+
+	writerPassword, err := secret.Resolve(ctx, *dbWriterPassword, *dbWriterPasswordFile, *dbWriterPasswordSecret)
+	if err != nil {
+		panic(fmt.Errorf("failed reading the database writer's password: %w", err))
+	}
+
+	dbReader, err = app.ConnectDBWithOTEL(*dbHost, *dbName, *dbReaderUser, readerPassword, uint16(*dbPort))
 	if err != nil {
 		panic(err)
 	}
 
-	dbWriter, err = app.ConnectDBWithOTEL(*dbHost, *dbName, *dbWriterUser, *dbWriterPassword, uint16(*dbPort))
+	dbWriter, err = app.ConnectDBWithOTEL(*dbHost, *dbName, *dbWriterUser, writerPassword, uint16(*dbPort))
 	if err != nil {
 		panic(err)
 	}
 
+	// the migrator logs every migration it applies, so the summary isn't needed
+	if *autoMigrate {
+		if err = app.Migrate(ctx, dbWriter, io.Discard, "up"); err != nil {
+			panic(err)
+		}
+	}
+
+	// quotas
+	if !*disableQuotas {
+		quotas = quota.New(logger, dbReader, quota.Limits{
+			RequestsPerSecond: *rateLimitRPS,
+			Burst:             *rateLimitBurst,
+			ConcurrentJobs:    *quotaConcurrentJobs,
+			ImagesPerDay:      *quotaImagesPerDay,
+			BytesPerDay:       *quotaBytesPerDay,
+		})
+	}
+
+	// jobs
+	limits := download.Default
+	limits.MaxBytes = *maxImageBytes
+	jobManager = jobs.NewManager("jobs", logger, dbReader, dbWriter, &http.Client{
+		Timeout:   *httpTimeout,
+		Transport: tracing.Transport(metrics.Transport(nil)),
+	}, *storageDir, jobs.Options{
+		JobWorkers:   *jobWorkers,
+		ImageWorkers: *imageWorkers,
+		PollInterval: *jobPollInterval,
+		Lease:        *jobLease,
+		MaxAttempts:  *jobMaxAttempts,
+		Limits:       &limits,
+		Quotas:       quotas,
+	})
+
+	if !*disableWorkers {
+		jobManager.Start()
+	}
+
+	// health. Nothing is Live: the job workers fail whenever the database does, and a
+	// restart can't fix that, so they only take the instance out of rotation
+	grpcHealth = grpchealth.NewServer()
+	healthChecker = health.New(logger, *healthInterval, *healthTimeout,
+		health.Check{Name: "db-reader", Fn: dbReader.PingContext},
+		health.Check{Name: "db-writer", Fn: dbWriter.PingContext},
+		health.Check{Name: "job-workers", Fn: jobManager.Check},
+		health.Check{Name: "storage", Fn: health.DirWritable(*storageDir)},
+	).WithGRPCServer(grpcHealth, "backend")
+
 	// OTEL
 	otel.SetTextMapPropagator(
 		propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}),
 	)
 
 	// Tracing
-	tp, err = app.CreateTracer(ctx, *traceExporter, *traceExporterURL, *traceExporterTimeout)
+	headers, err := cmdline.ParseHeaders(*traceExporterHeaders)
+	if err != nil {
+		panic(err)
+	}
+
+	tp, err = app.CreateTracer(ctx, cmdline.TracerOptions{
+		Exporter:    *traceExporter,
+		URL:         *traceExporterURL,
+		Timeout:     *traceExporterTimeout,
+		Headers:     headers,
+		Insecure:    *traceExporterInsecure,
+		CAFile:      *traceExporterCAFile,
+		SampleRatio: *traceSampleRatio,
+	})
 	if err != nil {
 		panic(err)
 	}
 
-	defer func() {
-		if err := tp.Shutdown(context.Background()); err != nil {
-			logger.Error("failed shutting down tracer", "error", err)
-			os.Exit(1)
-		}
-	}()
 	otel.SetTracerProvider(tp) // set the global tracer provider
+
+	// OTel metrics, served on /metrics next to the prometheus ones
+	if mp, err = app.CreateMeterProvider(); err != nil {
+		panic(err)
+	}
+
+	otel.SetMeterProvider(mp)
 }
 
 func shutdownServers(ctx context.Context) {
+	// stop taking traffic first
+	if healthChecker != nil {
+		logger.Info("marking instance not ready")
+		healthChecker.Drain()
+	}
+
 	if httpServer != nil {
 		logger.Info("shutting down HTTP server")
 		if err := httpServer.Shutdown(ctx); err != nil {
@@ -75,6 +179,14 @@ func shutdownServers(ctx context.Context) {
 		logger.Info("gRPC server shut down")
 	}
 
+	if jobManager != nil {
+		logger.Info("stopping job workers")
+		if err := jobManager.Shutdown(ctx); err != nil {
+			logger.Error("job workers didn't stop in time", "err", err)
+		}
+		logger.Info("job workers stopped")
+	}
+
 	if httpMetricsServer != nil {
 		logger.Info("shutting down HTTP metrics")
 		if err := httpMetricsServer.Shutdown(ctx); err != nil {
@@ -88,4 +200,26 @@ func shutdownServers(ctx context.Context) {
 		healthServer.GracefulStop()
 		logger.Info("shut down health server")
 	}
+
+	if httpHealthServer != nil {
+		logger.Info("shutting down HTTP health server")
+		if err := httpHealthServer.Shutdown(ctx); err != nil {
+			logger.Error("server shutdown failure", "err", err)
+		}
+		logger.Info("HTTP health server shut down")
+	}
+
+	// last, so spans from everything above are flushed
+	if tp != nil {
+		logger.Info("flushing traces")
+		if err := tp.Shutdown(ctx); err != nil {
+			logger.Error("failed shutting down tracer", "err", err)
+		}
+	}
+
+	if mp != nil {
+		if err := mp.Shutdown(ctx); err != nil {
+			logger.Error("failed shutting down meter provider", "err", err)
+		}
+	}
 }
@@ -10,13 +10,20 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/AnthonyHewins/imgscrape/internal/auth"
+	"github.com/AnthonyHewins/imgscrape/internal/cmdline"
+	"github.com/AnthonyHewins/imgscrape/internal/download"
+	"github.com/AnthonyHewins/imgscrape/internal/health"
+	"github.com/AnthonyHewins/imgscrape/internal/jobs"
+	"github.com/AnthonyHewins/imgscrape/internal/quota"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
-	"github.com/namsral/flag"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/trace"
 	"golang.org/x/exp/slog"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
+	grpchealth "google.golang.org/grpc/health"
 )
 
 const appName = "backend"
@@ -24,64 +31,137 @@ const asciiArt = ``
 
 // CLI vars
 var (
-	envStr = flag.String("env", "local", "which env: local | dev | stage | prod")
+	flags = cmdline.NewFlagSet()
+
+	envStr = flags.String("env", "local", "which env: local | dev | stage | prod")
+
+	// read by cmdline.LoadFlagConfig
+	_ = flags.String(cmdline.ConfigFile, "", "YAML (.yaml/.yml) or TOML (.toml) file of flag names to values. Environment variables (IMGSCRAPE_DB_HOST for -db-host) override it, and flags override both")
 
 	// logging
-	logExporter = flag.String("log-exporter", "", "File to log to. Blank for stdout")
-	logLevel    = flag.String("log-level", "INFO", "Log level to use: DEBUG | INFO | WARN | ERROR")
-	logFmt      = flag.String("log-format", "json", "Log format to use: json | logfmt")
+	logExporter = flags.String("log-exporter", "", "File to log to. Blank for stdout")
+	logLevel    = flags.String("log-level", "INFO", "Log level to use: DEBUG | INFO | WARN | ERROR")
+	logFmt      = flags.String("log-format", "json", "Log format to use: json | logfmt")
 
 	// metrics
-	disableMetricsServer = flag.Bool("disable-metrics-server", false, "Disable the metrics server")
-	httpMetricsPort      = flag.Int("http-metrics-port", 8088, "HTTP metrics port")
+	disableMetricsServer = flags.Bool("disable-metrics-server", false, "Disable the metrics server")
+	httpMetricsPort      = flags.Int("http-metrics-port", 8088, "HTTP metrics port")
 
 	// tracing
-	traceExporter        = flag.String("trace-exporter", "stdout", "Export trace data. Options: stdout | jaeger | otlp | none")
-	traceExporterURL     = flag.String("trace-export-url", "", "URL to use for your trace export option")
-	traceExporterTimeout = flag.Duration("trace-exporter-timeout", time.Second*5, "How long the tracer will try to export before it abandons the whole process (not supported for all trace exporters)")
+	traceExporter         = flags.String("trace-exporter", "stdout", "Export trace data. Options: stdout | jaeger | otlp (gRPC) | otlp-http | none")
+	traceExporterURL      = flags.String("trace-export-url", "", "URL to use for your trace export option. For stdout, a file to append to instead")
+	traceExporterTimeout  = flags.Duration("trace-exporter-timeout", time.Second*5, "How long the tracer will try to export before it abandons the whole process (not supported for all trace exporters)")
+	traceExporterHeaders  = flags.String("trace-exporter-headers", "", "Headers sent with every OTLP export, as key1=value1,key2=value2 with URL encoded values")
+	traceExporterInsecure = flags.Bool("trace-exporter-insecure", false, "Send OTLP exports in plaintext instead of TLS")
+	traceExporterCAFile   = flags.String("trace-exporter-ca-file", "", "PEM file of CAs to verify the OTLP collector's certificate with. Blank uses the system roots")
+	traceSampleRatio      = flags.Float64("trace-sample-ratio", 1, "Fraction of new traces to sample, 0 to 1. Requests whose caller sampled them are always sampled")
 
 	// health server
-	disableHealthServer = flag.Bool("disable-health", false, "disable the health check server")
-	healthPort          = flag.Uint("health-port", 7674, "the port to run liveliness/readiness")
+	disableHealthServer = flags.Bool("disable-health", false, "disable the health check servers")
+	healthPort          = flags.Uint("health-port", 7674, "the port to run liveliness/readiness")
+	healthHTTPPort      = flags.Uint("health-http-port", 7675, "the port to serve the /livez, /readyz and /healthz HTTP probes on, whether or not the metrics server runs. If 0, they're only on the metrics server")
+	healthInterval      = flags.Duration("health-check-interval", time.Second*10, "How often the database, job workers and storage are checked")
+	healthTimeout       = flags.Duration("health-check-timeout", time.Second*3, "How long each health check may take before it counts as failed")
 
 	// gRPC server
-	grpcPort = flag.Uint("grpc-port", 9200, "run the GRPC server at this port")
+	grpcPort = flags.Uint("grpc-port", 9200, "run the GRPC server at this port")
 
 	// gRPC gateway interface to expose HTTP
-	grpcGatewayPort = flag.Uint("grpc-gateway-port", 0, "run the grpc-gateway server and listen to this port. If 0, don't use it. gRPC must be enabled for it to work")
+	grpcGatewayPort = flags.Uint("grpc-gateway-port", 0, "run the grpc-gateway server and listen to this port. If 0, don't use it. gRPC must be enabled for it to work")
+
+	// auth
+	disableAuth     = flags.Bool("disable-auth", false, "Let every API call through unauthenticated. Only for local development")
+	authJWKSFile    = flags.String("auth-jwks-file", "", "JSON Web Key Set file whose keys sign accepted JWT bearer tokens")
+	authJWKSURL     = flags.String("auth-jwks-url", "", "URL of a JSON Web Key Set, such as an identity provider's jwks_uri, fetched at startup. Can't be combined with -auth-jwks-file")
+	authJWTIssuer   = flags.String("auth-jwt-issuer", "", "If set, JWTs must have this iss claim")
+	authJWTAudience = flags.String("auth-jwt-audience", "", "If set, JWTs must have this aud claim")
+	authJWTLeeway   = flags.Duration("auth-jwt-leeway", 0, "Clock skew allowed when checking a JWT's exp, nbf and iat claims")
+	authAPIKeysFile = flags.String("auth-api-keys-file", "", `JSON list of service account API keys: [{"name": "...", "sha256": "<hex sha256 of the key>", "scopes": ["read", "write"]}]`)
+
+	// per-caller limits. Overridden per caller in the caller_quotas table; 0 for no limit
+	disableQuotas       = flags.Bool("disable-quotas", false, "Don't rate limit or apply quotas to callers")
+	rateLimitRPS        = flags.Float64("rate-limit-rps", 10, "Requests per second each caller may make")
+	rateLimitBurst      = flags.Int("rate-limit-burst", 20, "Requests each caller may make at once above their rate")
+	quotaConcurrentJobs = flags.Int("quota-concurrent-jobs", 5, "Queued and running jobs each caller may have")
+	quotaImagesPerDay   = flags.Int64("quota-images-per-day", 100_000, "Images each caller may download per UTC day")
+	quotaBytesPerDay    = flags.Int64("quota-bytes-per-day", 20<<30, "Bytes of images each caller may download per UTC day")
+
+	// jobs
+	storageDir      = flags.String("storage-dir", "images", "Directory downloaded images are stored in")
+	disableWorkers  = flags.Bool("disable-workers", false, "Don't process the job queue in this process; only serve the API")
+	jobWorkers      = flags.Int("job-workers", 2, "How many jobs are crawled at once")
+	imageWorkers    = flags.Int("image-workers", 8, "How many images are downloaded at once")
+	jobPollInterval = flags.Duration("job-poll-interval", time.Second*2, "How long idle workers wait before checking the queue again")
+	jobLease        = flags.Duration("job-lease", time.Minute, "How long a claimed job or image survives without a heartbeat before another worker takes it over")
+	jobMaxAttempts  = flags.Int("job-max-attempts", 3, "How many times jobs and image downloads are tried before they fail")
+	maxImageBytes   = flags.Int64("max-image-bytes", download.DefaultMaxBytes, "Abort any image download bigger than this many bytes. 0 for no limit")
+	httpTimeout     = flags.Duration("http-client-timeout", time.Second*30, "Timeout for each HTTP request jobs make")
 
 	// db plaintext config
-	dbHost = flag.String("db-host", "localhost", "the database host to connect to. If localhost, sslmode=disable; for any other host, sslmode=require")
-	dbPort = flag.Uint("db-port", 5432, "what port to connect to the DB on")
-	dbName = flag.String("db-name", "aq", "what database to connect to")
+	dbHost = flags.String("db-host", "localhost", "the database host to connect to. If localhost, sslmode=disable; for any other host, sslmode=require")
+	dbPort = flags.Uint("db-port", 5432, "what port to connect to the DB on")
+	dbName = flags.String("db-name", "aq", "what database to connect to")
+
+	// migrations
+	autoMigrate = flags.Bool("auto-migrate", false, "Apply pending schema migrations on startup, using the writer user. Safe with several replicas; they take turns behind an advisory lock")
 
 	// db reader user
-	dbReaderUser     = flag.String("db-reader-user", "dbreader", "The database reader username")
-	dbReaderPassword = flag.String("db-reader-password", "", "database reader's password")
+	dbReaderUser           = flags.String("db-reader-user", "dbreader", "The database reader username")
+	dbReaderPassword       = flags.String("db-reader-password", "", "database reader's password. Shows up in ps output; prefer IMGSCRAPE_DB_READER_PASSWORD, -db-reader-password-file or -db-reader-password-secret")
+	dbReaderPasswordFile   = flags.String("db-reader-password-file", "", "File holding the database reader's password, like a mounted Docker or Kubernetes secret")
+	dbReaderPasswordSecret = flags.String("db-reader-password-secret", "", "Where to look up the database reader's password: env:VAR, file:PATH or scheme:name of a registered secret provider")
 
 	// db writer user
-	dbWriterUser     = flag.String("db-writer-user", "dbwriter", "The database writer username")
-	dbWriterPassword = flag.String("db-writer-password", "", "database writer's password")
+	dbWriterUser           = flags.String("db-writer-user", "dbwriter", "The database writer username")
+	dbWriterPassword       = flags.String("db-writer-password", "", "database writer's password. Shows up in ps output; prefer IMGSCRAPE_DB_WRITER_PASSWORD, -db-writer-password-file or -db-writer-password-secret")
+	dbWriterPasswordFile   = flags.String("db-writer-password-file", "", "File holding the database writer's password, like a mounted Docker or Kubernetes secret")
+	dbWriterPasswordSecret = flags.String("db-writer-password-secret", "", "Where to look up the database writer's password: env:VAR, file:PATH or scheme:name of a registered secret provider")
 )
 
 // runtime vars
 var (
 	logger *slog.Logger
 	tp     *trace.TracerProvider
+	mp     *sdkmetric.MeterProvider
 
 	// database
 	dbReader *sqlx.DB
 	dbWriter *sqlx.DB
 
+	// API auth; nil if disabled
+	authenticator *auth.Authenticator
+
+	// per-caller limits; nil if disabled
+	quotas *quota.Store
+
+	// background scrape jobs
+	jobManager *jobs.Manager
+
+	// health
+	healthChecker *health.Checker
+	grpcHealth    *grpchealth.Server
+
 	// servers
 	httpServer        *http.Server
 	httpMetricsServer *http.Server
 	grpcServer        *grpc.Server
 	grpcGatewayServer *http.Server
 	healthServer      *grpc.Server
+	httpHealthServer  *http.Server
 )
 
 func main() {
+	flags.Parse(os.Args[1:])
+	config, err := cmdline.LoadFlagConfig(flags, os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if flags.NArg() > 0 {
+		os.Exit(command(config, flags.Args()))
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -104,8 +184,17 @@ func main() {
 		g.Go(prometheusMetrics)
 	}
 
+	g.Go(func() error {
+		healthChecker.Run(ctx)
+		return nil
+	})
+
 	if !*disableHealthServer {
 		g.Go(serveHealth)
+
+		if *healthHTTPPort != 0 {
+			g.Go(serveHealthHTTP)
+		}
 	}
 
 	if info, ok := debug.ReadBuildInfo(); ok {
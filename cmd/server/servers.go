@@ -10,13 +10,14 @@ import (
 	"time"
 
 	"github.com/AnthonyHewins/imgscrape/cmd/server/grpcserver"
+	imgscrapev1 "github.com/AnthonyHewins/imgscrape/gen/go/imgscrape/v1"
 	"github.com/grpc-ecosystem/grpc-gateway/runtime"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/exp/slog"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
-	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/health/grpc_health_v1"
 )
 
@@ -37,7 +38,13 @@ func prometheusMetrics() error {
 		WriteTimeout:      10 * time.Second,
 	}
 
-	http.Handle("/metrics", promhttp.Handler())
+	// a collector that fails leaves its own metrics out rather than failing the scrape
+	http.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+			ErrorLog:      slog.NewLogLogger(logger.Handler(), slog.LevelError),
+			ErrorHandling: promhttp.ContinueOnError,
+		}),
+	))
 
 	if info, ok := debug.ReadBuildInfo(); ok {
 		// expose version to prometheus
@@ -49,12 +56,12 @@ func prometheusMetrics() error {
 			w.Write(b)
 		})
 
-		http.HandleFunc("/healthz", func(w http.ResponseWriter, request *http.Request) {
-			w.Header().Set("Content-Type", "application/json")
-			w.Write([]byte(`{"status":"ok"}`))
-		})
 	}
 
+	http.Handle("/livez", healthChecker.LivenessHandler())
+	http.Handle("/readyz", healthChecker.ReadinessHandler())
+	http.Handle("/healthz", healthChecker.ReadinessHandler())
+
 	logger.Info("HTTP Metrics server listening", "listenaddr", listenAddr)
 	if err := httpMetricsServer.ListenAndServe(); err != http.ErrServerClosed {
 		return err //nolint:wrapcheck
@@ -76,7 +83,7 @@ func serveGRPC() error {
 		traceName = ""
 	}
 
-	grpcServer = grpcserver.NewServer(traceName, logger, dbReader, dbWriter)
+	grpcServer = grpcserver.NewServer(traceName, logger, dbReader, dbWriter, jobManager, authenticator, quotas)
 	logger.Info(fmt.Sprintf("gRPC API server listening at :%d", *grpcPort))
 	return grpcServer.Serve(tcpSocket)
 }
@@ -96,7 +103,9 @@ func serveGRPCGateway(ctx context.Context) func() error {
 		}
 
 		listenAddr := fmt.Sprintf(":%d", *grpcPort)
-		for _, handler := range []svcHandler{} {
+		for _, handler := range []svcHandler{
+			{name: "ScrapeService", svcHandler: imgscrapev1.RegisterScrapeServiceHandlerFromEndpoint},
+		} {
 			err := handler.svcHandler(ctx, mux, listenAddr, opts)
 			if err != nil {
 				return fmt.Errorf("failed registering grpc gateway service %s: %w", handler.name, err)
@@ -110,10 +119,10 @@ func serveGRPCGateway(ctx context.Context) func() error {
 }
 
 func serveHealth() error {
-	h := health.NewServer()
 	healthServer = grpc.NewServer()
 
-	grpc_health_v1.RegisterHealthServer(healthServer, h)
+	// statuses are kept up to date by healthChecker
+	grpc_health_v1.RegisterHealthServer(healthServer, grpcHealth)
 
 	haddr := fmt.Sprintf(":%d", *healthPort)
 	hln, err := net.Listen("tcp", haddr)
@@ -123,7 +132,30 @@ func serveHealth() error {
 	}
 
 	logger.Info("gRPC health server serving", "listenaddr", haddr)
-
-	h.SetServingStatus("backend", grpc_health_v1.HealthCheckResponse_SERVING)
 	return healthServer.Serve(hln)
 }
+
+// serveHealthHTTP serves the HTTP probes on their own port, so they don't depend on
+// the metrics server being enabled
+func serveHealthHTTP() error {
+	mux := http.NewServeMux()
+	mux.Handle("/livez", healthChecker.LivenessHandler())
+	mux.Handle("/readyz", healthChecker.ReadinessHandler())
+	mux.Handle("/healthz", healthChecker.ReadinessHandler())
+
+	listenAddr := fmt.Sprintf(":%d", *healthHTTPPort)
+	httpHealthServer = &http.Server{
+		Addr:              listenAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+	}
+
+	logger.Info("HTTP health server listening", "listenaddr", listenAddr)
+	if err := httpHealthServer.ListenAndServe(); err != http.ErrServerClosed {
+		return err //nolint:wrapcheck
+	}
+
+	return nil
+}
@@ -0,0 +1,375 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: imgscrape/v1/service.proto
+
+package imgscrapev1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	ScrapeService_SubmitCrawlJob_FullMethodName = "/imgscrape.v1.ScrapeService/SubmitCrawlJob"
+	ScrapeService_SubmitIIIFJob_FullMethodName  = "/imgscrape.v1.ScrapeService/SubmitIIIFJob"
+	ScrapeService_GetJob_FullMethodName         = "/imgscrape.v1.ScrapeService/GetJob"
+	ScrapeService_ListJobs_FullMethodName       = "/imgscrape.v1.ScrapeService/ListJobs"
+	ScrapeService_CancelJob_FullMethodName      = "/imgscrape.v1.ScrapeService/CancelJob"
+	ScrapeService_WatchJob_FullMethodName       = "/imgscrape.v1.ScrapeService/WatchJob"
+	ScrapeService_ListImages_FullMethodName     = "/imgscrape.v1.ScrapeService/ListImages"
+)
+
+// ScrapeServiceClient is the client API for ScrapeService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ScrapeServiceClient interface {
+	// SubmitCrawlJob queues a job crawling web pages for images
+	SubmitCrawlJob(ctx context.Context, in *SubmitCrawlJobRequest, opts ...grpc.CallOption) (*Job, error)
+	// SubmitIIIFJob queues a job downloading images from a IIIF image server
+	SubmitIIIFJob(ctx context.Context, in *SubmitIIIFJobRequest, opts ...grpc.CallOption) (*Job, error)
+	// GetJob returns a job's current state and progress
+	GetJob(ctx context.Context, in *GetJobRequest, opts ...grpc.CallOption) (*Job, error)
+	// ListJobs lists jobs, newest first
+	ListJobs(ctx context.Context, in *ListJobsRequest, opts ...grpc.CallOption) (*ListJobsResponse, error)
+	// CancelJob stops a queued or running job. Canceling a finished job is an error
+	CancelJob(ctx context.Context, in *CancelJobRequest, opts ...grpc.CallOption) (*Job, error)
+	// WatchJob streams a job's events as they happen, plus its counters every
+	// progress_interval, and ends once the job finishes. To resume after a
+	// disconnect, pass the cursor of the last event received
+	WatchJob(ctx context.Context, in *WatchJobRequest, opts ...grpc.CallOption) (ScrapeService_WatchJobClient, error)
+	// ListImages lists the images a job found, in the order they were found
+	ListImages(ctx context.Context, in *ListImagesRequest, opts ...grpc.CallOption) (*ListImagesResponse, error)
+}
+
+type scrapeServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewScrapeServiceClient(cc grpc.ClientConnInterface) ScrapeServiceClient {
+	return &scrapeServiceClient{cc}
+}
+
+func (c *scrapeServiceClient) SubmitCrawlJob(ctx context.Context, in *SubmitCrawlJobRequest, opts ...grpc.CallOption) (*Job, error) {
+	out := new(Job)
+	err := c.cc.Invoke(ctx, ScrapeService_SubmitCrawlJob_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *scrapeServiceClient) SubmitIIIFJob(ctx context.Context, in *SubmitIIIFJobRequest, opts ...grpc.CallOption) (*Job, error) {
+	out := new(Job)
+	err := c.cc.Invoke(ctx, ScrapeService_SubmitIIIFJob_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *scrapeServiceClient) GetJob(ctx context.Context, in *GetJobRequest, opts ...grpc.CallOption) (*Job, error) {
+	out := new(Job)
+	err := c.cc.Invoke(ctx, ScrapeService_GetJob_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *scrapeServiceClient) ListJobs(ctx context.Context, in *ListJobsRequest, opts ...grpc.CallOption) (*ListJobsResponse, error) {
+	out := new(ListJobsResponse)
+	err := c.cc.Invoke(ctx, ScrapeService_ListJobs_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *scrapeServiceClient) CancelJob(ctx context.Context, in *CancelJobRequest, opts ...grpc.CallOption) (*Job, error) {
+	out := new(Job)
+	err := c.cc.Invoke(ctx, ScrapeService_CancelJob_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *scrapeServiceClient) WatchJob(ctx context.Context, in *WatchJobRequest, opts ...grpc.CallOption) (ScrapeService_WatchJobClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ScrapeService_ServiceDesc.Streams[0], ScrapeService_WatchJob_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &scrapeServiceWatchJobClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ScrapeService_WatchJobClient interface {
+	Recv() (*JobEvent, error)
+	grpc.ClientStream
+}
+
+type scrapeServiceWatchJobClient struct {
+	grpc.ClientStream
+}
+
+func (x *scrapeServiceWatchJobClient) Recv() (*JobEvent, error) {
+	m := new(JobEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *scrapeServiceClient) ListImages(ctx context.Context, in *ListImagesRequest, opts ...grpc.CallOption) (*ListImagesResponse, error) {
+	out := new(ListImagesResponse)
+	err := c.cc.Invoke(ctx, ScrapeService_ListImages_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ScrapeServiceServer is the server API for ScrapeService service.
+// All implementations should embed UnimplementedScrapeServiceServer
+// for forward compatibility
+type ScrapeServiceServer interface {
+	// SubmitCrawlJob queues a job crawling web pages for images
+	SubmitCrawlJob(context.Context, *SubmitCrawlJobRequest) (*Job, error)
+	// SubmitIIIFJob queues a job downloading images from a IIIF image server
+	SubmitIIIFJob(context.Context, *SubmitIIIFJobRequest) (*Job, error)
+	// GetJob returns a job's current state and progress
+	GetJob(context.Context, *GetJobRequest) (*Job, error)
+	// ListJobs lists jobs, newest first
+	ListJobs(context.Context, *ListJobsRequest) (*ListJobsResponse, error)
+	// CancelJob stops a queued or running job. Canceling a finished job is an error
+	CancelJob(context.Context, *CancelJobRequest) (*Job, error)
+	// WatchJob streams a job's events as they happen, plus its counters every
+	// progress_interval, and ends once the job finishes. To resume after a
+	// disconnect, pass the cursor of the last event received
+	WatchJob(*WatchJobRequest, ScrapeService_WatchJobServer) error
+	// ListImages lists the images a job found, in the order they were found
+	ListImages(context.Context, *ListImagesRequest) (*ListImagesResponse, error)
+}
+
+// UnimplementedScrapeServiceServer should be embedded to have forward compatible implementations.
+type UnimplementedScrapeServiceServer struct {
+}
+
+func (UnimplementedScrapeServiceServer) SubmitCrawlJob(context.Context, *SubmitCrawlJobRequest) (*Job, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SubmitCrawlJob not implemented")
+}
+func (UnimplementedScrapeServiceServer) SubmitIIIFJob(context.Context, *SubmitIIIFJobRequest) (*Job, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SubmitIIIFJob not implemented")
+}
+func (UnimplementedScrapeServiceServer) GetJob(context.Context, *GetJobRequest) (*Job, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetJob not implemented")
+}
+func (UnimplementedScrapeServiceServer) ListJobs(context.Context, *ListJobsRequest) (*ListJobsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListJobs not implemented")
+}
+func (UnimplementedScrapeServiceServer) CancelJob(context.Context, *CancelJobRequest) (*Job, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CancelJob not implemented")
+}
+func (UnimplementedScrapeServiceServer) WatchJob(*WatchJobRequest, ScrapeService_WatchJobServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchJob not implemented")
+}
+func (UnimplementedScrapeServiceServer) ListImages(context.Context, *ListImagesRequest) (*ListImagesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListImages not implemented")
+}
+
+// UnsafeScrapeServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ScrapeServiceServer will
+// result in compilation errors.
+type UnsafeScrapeServiceServer interface {
+	mustEmbedUnimplementedScrapeServiceServer()
+}
+
+func RegisterScrapeServiceServer(s grpc.ServiceRegistrar, srv ScrapeServiceServer) {
+	s.RegisterService(&ScrapeService_ServiceDesc, srv)
+}
+
+func _ScrapeService_SubmitCrawlJob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SubmitCrawlJobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ScrapeServiceServer).SubmitCrawlJob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ScrapeService_SubmitCrawlJob_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ScrapeServiceServer).SubmitCrawlJob(ctx, req.(*SubmitCrawlJobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ScrapeService_SubmitIIIFJob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SubmitIIIFJobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ScrapeServiceServer).SubmitIIIFJob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ScrapeService_SubmitIIIFJob_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ScrapeServiceServer).SubmitIIIFJob(ctx, req.(*SubmitIIIFJobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ScrapeService_GetJob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetJobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ScrapeServiceServer).GetJob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ScrapeService_GetJob_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ScrapeServiceServer).GetJob(ctx, req.(*GetJobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ScrapeService_ListJobs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListJobsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ScrapeServiceServer).ListJobs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ScrapeService_ListJobs_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ScrapeServiceServer).ListJobs(ctx, req.(*ListJobsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ScrapeService_CancelJob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CancelJobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ScrapeServiceServer).CancelJob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ScrapeService_CancelJob_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ScrapeServiceServer).CancelJob(ctx, req.(*CancelJobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ScrapeService_WatchJob_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchJobRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ScrapeServiceServer).WatchJob(m, &scrapeServiceWatchJobServer{stream})
+}
+
+type ScrapeService_WatchJobServer interface {
+	Send(*JobEvent) error
+	grpc.ServerStream
+}
+
+type scrapeServiceWatchJobServer struct {
+	grpc.ServerStream
+}
+
+func (x *scrapeServiceWatchJobServer) Send(m *JobEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _ScrapeService_ListImages_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListImagesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ScrapeServiceServer).ListImages(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ScrapeService_ListImages_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ScrapeServiceServer).ListImages(ctx, req.(*ListImagesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ScrapeService_ServiceDesc is the grpc.ServiceDesc for ScrapeService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ScrapeService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "imgscrape.v1.ScrapeService",
+	HandlerType: (*ScrapeServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SubmitCrawlJob",
+			Handler:    _ScrapeService_SubmitCrawlJob_Handler,
+		},
+		{
+			MethodName: "SubmitIIIFJob",
+			Handler:    _ScrapeService_SubmitIIIFJob_Handler,
+		},
+		{
+			MethodName: "GetJob",
+			Handler:    _ScrapeService_GetJob_Handler,
+		},
+		{
+			MethodName: "ListJobs",
+			Handler:    _ScrapeService_ListJobs_Handler,
+		},
+		{
+			MethodName: "CancelJob",
+			Handler:    _ScrapeService_CancelJob_Handler,
+		},
+		{
+			MethodName: "ListImages",
+			Handler:    _ScrapeService_ListImages_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchJob",
+			Handler:       _ScrapeService_WatchJob_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "imgscrape/v1/service.proto",
+}
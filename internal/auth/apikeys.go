@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type apiKey struct {
+	Name   string  `json:"name"`
+	SHA256 string  `json:"sha256"`
+	Scopes []Scope `json:"scopes"`
+}
+
+// LoadAPIKeys reads a JSON list of service account keys. Only each key's SHA-256 is
+// stored, so the file doesn't hold usable secrets:
+//
+//	[{"name": "ingest-bot", "sha256": "<hex of sha256(key)>", "scopes": ["read", "write"]}]
+//
+// A key's name is its caller's subject
+func LoadAPIKeys(path string) (map[[sha256.Size]byte]apiKey, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []apiKey
+	if err = json.Unmarshal(buf, &list); err != nil {
+		return nil, fmt.Errorf("failed parsing API keys %s: %w", path, err)
+	}
+
+	keys := make(map[[sha256.Size]byte]apiKey, len(list))
+	for i, k := range list {
+		if k.Name == "" {
+			return nil, fmt.Errorf("API key %d in %s has no name", i, path)
+		}
+
+		sum, err := hex.DecodeString(strings.TrimSpace(k.SHA256))
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("API key %s in %s has a bad sha256", k.Name, path)
+		}
+
+		var hash [sha256.Size]byte
+		copy(hash[:], sum)
+		if _, ok := keys[hash]; ok {
+			return nil, fmt.Errorf("API key %s in %s is a duplicate", k.Name, path)
+		}
+
+		keys[hash] = k
+	}
+
+	return keys, nil
+}
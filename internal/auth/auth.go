@@ -0,0 +1,217 @@
+// Package auth authenticates API callers from bearer tokens: JWTs signed by a key in
+// a JWKS, read from a local file or an identity provider's URL, or static API keys
+// for service accounts
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrNotConfigured = errors.New("no JWKS or API keys configured")
+	ErrNoToken       = errors.New("no bearer token")
+	ErrInvalidToken  = errors.New("invalid bearer token")
+)
+
+// Scope is a permission granted to a caller. These match the OAuth2 scopes
+// advertised in the OpenAPI spec
+type Scope string
+
+const (
+	ScopeRead  Scope = "read"
+	ScopeWrite Scope = "write"
+
+	// ScopeAdmin implies every other scope
+	ScopeAdmin Scope = "admin"
+)
+
+// Method is how a caller authenticated
+type Method string
+
+const (
+	MethodJWT    Method = "jwt"
+	MethodAPIKey Method = "api_key"
+)
+
+// Identity is an authenticated caller
+type Identity struct {
+	// Subject is the JWT's sub claim, or the API key's name
+	Subject string
+	Method  Method
+	Scopes  []Scope
+}
+
+// Has reports whether the caller was granted scope
+func (i *Identity) Has(scope Scope) bool {
+	for _, s := range i.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
+
+type ctxKey struct{}
+
+// NewContext returns a copy of ctx carrying id
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// FromContext returns the caller in ctx, or nil if there isn't one
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(ctxKey{}).(*Identity)
+	return id
+}
+
+// Options configure an Authenticator. At least one of JWKSFile, JWKSURL and
+// APIKeysFile is required
+type Options struct {
+	// JWKSFile is a JSON Web Key Set whose keys sign accepted JWTs
+	JWKSFile string
+
+	// JWKSURL is the same served over HTTP; see FetchJWKS. Only one of JWKSFile
+	// and JWKSURL may be set
+	JWKSURL string
+
+	// HTTPClient fetches JWKSURL. Defaults to a client with a 10s timeout
+	HTTPClient *http.Client
+
+	// Issuer and Audience, if set, must match the JWT's iss and aud claims
+	Issuer   string
+	Audience string
+
+	// Leeway is how much clock skew is allowed when checking the exp, nbf and iat claims
+	Leeway time.Duration
+
+	// APIKeysFile lists static API keys; see LoadAPIKeys
+	APIKeysFile string
+}
+
+// Authenticator turns bearer tokens into identities
+type Authenticator struct {
+	keys    *KeySet
+	apiKeys map[[sha256.Size]byte]apiKey
+	parser  *jwt.Parser
+}
+
+// New loads the keys in opts
+func New(opts Options) (*Authenticator, error) {
+	if opts.JWKSFile == "" && opts.JWKSURL == "" && opts.APIKeysFile == "" {
+		return nil, ErrNotConfigured
+	}
+
+	if opts.JWKSFile != "" && opts.JWKSURL != "" {
+		return nil, errors.New("only one of a JWKS file and URL may be set")
+	}
+
+	a := &Authenticator{}
+	if opts.JWKSFile != "" || opts.JWKSURL != "" {
+		var keys *KeySet
+		var err error
+		if opts.JWKSFile != "" {
+			keys, err = LoadJWKS(opts.JWKSFile)
+		} else {
+			client := opts.HTTPClient
+			if client == nil {
+				client = &http.Client{Timeout: 10 * time.Second}
+			}
+
+			keys, err = FetchJWKS(client, opts.JWKSURL)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		parserOpts := []jwt.ParserOption{
+			jwt.WithValidMethods(keys.Algorithms()),
+			jwt.WithExpirationRequired(),
+			jwt.WithLeeway(opts.Leeway),
+		}
+
+		if opts.Issuer != "" {
+			parserOpts = append(parserOpts, jwt.WithIssuer(opts.Issuer))
+		}
+
+		if opts.Audience != "" {
+			parserOpts = append(parserOpts, jwt.WithAudience(opts.Audience))
+		}
+
+		a.keys, a.parser = keys, jwt.NewParser(parserOpts...)
+	}
+
+	if opts.APIKeysFile != "" {
+		apiKeys, err := LoadAPIKeys(opts.APIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+
+		a.apiKeys = apiKeys
+	}
+
+	return a, nil
+}
+
+// Authenticate checks an Authorization header value of the form "Bearer <token>"
+func (a *Authenticator) Authenticate(header string) (*Identity, error) {
+	scheme, token, _ := strings.Cut(strings.TrimSpace(header), " ")
+	if token = strings.TrimSpace(token); !strings.EqualFold(scheme, "bearer") || token == "" {
+		return nil, ErrNoToken
+	}
+
+	// map lookups by hash don't leak how much of a key matched
+	if k, ok := a.apiKeys[sha256.Sum256([]byte(token))]; ok {
+		return &Identity{Subject: k.Name, Method: MethodAPIKey, Scopes: k.Scopes}, nil
+	}
+
+	if a.parser == nil {
+		return nil, ErrInvalidToken
+	}
+
+	var claims struct {
+		jwt.RegisteredClaims
+
+		// identity providers disagree on the claim's name and on whether it's
+		// a space separated string or a list
+		Scope scopeList `json:"scope"`
+		Scp   scopeList `json:"scp"`
+	}
+
+	if _, err := a.parser.ParseWithClaims(token, &claims, a.keys.Keyfunc); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: no sub claim", ErrInvalidToken)
+	}
+
+	id := &Identity{Subject: claims.Subject, Method: MethodJWT}
+	for _, s := range append(claims.Scope, claims.Scp...) {
+		id.Scopes = append(id.Scopes, Scope(s))
+	}
+
+	return id, nil
+}
+
+type scopeList []string
+
+func (s *scopeList) UnmarshalJSON(buf []byte) error {
+	var str string
+	if err := json.Unmarshal(buf, &str); err == nil {
+		*s = strings.Fields(str)
+		return nil
+	}
+
+	return json.Unmarshal(buf, (*[]string)(s))
+}
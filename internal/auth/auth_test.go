@@ -0,0 +1,331 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	issuer   = "https://idp.example"
+	audience = "imgscrape"
+	kid      = "k1"
+)
+
+// jwksServer serves key's public half as kid from a local JWKS endpoint
+func jwksServer(t *testing.T, key *rsa.PrivateKey) *httptest.Server {
+	t.Helper()
+
+	set := map[string]any{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestAuthenticateJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := jwksServer(t, key)
+	a, err := New(Options{
+		JWKSURL:    srv.URL,
+		HTTPClient: srv.Client(),
+		Issuer:     issuer,
+		Audience:   audience,
+		Leeway:     30 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})
+
+	now := time.Now()
+	claims := func(change func(jwt.MapClaims)) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"sub":   "team-a",
+			"iss":   issuer,
+			"aud":   audience,
+			"exp":   now.Add(time.Hour).Unix(),
+			"iat":   now.Unix(),
+			"scope": "read write",
+		}
+
+		if change != nil {
+			change(c)
+		}
+
+		return c
+	}
+
+	sign := func(method jwt.SigningMethod, signingKey any, c jwt.MapClaims, header map[string]any) string {
+		tok := jwt.NewWithClaims(method, c)
+		tok.Header["kid"] = kid
+		for k, v := range header {
+			tok.Header[k] = v
+		}
+
+		s, err := tok.SignedString(signingKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return s
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		wantScopes []Scope
+		wantErr    error
+	}{
+		{
+			name:       "valid",
+			token:      sign(jwt.SigningMethodRS256, key, claims(nil), nil),
+			wantScopes: []Scope{ScopeRead, ScopeWrite},
+		},
+		{
+			name:       "valid with other RSA algorithm",
+			token:      sign(jwt.SigningMethodPS256, key, claims(nil), nil),
+			wantScopes: []Scope{ScopeRead, ScopeWrite},
+		},
+		{
+			name: "scp claim as a list",
+			token: sign(jwt.SigningMethodRS256, key, claims(func(c jwt.MapClaims) {
+				delete(c, "scope")
+				c["scp"] = []string{"admin"}
+			}), nil),
+			wantScopes: []Scope{ScopeAdmin},
+		},
+		{
+			name: "audience in a list",
+			token: sign(jwt.SigningMethodRS256, key, claims(func(c jwt.MapClaims) {
+				c["aud"] = []string{"someone-else", audience}
+			}), nil),
+			wantScopes: []Scope{ScopeRead, ScopeWrite},
+		},
+		{
+			name:       "no kid with a single key",
+			token:      sign(jwt.SigningMethodRS256, key, claims(nil), map[string]any{"kid": nil}),
+			wantScopes: []Scope{ScopeRead, ScopeWrite},
+		},
+		{
+			name: "expired within leeway",
+			token: sign(jwt.SigningMethodRS256, key, claims(func(c jwt.MapClaims) {
+				c["exp"] = now.Add(-10 * time.Second).Unix()
+			}), nil),
+			wantScopes: []Scope{ScopeRead, ScopeWrite},
+		},
+		{
+			name: "expired",
+			token: sign(jwt.SigningMethodRS256, key, claims(func(c jwt.MapClaims) {
+				c["exp"] = now.Add(-time.Minute).Unix()
+			}), nil),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name: "no expiry",
+			token: sign(jwt.SigningMethodRS256, key, claims(func(c jwt.MapClaims) {
+				delete(c, "exp")
+			}), nil),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name: "not valid yet",
+			token: sign(jwt.SigningMethodRS256, key, claims(func(c jwt.MapClaims) {
+				c["nbf"] = now.Add(time.Minute).Unix()
+			}), nil),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name: "wrong audience",
+			token: sign(jwt.SigningMethodRS256, key, claims(func(c jwt.MapClaims) {
+				c["aud"] = "someone-else"
+			}), nil),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name: "no audience",
+			token: sign(jwt.SigningMethodRS256, key, claims(func(c jwt.MapClaims) {
+				delete(c, "aud")
+			}), nil),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name: "wrong issuer",
+			token: sign(jwt.SigningMethodRS256, key, claims(func(c jwt.MapClaims) {
+				c["iss"] = "https://evil.example"
+			}), nil),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name: "no subject",
+			token: sign(jwt.SigningMethodRS256, key, claims(func(c jwt.MapClaims) {
+				delete(c, "sub")
+			}), nil),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "alg none",
+			token:   sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, claims(nil), nil),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			// the public key is no secret, so HMAC with it must never verify
+			name:    "HS256 signed with the RSA public key",
+			token:   sign(jwt.SigningMethodHS256, pubPEM, claims(nil), nil),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "HS256 signed with the RSA public key's DER",
+			token:   sign(jwt.SigningMethodHS256, pub, claims(nil), nil),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "signed by another key",
+			token:   sign(jwt.SigningMethodRS256, other, claims(nil), nil),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "unknown kid",
+			token:   sign(jwt.SigningMethodRS256, key, claims(nil), map[string]any{"kid": "k2"}),
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "garbage",
+			token:   "not.a.jwt",
+			wantErr: ErrInvalidToken,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			id, err := a.Authenticate("Bearer " + tc.token)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("got err %v, want %v", err, tc.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if id.Subject != "team-a" || id.Method != MethodJWT {
+				t.Fatalf("got %+v, want team-a by JWT", id)
+			}
+
+			if !reflect.DeepEqual(id.Scopes, tc.wantScopes) {
+				t.Fatalf("scopes %v, want %v", id.Scopes, tc.wantScopes)
+			}
+		})
+	}
+}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	sum := sha256.Sum256([]byte("s3cret"))
+	path := filepath.Join(t.TempDir(), "keys.json")
+	keys := `[{"name": "ingest-bot", "sha256": "` + hex.EncodeToString(sum[:]) + `", "scopes": ["read"]}]`
+	if err := os.WriteFile(path, []byte(keys), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New(Options{APIKeysFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		header  string
+		wantErr error
+	}{
+		{header: "Bearer s3cret"},
+		{header: "bearer   s3cret "},
+		{header: "Bearer s3cre", wantErr: ErrInvalidToken},
+		{header: "Basic s3cret", wantErr: ErrNoToken},
+		{header: "Bearer ", wantErr: ErrNoToken},
+		{header: "", wantErr: ErrNoToken},
+	}
+
+	for _, tc := range tests {
+		id, err := a.Authenticate(tc.header)
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("Authenticate(%q): got err %v, want %v", tc.header, err, tc.wantErr)
+			continue
+		}
+
+		if err == nil && (id.Subject != "ingest-bot" || id.Method != MethodAPIKey || !id.Has(ScopeRead) || id.Has(ScopeWrite)) {
+			t.Errorf("Authenticate(%q) = %+v", tc.header, id)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{name: "nothing configured", opts: Options{}},
+		{name: "JWKS file and URL", opts: Options{JWKSFile: "jwks.json", JWKSURL: srv.URL}},
+		{name: "JWKS URL not found", opts: Options{JWKSURL: srv.URL}},
+		{name: "missing JWKS file", opts: Options{JWKSFile: filepath.Join(t.TempDir(), "jwks.json")}},
+	}
+
+	for _, tc := range tests {
+		if _, err := New(tc.opts); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
+
+func TestIdentityHas(t *testing.T) {
+	admin := &Identity{Scopes: []Scope{ScopeAdmin}}
+	reader := &Identity{Scopes: []Scope{ScopeRead}}
+
+	if !admin.Has(ScopeWrite) || !admin.Has(ScopeRead) {
+		t.Error("admin should imply every scope")
+	}
+
+	if !reader.Has(ScopeRead) || reader.Has(ScopeWrite) || reader.Has(ScopeAdmin) {
+		t.Error("read should only grant read")
+	}
+}
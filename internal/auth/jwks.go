@@ -0,0 +1,253 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// algorithms each key type may sign with. Symmetric keys aren't supported, so a
+// public key can never be mistaken for an HMAC secret
+var rsaAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}
+
+var curves = map[string]struct {
+	curve elliptic.Curve
+	alg   string
+}{
+	"P-256": {elliptic.P256(), "ES256"},
+	"P-384": {elliptic.P384(), "ES384"},
+	"P-521": {elliptic.P521(), "ES512"},
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// EC and OKP
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type key struct {
+	public any
+	algs   []string
+}
+
+// KeySet is the public keys of a JWKS, by key ID
+type KeySet struct {
+	keys map[string]key
+}
+
+// LoadJWKS reads a JSON Web Key Set. RSA, EC (P-256, P-384, P-521) and Ed25519 keys
+// are supported; encryption keys are skipped
+func LoadJWKS(path string) (*KeySet, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseJWKS(buf, path)
+}
+
+// FetchJWKS is LoadJWKS for a key set served over HTTP, such as an identity
+// provider's jwks_uri. It's fetched once; a rotated key needs a restart to be picked up
+func FetchJWKS(client *http.Client, url string) (*KeySet, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed fetching JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed fetching JWKS %s: %s", url, resp.Status)
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, maxJWKSBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed fetching JWKS %s: %w", url, err)
+	}
+
+	return parseJWKS(buf, url)
+}
+
+// maxJWKSBytes is far more than any real key set, so a misconfigured URL can't
+// make the server buffer something huge
+const maxJWKSBytes = 1 << 20
+
+func parseJWKS(buf []byte, src string) (*KeySet, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	if err := json.Unmarshal(buf, &set); err != nil {
+		return nil, fmt.Errorf("failed parsing JWKS %s: %w", src, err)
+	}
+
+	ks := &KeySet{keys: make(map[string]key, len(set.Keys))}
+	for i, k := range set.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+
+		parsed, err := k.parse()
+		if err != nil {
+			return nil, fmt.Errorf("JWKS %s key %d (kid %q): %w", src, i, k.Kid, err)
+		}
+
+		if _, ok := ks.keys[k.Kid]; ok {
+			return nil, fmt.Errorf("JWKS %s has more than one key with kid %q", src, k.Kid)
+		}
+
+		ks.keys[k.Kid] = parsed
+	}
+
+	if len(ks.keys) == 0 {
+		return nil, fmt.Errorf("JWKS %s has no signing keys", src)
+	}
+
+	return ks, nil
+}
+
+func (k *jwk) parse() (key, error) {
+	var out key
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return out, fmt.Errorf("bad n: %w", err)
+		}
+
+		e, err := decodeInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return out, fmt.Errorf("bad e %q", k.E)
+		}
+
+		out = key{public: &rsa.PublicKey{N: n, E: int(e.Int64())}, algs: rsaAlgorithms}
+	case "EC":
+		c, ok := curves[k.Crv]
+		if !ok {
+			return out, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return out, fmt.Errorf("bad x: %w", err)
+		}
+
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return out, fmt.Errorf("bad y: %w", err)
+		}
+
+		if !c.curve.IsOnCurve(x, y) {
+			return out, fmt.Errorf("point isn't on %s", k.Crv)
+		}
+
+		out = key{public: &ecdsa.PublicKey{Curve: c.curve, X: x, Y: y}, algs: []string{c.alg}}
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return out, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return out, fmt.Errorf("bad x")
+		}
+
+		out = key{public: ed25519.PublicKey(x), algs: []string{"EdDSA"}}
+	default:
+		return out, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+
+	if k.Alg != "" {
+		if !contains(out.algs, k.Alg) {
+			return out, fmt.Errorf("alg %s doesn't fit a %s key", k.Alg, k.Kty)
+		}
+
+		out.algs = []string{k.Alg}
+	}
+
+	return out, nil
+}
+
+// Algorithms lists every signing algorithm the set's keys accept
+func (ks *KeySet) Algorithms() []string {
+	seen := map[string]bool{}
+	for _, k := range ks.keys {
+		for _, alg := range k.algs {
+			seen[alg] = true
+		}
+	}
+
+	algs := make([]string, 0, len(seen))
+	for alg := range seen {
+		algs = append(algs, alg)
+	}
+
+	sort.Strings(algs)
+	return algs
+}
+
+// Keyfunc picks the key for a token by its kid header. Tokens without one are
+// accepted only if the set has a single key
+func (ks *KeySet) Keyfunc(t *jwt.Token) (any, error) {
+	kid, _ := t.Header["kid"].(string)
+
+	k, ok := ks.keys[kid]
+	if !ok && kid == "" && len(ks.keys) == 1 {
+		for _, only := range ks.keys {
+			k, ok = only, true
+		}
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+
+	if alg := t.Method.Alg(); !contains(k.algs, alg) {
+		return nil, fmt.Errorf("key %q doesn't sign with %s", kid, alg)
+	}
+
+	return k.public, nil
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buf) == 0 {
+		return nil, fmt.Errorf("empty")
+	}
+
+	return new(big.Int).SetBytes(buf), nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"context"
+
+	"golang.org/x/exp/slog"
+)
+
+// LogHandler adds the caller in a record's context, if any, as a "caller" attribute
+type LogHandler struct {
+	slog.Handler
+}
+
+// NewLogHandler wraps h
+func NewLogHandler(h slog.Handler) *LogHandler {
+	return &LogHandler{Handler: h}
+}
+
+func (h *LogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := FromContext(ctx); id != nil {
+		r.AddAttrs(slog.Group("caller",
+			slog.String("subject", id.Subject),
+			slog.String("method", string(id.Method)),
+		))
+	}
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *LogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &LogHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *LogHandler) WithGroup(name string) slog.Handler {
+	return &LogHandler{Handler: h.Handler.WithGroup(name)}
+}
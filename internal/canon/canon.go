@@ -0,0 +1,303 @@
+package canon
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// DefaultTrackingParams are query parameters that never change the resource being
+// pointed to. Entries ending in '*' match by prefix
+var DefaultTrackingParams = []string{
+	"utm_*",
+	"fbclid",
+	"gclid",
+	"gclsrc",
+	"dclid",
+	"msclkid",
+	"yclid",
+	"igshid",
+	"mc_cid",
+	"mc_eid",
+	"_ga",
+	"_gl",
+	"_hsenc",
+	"_hsmi",
+	"mkt_tok",
+	"ref_src",
+	"jsessionid",
+	"phpsessid",
+	"sessionid",
+	"aspsessionid*",
+	"cfid",
+	"cftoken",
+}
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// Canonicalizer normalizes URLs so the same resource always maps to the same string
+type Canonicalizer struct {
+	exact    map[string]bool
+	prefixes []string
+}
+
+// Default strips DefaultTrackingParams
+var Default = New(DefaultTrackingParams...)
+
+// New creates a canonicalizer that strips the given query parameters. Matching is
+// case insensitive, and a trailing '*' matches any parameter with that prefix
+func New(trackingParams ...string) *Canonicalizer {
+	c := &Canonicalizer{exact: map[string]bool{}}
+	for _, p := range trackingParams {
+		p = strings.ToLower(strings.TrimSpace(p))
+		switch {
+		case p == "":
+		case strings.HasSuffix(p, "*"):
+			c.prefixes = append(c.prefixes, strings.TrimSuffix(p, "*"))
+		default:
+			c.exact[p] = true
+		}
+	}
+
+	return c
+}
+
+// With returns a copy of c that also strips the given parameters
+func (c *Canonicalizer) With(trackingParams ...string) *Canonicalizer {
+	params := make([]string, 0, len(c.exact)+len(c.prefixes)+len(trackingParams))
+	for p := range c.exact {
+		params = append(params, p)
+	}
+
+	for _, p := range c.prefixes {
+		params = append(params, p+"*")
+	}
+
+	return New(append(params, trackingParams...)...)
+}
+
+// String parses and canonicalizes a URL
+func (c *Canonicalizer) String(rawURL string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return "", err
+	}
+
+	if !u.IsAbs() {
+		return "", fmt.Errorf("can't canonicalize relative URL %q", rawURL)
+	}
+
+	return c.URL(u).String(), nil
+}
+
+// URL returns a canonical copy of u:
+//
+//   - scheme and host are lowercased, a trailing dot on the host and the scheme's default port are removed
+//   - dot segments are resolved, ";jsessionid=..." style path parameters are dropped and an empty path becomes "/".
+//     Empty segments are kept: /a//b isn't /a/b
+//   - percent-encoding is normalized, so "%7e" and "~" compare equal
+//   - tracking parameters are removed and the rest are sorted by key, then value. Keys
+//     without a value, like ?download, stay that way
+//   - the fragment is removed
+func (c *Canonicalizer) URL(u *url.URL) *url.URL {
+	out := *u
+	out.Scheme = strings.ToLower(u.Scheme)
+	out.Host = c.host(out.Scheme, u.Host)
+	out.Fragment, out.RawFragment = "", ""
+	out.ForceQuery = false
+
+	if u.Opaque == "" {
+		p := c.path(u.EscapedPath())
+		if decoded, err := url.PathUnescape(p); err == nil {
+			out.Path, out.RawPath = decoded, p
+		}
+	}
+
+	out.RawQuery = c.query(u.RawQuery)
+	return &out
+}
+
+func (c *Canonicalizer) host(scheme, host string) string {
+	host = strings.ToLower(host)
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return strings.TrimSuffix(host, ".")
+	}
+
+	h = strings.TrimSuffix(h, ".")
+	if port == "" || defaultPorts[scheme] == port {
+		if strings.Contains(h, ":") {
+			return "[" + h + "]"
+		}
+
+		return h
+	}
+
+	return net.JoinHostPort(h, port)
+}
+
+func (c *Canonicalizer) path(escaped string) string {
+	segments := strings.Split(escaped, "/")
+	for i, s := range segments {
+		if name, params, ok := strings.Cut(s, ";"); ok {
+			if key, _, _ := strings.Cut(params, "="); c.tracking(key) {
+				segments[i] = name
+			}
+		}
+
+		segments[i] = normalizeEscapes(segments[i])
+	}
+
+	p := strings.Join(removeDotSegments(segments), "/")
+	if p == "" {
+		return "/"
+	}
+
+	return p
+}
+
+// removeDotSegments resolves "." and ".." segments (RFC 3986 section 5.2.4). Unlike
+// path.Clean it keeps empty ones: plenty of servers, S3 among them, treat a//b and a/b
+// as different resources
+func removeDotSegments(segments []string) []string {
+	out := make([]string, 0, len(segments))
+	for i, s := range segments {
+		switch s {
+		case ".":
+		case "..":
+			// the first segment is the empty one before the leading slash
+			if len(out) > 1 {
+				out = out[:len(out)-1]
+			}
+		default:
+			out = append(out, s)
+			continue
+		}
+
+		// /a/. and /a/b/.. are the directory /a/
+		if i == len(segments)-1 {
+			out = append(out, "")
+		}
+	}
+
+	return out
+}
+
+func (c *Canonicalizer) query(raw string) string {
+	if raw == "" {
+		return ""
+	}
+
+	type pair struct {
+		key, value string
+		hasValue   bool
+	}
+	var pairs []pair
+	for _, kv := range strings.Split(raw, "&") {
+		if kv == "" {
+			continue
+		}
+
+		k, v, hasValue := strings.Cut(kv, "=")
+		key, err := url.QueryUnescape(k)
+		if err != nil {
+			key = k
+		}
+
+		if c.tracking(key) {
+			continue
+		}
+
+		value, err := url.QueryUnescape(v)
+		if err != nil {
+			value = v
+		}
+
+		pairs = append(pairs, pair{key, value, hasValue})
+	}
+
+	sort.SliceStable(pairs, func(i, j int) bool {
+		if pairs[i].key != pairs[j].key {
+			return pairs[i].key < pairs[j].key
+		}
+
+		return pairs[i].value < pairs[j].value
+	})
+
+	parts := make([]string, len(pairs))
+	for i, p := range pairs {
+		parts[i] = url.QueryEscape(p.key)
+		if p.hasValue {
+			parts[i] += "=" + url.QueryEscape(p.value)
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+func (c *Canonicalizer) tracking(param string) bool {
+	param = strings.ToLower(param)
+	if c.exact[param] {
+		return true
+	}
+
+	for _, p := range c.prefixes {
+		if strings.HasPrefix(param, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// normalizeEscapes uppercases percent-encoding hex digits and decodes escaped
+// unreserved characters (RFC 3986 section 6.2.2)
+func normalizeEscapes(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		v := unhex(s[i+1])<<4 | unhex(s[i+2])
+		if isUnreserved(v) {
+			b.WriteByte(v)
+		} else {
+			b.WriteString(strings.ToUpper(s[i : i+3]))
+		}
+
+		i += 2
+	}
+
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+func isUnreserved(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
@@ -0,0 +1,93 @@
+package canon
+
+import "testing"
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		// scheme and host
+		{"lowercases scheme and host", "HTTP://Example.COM/Path", "http://example.com/Path"},
+		{"removes the default http port", "http://example.com:80/a", "http://example.com/a"},
+		{"removes the default https port", "https://example.com:443/a", "https://example.com/a"},
+		{"keeps other ports", "https://example.com:8443/a", "https://example.com:8443/a"},
+		{"keeps the other scheme's default port", "https://example.com:80/a", "https://example.com:80/a"},
+		{"removes the host's trailing dot", "http://example.com./a", "http://example.com/a"},
+		{"IPv6 host", "http://[2001:DB8::1]/a", "http://[2001:db8::1]/a"},
+		{"IPv6 host with the default port", "http://[2001:db8::1]:80/a", "http://[2001:db8::1]/a"},
+		{"IPv6 host with another port", "http://[::1]:8080/a", "http://[::1]:8080/a"},
+
+		// path
+		{"empty path", "http://example.com", "http://example.com/"},
+		{"empty path with a query", "http://example.com?a=1", "http://example.com/?a=1"},
+		{"dot segments", "http://example.com/a/./b/../c", "http://example.com/a/c"},
+		{"dot segments above the root", "http://example.com/../../a", "http://example.com/a"},
+		{"trailing dot segment", "http://example.com/a/b/..", "http://example.com/a/"},
+		{"keeps trailing slashes", "http://example.com/a/b/", "http://example.com/a/b/"},
+		{"keeps empty segments", "http://example.com/bucket//key.jpg", "http://example.com/bucket//key.jpg"},
+		{"keeps a leading empty segment", "http://example.com//a", "http://example.com//a"},
+		{"dot dot over an empty segment", "http://example.com/a//../b", "http://example.com/a/b"},
+		{"decodes escaped unreserved characters", "http://example.com/%7euser", "http://example.com/~user"},
+		{"escaped and unescaped tilde match", "http://example.com/~user", "http://example.com/~user"},
+		{"uppercases other escapes", "http://example.com/a%2fb%c3%a9", "http://example.com/a%2Fb%C3%A9"},
+		{"drops jsessionid path parameters", "http://example.com/a;jsessionid=ABC123/img.jpg", "http://example.com/a/img.jpg"},
+		{"drops a final jsessionid path parameter", "http://example.com/img.jpg;JSESSIONID=ABC123", "http://example.com/img.jpg"},
+		{"keeps other path parameters", "http://example.com/img.jpg;v=2", "http://example.com/img.jpg;v=2"},
+
+		// query
+		{"strips tracking parameters", "http://example.com/a?utm_source=x&id=1&fbclid=y", "http://example.com/a?id=1"},
+		{"strips tracking prefixes in any case", "http://example.com/a?UTM_Campaign=x&utm_whatever=y&id=1", "http://example.com/a?id=1"},
+		{"strips wildcard session parameters", "http://example.com/a?ASPSESSIONIDQQ=x&id=1", "http://example.com/a?id=1"},
+		{"only tracking parameters", "http://example.com/a?utm_source=x", "http://example.com/a"},
+		{"keeps valueless keys", "http://example.com/a?download", "http://example.com/a?download"},
+		{"keeps empty values", "http://example.com/a?download=", "http://example.com/a?download="},
+		{"sorts valueless keys with the rest", "http://example.com/a?z=1&download", "http://example.com/a?download&z=1"},
+		{"sorts by key", "http://example.com/a?b=1&a=2", "http://example.com/a?a=2&b=1"},
+		{"sorts repeated keys by value", "http://example.com/a?b=2&a=2&a=1&b=1", "http://example.com/a?a=1&a=2&b=1&b=2"},
+		{"normalizes query escapes", "http://example.com/a?q=a%20b&r=a+b", "http://example.com/a?q=a+b&r=a+b"},
+		{"drops empty pairs", "http://example.com/a?&a=1&&", "http://example.com/a?a=1"},
+		{"drops a bare question mark", "http://example.com/a?", "http://example.com/a"},
+
+		// fragment
+		{"drops the fragment", "http://example.com/a?b=1#section", "http://example.com/a?b=1"},
+		{"trims whitespace", "  http://example.com/a  ", "http://example.com/a"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Default.String(tc.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tc.want {
+				t.Fatalf("String(%q) = %q, want %q", tc.in, got, tc.want)
+			}
+
+			// canonical URLs are fixed points
+			if again, _ := Default.String(got); again != got {
+				t.Fatalf("String(%q) = %q, not idempotent", got, again)
+			}
+		})
+	}
+}
+
+func TestStringRelative(t *testing.T) {
+	if _, err := Default.String("/a/b"); err == nil {
+		t.Fatal("canonicalized a relative URL")
+	}
+}
+
+func TestWith(t *testing.T) {
+	c := New("ref").With("sid", "x_*")
+
+	got, err := c.String("http://example.com/?ref=1&sid=2&x_a=3&utm_source=4&id=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// utm_source isn't one of c's
+	if want := "http://example.com/?id=5&utm_source=4"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
@@ -2,11 +2,21 @@ package cmdline
 
 import (
 	"net/http"
+	"time"
 
+	"github.com/AnthonyHewins/imgscrape/internal/httpcache"
+	"github.com/AnthonyHewins/imgscrape/internal/metrics"
+	"github.com/AnthonyHewins/imgscrape/internal/tracing"
 	"github.com/spf13/cobra"
 	"golang.org/x/exp/slog"
 )
 
+const (
+	HTTPTimeout   = "http-client-timeout"
+	HTTPCacheDir  = "http-cache-dir"
+	HTTPCacheMode = "http-cache-mode"
+)
+
 type App struct {
 	appName    string
 	logger     *slog.Logger
@@ -21,7 +31,22 @@ func NewAppFromCobra(appName string, cmd *cobra.Command) (*App, error) {
 		return nil, err
 	}
 
-	timeout, err := f.GetDuration("http-timeout")
+	timeout, err := f.GetDuration(HTTPTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheDir, err := f.GetString(HTTPCacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheMode, err := f.GetString(HTTPCacheMode)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient, err := NewHTTPClient(timeout, cacheDir, cacheMode)
 	if err != nil {
 		return nil, err
 	}
@@ -29,7 +54,7 @@ func NewAppFromCobra(appName string, cmd *cobra.Command) (*App, error) {
 	return &App{
 		appName:    appName,
 		logger:     logger,
-		httpClient: &http.Client{Timeout: timeout},
+		httpClient: httpClient,
 	}, nil
 }
 
@@ -48,3 +73,32 @@ func NewApp(appName, logLevel, logFmt, exporter string, addSrc bool) (*App, erro
 func (a *App) Logger() *slog.Logger {
 	return a.logger
 }
+
+func (a *App) HTTPClient() *http.Client {
+	if a.httpClient == nil {
+		return http.DefaultClient
+	}
+
+	return a.httpClient
+}
+
+// NewHTTPClient creates an HTTP client, caching responses on disk in cacheDir
+// unless it's blank. cacheMode is one of default | revalidate | changed-only. Requests
+// that actually go out (not cache hits) are traced and counted in metrics
+func NewHTTPClient(timeout time.Duration, cacheDir, cacheMode string) (*http.Client, error) {
+	c := &http.Client{Timeout: timeout, Transport: tracing.Transport(metrics.Transport(nil))}
+	if cacheDir == "" {
+		return c, nil
+	}
+
+	mode, err := httpcache.ParseMode(cacheMode)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Transport, err = httpcache.New(cacheDir, mode, c.Transport); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
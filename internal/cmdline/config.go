@@ -0,0 +1,350 @@
+package cmdline
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/namsral/flag"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFile is the flag every binary reads its config file path from
+const ConfigFile = "config-file"
+
+// EnvPrefix starts the name of every environment variable the binaries read flags from
+const EnvPrefix = "IMGSCRAPE"
+
+// Source is where a setting's value came from
+type Source string
+
+const (
+	SourceDefault Source = "default"
+	SourceFile    Source = "file"
+	SourceEnv     Source = "env"
+	SourceFlag    Source = "flag"
+)
+
+// setting is one flag, whichever flag package defined it
+type setting struct {
+	name   string
+	value  interface{ String() string }
+	set    func(string) error
+	source Source
+}
+
+// Config is the effective configuration of a binary: its flags after the config file and
+// environment were applied. Precedence, highest first: command line flags, environment
+// variables, the config file, the flags' defaults.
+//
+// Environment variables are named after flags, upper cased with dashes as underscores
+// and prefixed with EnvPrefix: -db-host is IMGSCRAPE_DB_HOST. Config files are YAML
+// (.yaml, .yml) or TOML (.toml), keyed by flag name. Nested tables are joined with
+// dashes, so these are the same:
+//
+//	db-host: localhost
+//
+//	db:
+//	  host: localhost
+//
+// Lists are joined with commas. Keys that aren't flags are errors, and every value is
+// parsed by its flag, so a bad file fails at startup. Values end up in the flags, not
+// in typed structs; checking more than each flag's type is up to the binary
+type Config struct {
+	file     string
+	settings []*setting
+}
+
+// NewFlagSet creates the flag set of a binary using the flag package. It reads the
+// environment while parsing, with EnvPrefix
+func NewFlagSet() *flag.FlagSet {
+	return flag.NewFlagSetWithEnvPrefix(os.Args[0], EnvPrefix, flag.ExitOnError)
+}
+
+// LoadFlagConfig loads the config into fs, which must already be parsed with args.
+// fs is expected to come from NewFlagSet, so it's read the environment itself
+func LoadFlagConfig(fs *flag.FlagSet, args []string) (*Config, error) {
+	// the flag package only tells what was set, not whether by args or environment
+	onCommandLine := map[string]bool{}
+	flagArgs := args[:len(args)-fs.NArg()]
+	for i := 0; i < len(flagArgs); i++ {
+		name, _, hasValue := strings.Cut(strings.TrimLeft(flagArgs[i], "-"), "=")
+		f := fs.Lookup(name)
+		if f == nil {
+			continue
+		}
+
+		onCommandLine[name] = true
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !hasValue && !(ok && b.IsBoolFlag()) {
+			i++ // -name value
+		}
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var settings []*setting
+	fs.VisitAll(func(f *flag.Flag) {
+		s := &setting{name: f.Name, value: f.Value, set: f.Value.Set, source: SourceDefault}
+		switch {
+		case onCommandLine[f.Name]:
+			s.source = SourceFlag
+		case set[f.Name]:
+			s.source = SourceEnv
+		}
+
+		settings = append(settings, s)
+	})
+
+	return load(settings, nil)
+}
+
+// LoadCobraConfig loads the config into cmd's flags, local and inherited, after cobra
+// parsed them. Keys in the file are checked against the flags of every command in
+// the tree, so one file can configure all of them
+func LoadCobraConfig(cmd *cobra.Command) (*Config, error) {
+	var settings []*setting
+	add := func(f *pflag.Flag) {
+		s := &setting{name: f.Name, value: f.Value, source: SourceDefault}
+		s.set = func(v string) error {
+			if err := f.Value.Set(v); err != nil {
+				return err
+			}
+
+			f.Changed = true
+			return nil
+		}
+
+		if f.Changed {
+			s.source = SourceFlag
+		}
+
+		settings = append(settings, s)
+	}
+
+	cmd.LocalFlags().VisitAll(add)
+	cmd.InheritedFlags().VisitAll(add)
+
+	known := map[string]bool{}
+	var walk func(*cobra.Command)
+	walk = func(c *cobra.Command) {
+		c.LocalFlags().VisitAll(func(f *pflag.Flag) { known[f.Name] = true })
+		for _, sub := range c.Commands() {
+			walk(sub)
+		}
+	}
+	walk(cmd.Root())
+
+	return load(settings, known)
+}
+
+// EnvName is the environment variable a flag is read from
+func EnvName(name string) string {
+	return strings.ReplaceAll(strings.ToUpper(EnvPrefix+"_"+name), "-", "_")
+}
+
+// load applies the environment (unless the flag package does it itself) and then the
+// config file to whatever wasn't set by something higher up. known, if set, are the
+// keys a file may have on top of settings
+func load(settings []*setting, known map[string]bool) (*Config, error) {
+	byName := make(map[string]*setting, len(settings))
+	for _, s := range settings {
+		byName[s.name] = s
+	}
+
+	// pflag doesn't read the environment
+	if known != nil {
+		for _, s := range settings {
+			v, ok := os.LookupEnv(EnvName(s.name))
+			if !ok || s.source != SourceDefault {
+				continue
+			}
+
+			if err := s.set(v); err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", EnvName(s.name), err)
+			}
+
+			s.source = SourceEnv
+		}
+	}
+
+	c := &Config{settings: settings}
+	if s := byName[ConfigFile]; s != nil {
+		c.file = s.value.String()
+	}
+
+	if c.file == "" {
+		return c, nil
+	}
+
+	values, err := readConfigFile(c.file)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range sortedKeys(values) {
+		s := byName[key]
+		if s == nil {
+			if known[key] {
+				continue // another command's
+			}
+
+			return nil, fmt.Errorf("%s: unknown setting %q", c.file, key)
+		}
+
+		if key == ConfigFile {
+			return nil, fmt.Errorf("%s: a config file can't set %s", c.file, ConfigFile)
+		}
+
+		if s.source != SourceDefault {
+			continue
+		}
+
+		if err = s.set(values[key]); err != nil {
+			return nil, fmt.Errorf("%s: invalid %s: %w", c.file, key, err)
+		}
+
+		s.source = SourceFile
+	}
+
+	return c, nil
+}
+
+// readConfigFile reads a YAML or TOML file into flag names and values
+func readConfigFile(path string) (map[string]string, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]any
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(buf, &raw)
+	case ".toml":
+		err = toml.Unmarshal(buf, &raw)
+	default:
+		return nil, fmt.Errorf("config file %s isn't .yaml, .yml or .toml", path)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing %s: %w", path, err)
+	}
+
+	values := map[string]string{}
+	flatten(values, "", raw)
+	return values, nil
+}
+
+func flatten(out map[string]string, prefix string, m map[string]any) {
+	for k, v := range m {
+		if prefix != "" {
+			k = prefix + "-" + k
+		}
+
+		switch v := v.(type) {
+		case map[string]any:
+			flatten(out, k, v)
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+
+			out[k] = strings.Join(items, ",")
+		case nil:
+			out[k] = "" // key:
+		default:
+			out[k] = fmt.Sprint(v)
+		}
+	}
+}
+
+// Source reports where a flag's value came from
+func (c *Config) Source(name string) Source {
+	for _, s := range c.settings {
+		if s.name == name {
+			return s.source
+		}
+	}
+
+	return ""
+}
+
+// Print writes the effective config as YAML that can be used as a config file, with
+// where each value came from as a comment. Secrets are redacted, so they have to be
+// filled back in
+func (c *Config) Print(w io.Writer) error {
+	settings := append([]*setting(nil), c.settings...)
+	sort.Slice(settings, func(i, j int) bool { return settings[i].name < settings[j].name })
+
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	for _, s := range settings {
+		if s.name == ConfigFile || s.name == "help" {
+			continue
+		}
+
+		value := &yaml.Node{Kind: yaml.ScalarNode, Value: s.value.String(), LineComment: string(s.source)}
+		switch v := s.value.(type) {
+		case pflag.SliceValue:
+			// String() of slices is [a,b], which wouldn't read back
+			value.Kind, value.Value, value.Style = yaml.SequenceNode, "", yaml.FlowStyle
+			for _, item := range v.GetSlice() {
+				value.Content = append(value.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: item})
+			}
+		}
+
+		switch {
+		case IsSecret(s.name) && (value.Value != "" || len(value.Content) > 0):
+			value.Kind, value.Value, value.Style, value.Content = yaml.ScalarNode, "REDACTED", 0, nil
+		case value.Kind == yaml.ScalarNode && value.Value == "":
+			value.Style = yaml.DoubleQuotedStyle
+		}
+
+		doc.Content = append(doc.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: s.name}, value)
+	}
+
+	if c.file != "" {
+		doc.HeadComment = "loaded from " + c.file
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+
+	return enc.Close()
+}
+
+// IsSecret reports whether a flag holds something that shouldn't be shown. Paths of
+// files holding secrets can be
+func IsSecret(name string) bool {
+	if strings.HasSuffix(name, "-file") {
+		return false
+	}
+
+	for _, word := range []string{"password", "secret", "token", "headers"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,334 @@
+package cmdline
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/namsral/flag"
+	"github.com/spf13/cobra"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// cobraTree is a root command with a config-file flag, the crawl subcommand under
+// test, and a sibling whose flags a shared config file may also set
+func cobraTree() (root, crawl *cobra.Command) {
+	root = &cobra.Command{Use: "imgscrape"}
+	root.PersistentFlags().String(ConfigFile, "", "")
+	root.PersistentFlags().String("log-level", "info", "")
+
+	crawl = &cobra.Command{Use: "crawl", Run: func(*cobra.Command, []string) {}}
+	crawl.Flags().String("db-host", "localhost", "")
+	crawl.Flags().Int("db-port", 5432, "")
+	crawl.Flags().String("db-password", "", "")
+	crawl.Flags().StringSlice("tags", nil, "")
+	crawl.Flags().Bool("verbose", false, "")
+
+	split := &cobra.Command{Use: "split", Run: func(*cobra.Command, []string) {}}
+	split.Flags().Float64("test-ratio", 0.1, "")
+
+	root.AddCommand(crawl, split)
+	return root, crawl
+}
+
+func TestLoadCobraConfig(t *testing.T) {
+	yamlFile := `
+log-level: debug
+db:
+  host: db.internal
+  port: 6432
+tags: [a, b]
+verbose: true
+test-ratio: 0.2
+`
+
+	tomlFile := `
+log-level = "debug"
+tags = ["a", "b"]
+verbose = true
+test-ratio = 0.2
+
+[db]
+host = "db.internal"
+port = 6432
+`
+
+	tests := []struct {
+		name        string
+		file        string // name and content separated by a newline
+		env         map[string]string
+		args        []string
+		want        map[string]string
+		wantSources map[string]Source
+		wantErr     string
+	}{
+		{
+			name: "defaults",
+			want: map[string]string{"db-host": "localhost", "db-port": "5432", "log-level": "info", "verbose": "false"},
+			wantSources: map[string]Source{
+				"db-host": SourceDefault, "log-level": SourceDefault,
+			},
+		},
+		{
+			name: "YAML with nested tables and lists",
+			file: "config.yaml\n" + yamlFile,
+			want: map[string]string{"db-host": "db.internal", "db-port": "6432", "log-level": "debug", "tags": "[a,b]", "verbose": "true"},
+			wantSources: map[string]Source{
+				"db-host": SourceFile, "db-port": SourceFile, "log-level": SourceFile, "tags": SourceFile, "db-password": SourceDefault,
+			},
+		},
+		{
+			name: "TOML with nested tables and lists",
+			file: "config.toml\n" + tomlFile,
+			want: map[string]string{"db-host": "db.internal", "db-port": "6432", "log-level": "debug", "tags": "[a,b]", "verbose": "true"},
+			wantSources: map[string]Source{
+				"db-host": SourceFile, "db-port": SourceFile, "log-level": SourceFile, "tags": SourceFile,
+			},
+		},
+		{
+			name: "environment overrides the file",
+			file: "config.yaml\n" + yamlFile,
+			env:  map[string]string{"IMGSCRAPE_DB_HOST": "db.env", "IMGSCRAPE_LOG_LEVEL": "warn", "IMGSCRAPE_TAGS": "x,y"},
+			want: map[string]string{"db-host": "db.env", "db-port": "6432", "log-level": "warn", "tags": "[x,y]"},
+			wantSources: map[string]Source{
+				"db-host": SourceEnv, "db-port": SourceFile, "log-level": SourceEnv, "tags": SourceEnv,
+			},
+		},
+		{
+			name: "flags override the environment",
+			file: "config.yaml\n" + yamlFile,
+			env:  map[string]string{"IMGSCRAPE_DB_HOST": "db.env"},
+			args: []string{"--db-host", "db.flag", "--log-level=error"},
+			want: map[string]string{"db-host": "db.flag", "log-level": "error"},
+			wantSources: map[string]Source{
+				"db-host": SourceFlag, "log-level": SourceFlag,
+			},
+		},
+		{
+			name:    "unknown key",
+			file:    "config.yaml\ndb:\n  hots: typo\n",
+			wantErr: `unknown setting "db-hots"`,
+		},
+		{
+			name:    "config file can't set config-file",
+			file:    "config.yaml\nconfig-file: other.yaml\n",
+			wantErr: "can't set config-file",
+		},
+		{
+			name:    "invalid value in the file",
+			file:    "config.toml\n[db]\nport = \"not a port\"\n",
+			wantErr: "invalid db-port",
+		},
+		{
+			name:    "invalid value in the environment",
+			env:     map[string]string{"IMGSCRAPE_DB_PORT": "not a port"},
+			wantErr: "invalid IMGSCRAPE_DB_PORT",
+		},
+		{
+			name:    "unsupported file type",
+			file:    "config.json\n{}",
+			wantErr: "isn't .yaml, .yml or .toml",
+		},
+		{
+			name:    "unparseable file",
+			file:    "config.yaml\ndb: [unclosed\n",
+			wantErr: "failed parsing",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+
+			args := tc.args
+			if tc.file != "" {
+				name, content, _ := strings.Cut(tc.file, "\n")
+				args = append([]string{"--" + ConfigFile, writeConfig(t, name, content)}, args...)
+			}
+
+			_, crawl := cobraTree()
+			if err := crawl.ParseFlags(args); err != nil {
+				t.Fatal(err)
+			}
+
+			c, err := LoadCobraConfig(crawl)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got err %v, want one containing %q", err, tc.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for name, want := range tc.want {
+				if got := crawl.Flag(name).Value.String(); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+
+			for name, want := range tc.wantSources {
+				if got := c.Source(name); got != want {
+					t.Errorf("%s came from %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadFlagConfig(t *testing.T) {
+	t.Setenv("IMGSCRAPE_DB_HOST", "db.env")
+	t.Setenv("IMGSCRAPE_DB_NAME", "env-name")
+	path := writeConfig(t, "server.yaml", "db:\n  host: db.file\n  name: file-name\n  port: 6432\nverbose: true\n")
+
+	fs := flag.NewFlagSetWithEnvPrefix("server", EnvPrefix, flag.ContinueOnError)
+	fs.String(ConfigFile, "", "")
+	fs.String("db-host", "localhost", "")
+	fs.String("db-name", "imgscrape", "")
+	fs.Int("db-port", 5432, "")
+	fs.Bool("verbose", false, "")
+	fs.String("log-level", "info", "")
+
+	args := []string{"-" + ConfigFile, path, "-db-name=flag-name", "-verbose", "positional"}
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := LoadFlagConfig(fs, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, want string
+		source     Source
+	}{
+		{"db-host", "db.env", SourceEnv},
+		{"db-name", "flag-name", SourceFlag},
+		{"db-port", "6432", SourceFile},
+		{"verbose", "true", SourceFlag},
+		{"log-level", "info", SourceDefault},
+	}
+
+	for _, tc := range tests {
+		if got := fs.Lookup(tc.name).Value.String(); got != tc.want {
+			t.Errorf("%s = %q, want %q", tc.name, got, tc.want)
+		}
+
+		if got := c.Source(tc.name); got != tc.source {
+			t.Errorf("%s came from %q, want %q", tc.name, got, tc.source)
+		}
+	}
+
+	if !reflect.DeepEqual(fs.Args(), []string{"positional"}) {
+		t.Errorf("args %v, want [positional]", fs.Args())
+	}
+
+	// flag sets without the other commands' flags reject them
+	path = writeConfig(t, "server.yaml", "test-ratio: 0.2\n")
+	fs = flag.NewFlagSetWithEnvPrefix("server", EnvPrefix, flag.ContinueOnError)
+	fs.String(ConfigFile, "", "")
+	args = []string{"-" + ConfigFile, path}
+	fs.Parse(args)
+
+	if _, err = LoadFlagConfig(fs, args); err == nil || !strings.Contains(err.Error(), `unknown setting "test-ratio"`) {
+		t.Fatalf("got err %v, want an unknown setting", err)
+	}
+}
+
+func TestPrint(t *testing.T) {
+	t.Setenv("IMGSCRAPE_DB_PASSWORD", "hunter2")
+	path := writeConfig(t, "config.yaml", "db-host: db.file\n")
+
+	_, crawl := cobraTree()
+	crawl.Flags().String("trace-exporter-headers", "", "")
+	crawl.Flags().String("db-password-file", "", "")
+	crawl.Flags().StringSlice("auth-tokens", nil, "")
+
+	args := []string{"--" + ConfigFile, path, "--tags", "a,b", "--trace-exporter-headers", "authorization=Bearer%20xyz", "--auth-tokens", "tok-one,tok-two", "--db-password-file", "/run/secrets/db"}
+	if err := crawl.ParseFlags(args); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := LoadCobraConfig(crawl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err = c.Print(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	for _, secret := range []string{"hunter2", "xyz", "tok-one", "tok-two"} {
+		if strings.Contains(out, secret) {
+			t.Fatalf("printed the secret %q:\n%s", secret, out)
+		}
+	}
+
+	for _, line := range []string{
+		"# loaded from " + path,
+		"auth-tokens: REDACTED # flag",
+		"db-host: db.file # file",
+		"db-password: REDACTED # env",
+		"db-password-file: /run/secrets/db # flag",
+		"db-port: 5432 # default",
+		"log-level: info # default",
+		"tags: [a, b] # flag",
+		"trace-exporter-headers: REDACTED # flag",
+		`verbose: false # default`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, out)
+		}
+	}
+
+	if strings.Contains(out, ConfigFile+":") {
+		t.Errorf("printed %s, which a config file can't set:\n%s", ConfigFile, out)
+	}
+}
+
+func TestIsSecret(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"db-reader-password", true},
+		{"db-reader-password-file", false},
+		{"client-secret", true},
+		{"auth-token", true},
+		{"trace-exporter-headers", true},
+		{"db-host", false},
+		{"auth-api-keys-file", false},
+	}
+
+	for _, tc := range tests {
+		if got := IsSecret(tc.name); got != tc.want {
+			t.Errorf("IsSecret(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	if got := EnvName("db-reader-password"); got != "IMGSCRAPE_DB_READER_PASSWORD" {
+		t.Fatalf("got %q", got)
+	}
+}
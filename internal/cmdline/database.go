@@ -1,11 +1,18 @@
 package cmdline
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"io"
+	"strings"
 
+	"github.com/AnthonyHewins/imgscrape/internal/migrations"
 	"github.com/XSAM/otelsql"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
 )
 
@@ -19,15 +26,16 @@ func (a *App) ConnectDB(host, name, user, password string, port uint16) (*sqlx.D
 		"sslmode", sslmode,
 		"name", name,
 		"user", user,
-		"len(password) > 0", len(password) > 0,
+		"password_set", len(password) > 0,
 	)
 
-	db, err := sqlx.Open("postgres", genConnStr(port, host, name, user, password, sslmode))
+	connector, err := newConnector(port, host, name, user, password, sslmode)
 	if err != nil {
-		a.logger.Error("msg", "failed connecting to database")
+		a.logger.Error("failed connecting to database", "err", err)
 		return nil, err
 	}
 
+	db := sqlx.NewDb(sql.OpenDB(connector), "postgres")
 	if err = a.ping(db); err != nil {
 		return nil, err
 	}
@@ -48,15 +56,16 @@ func (a *App) ConnectDBWithOTEL(host, name, user, password string, port uint16)
 		"password_set", len(password) > 0,
 	)
 
-	otelDB, err := otelsql.Open("postgres", genConnStr(port, host, name, user, password, sslmode), otelsql.WithAttributes(
-		semconv.DBSystemPostgreSQL,
-	))
-
+	connector, err := newConnector(port, host, name, user, password, sslmode)
 	if err != nil {
 		a.logger.Error("failed connecting to database", "err", err)
 		return nil, err
 	}
 
+	otelDB := otelsql.OpenDB(connector, otelsql.WithAttributes(
+		semconv.DBSystemPostgreSQL,
+	))
+
 	db := sqlx.NewDb(otelDB, "postgres")
 	if err = a.ping(db); err != nil {
 		return nil, err
@@ -73,16 +82,32 @@ func useSSL(host string) string {
 	return "require"
 }
 
-func genConnStr(port uint16, host, name, user, password, useSSL string) string {
-	return fmt.Sprintf(
-		"host=%s port=%d dbname=%v sslmode=%v user=%s password=%s",
-		host,
+// newConnector builds the connection string only to hand it to the driver, so the
+// password in it can't end up in a log line, a span or an error
+func newConnector(port uint16, host, name, user, password, sslmode string) (driver.Connector, error) {
+	connector, err := pq.NewConnector(fmt.Sprintf(
+		"host=%s port=%d dbname=%s sslmode=%s user=%s password=%s",
+		connValue(host),
 		port,
-		name,
-		useSSL,
-		user,
-		password,
-	)
+		connValue(name),
+		sslmode,
+		connValue(user),
+		connValue(password),
+	))
+
+	if err != nil {
+		// pq quotes the part of the string it couldn't parse, which may be the password
+		return nil, errors.New("invalid database connection settings")
+	}
+
+	return connector, nil
+}
+
+// connValue quotes v for a key=value connection string, so values with spaces or
+// quotes, like generated passwords, don't break it
+func connValue(v string) string {
+	v = strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v)
+	return "'" + v + "'"
 }
 
 func (a *App) ping(db *sqlx.DB) error {
@@ -94,3 +119,14 @@ func (a *App) ping(db *sqlx.DB) error {
 	a.logger.Info("connected and pinged database")
 	return nil
 }
+
+// Migrate runs a migrate subcommand (up | down [steps] | status) against db, which needs
+// permission to create tables, writing a summary to w
+func (a *App) Migrate(ctx context.Context, db *sqlx.DB, w io.Writer, args ...string) error {
+	m, err := migrations.New(a.logger, db)
+	if err != nil {
+		return err
+	}
+
+	return m.Command(ctx, w, args...)
+}
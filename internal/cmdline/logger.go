@@ -63,16 +63,18 @@ func getLogger(appName, logLevel, logFmt, exporter string, addSrc bool) (*slog.L
 		return nil, err
 	}
 
-	var logger *slog.Logger
+	var h slog.Handler
 	switch logFmt {
 	case "", "json":
-		logger = slog.New(slog.NewJSONHandler(out, &level))
+		h = slog.NewJSONHandler(out, &level)
 	case "text", "logfmt":
-		logger = slog.New(slog.NewTextHandler(out, &level))
+		h = slog.NewTextHandler(out, &level)
 	default:
 		return nil, fmt.Errorf("invalid handler format: %s", logFmt)
 	}
 
+	logger := slog.New(NewTraceLogHandler(h))
+
 	if appName == "" {
 		logger = logger.With("app-name", appName)
 	}
@@ -0,0 +1,44 @@
+package cmdline
+
+import (
+	"github.com/AnthonyHewins/imgscrape/internal/metrics"
+	"github.com/spf13/pflag"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	MetricsPushURL      = "metrics-push-url"
+	MetricsPushJob      = "metrics-push-job"
+	MetricsTextfile     = "metrics-textfile"
+	MetricsPushInterval = "metrics-push-interval"
+)
+
+// NewExporterFromCobra creates a metrics exporter from the Metrics* flags
+func NewExporterFromCobra(logger *slog.Logger, flags *pflag.FlagSet) (*metrics.Exporter, error) {
+	pushURL, err := flags.GetString(MetricsPushURL)
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := flags.GetString(MetricsPushJob)
+	if err != nil {
+		return nil, err
+	}
+
+	textfile, err := flags.GetString(MetricsTextfile)
+	if err != nil {
+		return nil, err
+	}
+
+	interval, err := flags.GetDuration(MetricsPushInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	return metrics.NewExporter(logger, metrics.ExportOptions{
+		PushURL:  pushURL,
+		Job:      job,
+		Textfile: textfile,
+		Interval: interval,
+	}), nil
+}
@@ -0,0 +1,343 @@
+package cmdline
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"golang.org/x/exp/slog"
+)
+
+// CreateMeterProvider creates an OTel meter provider whose instruments (the ones
+// otelgrpc, otelsql and the like record to) are collected through the default
+// Prometheus registry, so they're served with everything else on /metrics. Names are
+// converted to Prometheus' conventions the way the OTel Prometheus exporter does:
+// dots become underscores, the unit is appended (_seconds, _bytes, ...) and monotonic
+// sums get a _total suffix. Every series is labeled with the instrumentation scope it
+// came from, otel_scope_name and otel_scope_version
+func (a *App) CreateMeterProvider() (*metric.MeterProvider, error) {
+	reader := metric.NewManualReader()
+	if err := prometheus.Register(&promBridge{reader: reader, logger: a.logger}); err != nil {
+		a.logger.Error("failed registering OTel metrics with prometheus", "err", err)
+		return nil, err
+	}
+
+	a.logger.Info("Creating meter provider", "exporter", "prometheus")
+	return metric.NewMeterProvider(
+		metric.WithReader(reader),
+		metric.WithResource(a.newResource()),
+	), nil
+}
+
+// promUnits are the suffixes OTel units get in Prometheus names. Annotations like
+// {request} and units not listed are left out of the name
+var promUnits = map[string]string{
+	"s":    "seconds",
+	"ms":   "milliseconds",
+	"us":   "microseconds",
+	"ns":   "nanoseconds",
+	"By":   "bytes",
+	"KiBy": "kibibytes",
+	"MiBy": "mebibytes",
+	"1":    "ratio",
+}
+
+type promKind int
+
+const (
+	promGauge promKind = iota
+	promCounter
+	promHistogram
+)
+
+// promPoint is one OTel data point, with its attributes turned into labels
+type promPoint struct {
+	labels map[string]string
+
+	// sums and gauges
+	value float64
+
+	// histograms, with cumulative bucket counts
+	count   uint64
+	sum     float64
+	buckets map[float64]uint64
+}
+
+// promFamily is every data point collected under one Prometheus name. Instruments
+// from different scopes may share it as long as they're the same kind; the first one
+// seen sets the help text
+type promFamily struct {
+	kind   promKind
+	help   string
+	keys   map[string]bool
+	points []promPoint
+}
+
+// promBridge is a prometheus.Collector reading from an OTel reader on every scrape.
+// Whatever would make the registry's Gather fail is dropped and logged instead:
+// instruments of different kinds under one name, and series with the same labels.
+// Points missing labels others in their family have get them blank, so each family
+// has one label set
+type promBridge struct {
+	reader metric.Reader
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	dropped map[string]bool // what's been logged already, so it's logged once
+}
+
+// Describe describes nothing, making the bridge an unchecked collector; instruments
+// are only known once they've recorded something
+func (b *promBridge) Describe(chan<- *prometheus.Desc) {}
+
+func (b *promBridge) Collect(ch chan<- prometheus.Metric) {
+	var rm metricdata.ResourceMetrics
+	if err := b.reader.Collect(context.Background(), &rm); err != nil {
+		b.logger.Error("failed collecting OTel metrics", "err", err)
+		return
+	}
+
+	families := map[string]*promFamily{}
+	var names []string
+	for _, sm := range rm.ScopeMetrics {
+		scope := map[string]string{
+			"otel_scope_name":    sm.Scope.Name,
+			"otel_scope_version": sm.Scope.Version,
+		}
+
+		for _, m := range sm.Metrics {
+			kind, points, ok := promPoints(m.Data)
+			if !ok {
+				continue
+			}
+
+			name := promMetricName(m.Name, m.Unit, kind)
+			f, ok := families[name]
+			if !ok {
+				f = &promFamily{kind: kind, help: m.Description, keys: map[string]bool{}}
+				families[name] = f
+				names = append(names, name)
+			} else if f.kind != kind {
+				b.drop(name+"/"+sm.Scope.Name, "OTel instrument dropped from /metrics: another of a different kind has the same name",
+					"name", name,
+					"scope", sm.Scope.Name,
+				)
+				continue
+			}
+
+			for _, p := range points {
+				for k, v := range scope {
+					p.labels[k] = v
+				}
+
+				for k := range p.labels {
+					f.keys[k] = true
+				}
+
+				f.points = append(f.points, p)
+			}
+		}
+	}
+
+	for _, name := range names {
+		b.collectFamily(ch, name, families[name])
+	}
+}
+
+func (b *promBridge) collectFamily(ch chan<- prometheus.Metric, name string, f *promFamily) {
+	keys := make([]string, 0, len(f.keys))
+	for k := range f.keys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	desc := prometheus.NewDesc(name, f.help, keys, nil)
+	seen := make(map[string]bool, len(f.points))
+	for _, p := range f.points {
+		values := make([]string, len(keys))
+		for i, k := range keys {
+			values[i] = p.labels[k]
+		}
+
+		id := strings.Join(values, "\xff")
+		if seen[id] {
+			b.drop(name+"\xff"+id, "OTel data point dropped from /metrics: another has the same labels",
+				"name", name,
+				"labels", p.labels,
+			)
+			continue
+		}
+		seen[id] = true
+
+		var (
+			m   prometheus.Metric
+			err error
+		)
+		switch f.kind {
+		case promCounter:
+			m, err = prometheus.NewConstMetric(desc, prometheus.CounterValue, p.value, values...)
+		case promGauge:
+			m, err = prometheus.NewConstMetric(desc, prometheus.GaugeValue, p.value, values...)
+		case promHistogram:
+			m, err = prometheus.NewConstHistogram(desc, p.count, p.sum, p.buckets, values...)
+		}
+
+		if err != nil {
+			b.drop(name, "OTel metric dropped from /metrics", "name", name, "err", err)
+			continue
+		}
+
+		ch <- m
+	}
+}
+
+// drop logs why something was left out of a scrape, the first time it happens
+func (b *promBridge) drop(key, msg string, args ...any) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.dropped[key] {
+		return
+	}
+
+	if b.dropped == nil {
+		b.dropped = map[string]bool{}
+	}
+
+	b.dropped[key] = true
+	b.logger.Warn(msg, args...)
+}
+
+// promPoints converts the data of an instrument. ok is false for aggregations
+// Prometheus has nothing for, like exponential histograms
+func promPoints(data metricdata.Aggregation) (kind promKind, points []promPoint, ok bool) {
+	switch data := data.(type) {
+	case metricdata.Sum[int64]:
+		kind, points = sumPoints(data)
+	case metricdata.Sum[float64]:
+		kind, points = sumPoints(data)
+	case metricdata.Gauge[int64]:
+		kind, points = gaugePoints(data)
+	case metricdata.Gauge[float64]:
+		kind, points = gaugePoints(data)
+	case metricdata.Histogram[int64]:
+		kind, points = histogramPoints(data)
+	case metricdata.Histogram[float64]:
+		kind, points = histogramPoints(data)
+	default:
+		return 0, nil, false
+	}
+
+	return kind, points, true
+}
+
+func sumPoints[N int64 | float64](s metricdata.Sum[N]) (promKind, []promPoint) {
+	kind := promGauge
+	if s.IsMonotonic {
+		kind = promCounter
+	}
+
+	points := make([]promPoint, len(s.DataPoints))
+	for i, dp := range s.DataPoints {
+		points[i] = promPoint{labels: promLabels(dp.Attributes), value: float64(dp.Value)}
+	}
+
+	return kind, points
+}
+
+func gaugePoints[N int64 | float64](g metricdata.Gauge[N]) (promKind, []promPoint) {
+	points := make([]promPoint, len(g.DataPoints))
+	for i, dp := range g.DataPoints {
+		points[i] = promPoint{labels: promLabels(dp.Attributes), value: float64(dp.Value)}
+	}
+
+	return promGauge, points
+}
+
+func histogramPoints[N int64 | float64](h metricdata.Histogram[N]) (promKind, []promPoint) {
+	points := make([]promPoint, len(h.DataPoints))
+	for i, dp := range h.DataPoints {
+		// OTel counts per bucket, Prometheus cumulatively
+		buckets := make(map[float64]uint64, len(dp.Bounds))
+		var cumulative uint64
+		for j, bound := range dp.Bounds {
+			cumulative += dp.BucketCounts[j]
+			buckets[bound] = cumulative
+		}
+
+		points[i] = promPoint{
+			labels:  promLabels(dp.Attributes),
+			count:   dp.Count,
+			sum:     float64(dp.Sum),
+			buckets: buckets,
+		}
+	}
+
+	return promHistogram, points
+}
+
+// promLabels converts attributes to labels. Keys that end up the same once they're
+// valid label names (which, unlike metric names, can't have colons) have their values
+// joined with ;
+func promLabels(set attribute.Set) map[string]string {
+	labels := make(map[string]string, set.Len())
+	for _, kv := range set.ToSlice() {
+		key := strings.ReplaceAll(promName(string(kv.Key)), ":", "_")
+		switch {
+		case key == "":
+			continue
+		case key[0] >= '0' && key[0] <= '9':
+			key = "key_" + key
+		case strings.HasPrefix(key, "__"):
+			// reserved for Prometheus' own use
+			key = "key" + key
+		}
+
+		if v, ok := labels[key]; ok {
+			labels[key] = v + ";" + kv.Value.Emit()
+		} else {
+			labels[key] = kv.Value.Emit()
+		}
+	}
+
+	return labels
+}
+
+// promMetricName is name as a valid Prometheus name, followed by its unit and, for
+// counters, _total, unless it already ends with them
+func promMetricName(name, unit string, kind promKind) string {
+	name = promName(name)
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+
+	// a ratio that only ever goes up isn't one
+	if suffix, ok := promUnits[unit]; ok && !(unit == "1" && kind == promCounter) {
+		if !strings.HasSuffix(name, "_"+suffix) {
+			name += "_" + suffix
+		}
+	}
+
+	if kind == promCounter && !strings.HasSuffix(name, "_total") {
+		name += "_total"
+	}
+
+	return name
+}
+
+// promName replaces everything Prometheus doesn't allow in a name with underscores
+func promName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == ':':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
@@ -0,0 +1,287 @@
+package cmdline
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// retries of an export back off from otlpInitialBackoff up to otlpMaxBackoff between
+// attempts, and give up once otlpMaxElapsed has passed. Same as otlptracehttp
+const (
+	otlpInitialBackoff = 5 * time.Second
+	otlpMaxBackoff     = 30 * time.Second
+	otlpMaxElapsed     = time.Minute
+)
+
+// otlpHTTPClient sends spans to a collector's OTLP/HTTP receiver as protobuf, the way
+// otlptracehttp does. It plugs into otlptrace.New, which does the conversion from SDK
+// spans
+type otlpHTTPClient struct {
+	endpoint string
+	headers  map[string]string
+	gzip     bool
+	client   *http.Client
+}
+
+// newOTLPHTTPClient creates a client for opts.URL, which may be a full URL or just
+// host:port, in which case the path is /v1/traces and the scheme https unless
+// opts.Insecure. What opts leaves blank is read from the standard environment
+// variables, the traces specific ones first:
+//
+//	OTEL_EXPORTER_OTLP_TRACES_ENDPOINT     the full URL
+//	OTEL_EXPORTER_OTLP_ENDPOINT            base URL; /v1/traces is appended
+//	OTEL_EXPORTER_OTLP_[TRACES_]HEADERS    added under the ones in opts
+//	OTEL_EXPORTER_OTLP_[TRACES_]TIMEOUT    milliseconds
+//	OTEL_EXPORTER_OTLP_[TRACES_]COMPRESSION gzip or none
+//	OTEL_EXPORTER_OTLP_[TRACES_]CERTIFICATE CA file
+func newOTLPHTTPClient(opts TracerOptions) (*otlpHTTPClient, error) {
+	endpoint := opts.URL
+	if endpoint == "" {
+		if v := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); v != "" {
+			endpoint = v
+		} else if v = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); v != "" {
+			endpoint = strings.TrimSuffix(v, "/") + "/v1/traces"
+		} else {
+			endpoint = "localhost:4318"
+		}
+	}
+
+	if !strings.Contains(endpoint, "://") {
+		scheme := "https://"
+		if opts.Insecure {
+			scheme = "http://"
+		}
+
+		endpoint = scheme + endpoint
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q: %w", endpoint, err)
+	}
+
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+
+	headers := map[string]string{}
+	if v := otlpEnv("HEADERS"); v != "" {
+		if headers, err = ParseHeaders(v); err != nil {
+			return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS: %w", err)
+		}
+	}
+
+	for k, v := range opts.Headers {
+		headers[k] = v
+	}
+
+	timeout := opts.Timeout
+	if v := otlpEnv("TIMEOUT"); v != "" && timeout <= 0 {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_TIMEOUT %q: want milliseconds", v)
+		}
+
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+
+	var gzipped bool
+	switch v := strings.ToLower(otlpEnv("COMPRESSION")); v {
+	case "", "none":
+	case "gzip":
+		gzipped = true
+	default:
+		return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_COMPRESSION %q: want gzip or none", v)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if u.Scheme == "https" {
+		caFile := opts.CAFile
+		if caFile == "" {
+			caFile = otlpEnv("CERTIFICATE")
+		}
+
+		if transport.TLSClientConfig, err = loadTLSConfig(caFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return &otlpHTTPClient{
+		endpoint: u.String(),
+		headers:  headers,
+		gzip:     gzipped,
+		client:   &http.Client{Timeout: timeout, Transport: transport},
+	}, nil
+}
+
+// otlpEnv reads OTEL_EXPORTER_OTLP_TRACES_<name>, falling back to OTEL_EXPORTER_OTLP_<name>
+func otlpEnv(name string) string {
+	if v := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_" + name); v != "" {
+		return v
+	}
+
+	return os.Getenv("OTEL_EXPORTER_OTLP_" + name)
+}
+
+func (c *otlpHTTPClient) Start(context.Context) error { return nil }
+
+func (c *otlpHTTPClient) Stop(context.Context) error {
+	c.client.CloseIdleConnections()
+	return nil
+}
+
+// UploadTraces sends spans, retrying while the collector says it's overloaded or
+// unavailable. Spans the collector accepted only partially are reported to the
+// global OTel error handler, as otlptracehttp does
+func (c *otlpHTTPClient) UploadTraces(ctx context.Context, spans []*tracepb.ResourceSpans) error {
+	body, err := proto.Marshal(&coltracepb.ExportTraceServiceRequest{ResourceSpans: spans})
+	if err != nil {
+		return err
+	}
+
+	if c.gzip {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err = w.Write(body); err != nil {
+			return err
+		}
+
+		if err = w.Close(); err != nil {
+			return err
+		}
+
+		body = buf.Bytes()
+	}
+
+	deadline := time.Now().Add(otlpMaxElapsed)
+	backoff := otlpInitialBackoff
+	for {
+		retryAfter, err := c.upload(ctx, body)
+		if retryAfter < 0 {
+			return err
+		}
+
+		wait := backoff
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+
+		if time.Now().Add(wait).After(deadline) {
+			return fmt.Errorf("gave up retrying OTLP export after %v: %w", otlpMaxElapsed, err)
+		}
+
+		if serr := sleepContext(ctx, wait); serr != nil {
+			return fmt.Errorf("%v; last attempt: %w", serr, err)
+		}
+
+		if backoff *= 2; backoff > otlpMaxBackoff {
+			backoff = otlpMaxBackoff
+		}
+	}
+}
+
+// upload makes one attempt. retryAfter is negative if it shouldn't be retried, and
+// otherwise what the collector asked to wait, or 0 if it didn't say
+func (c *otlpHTTPClient) upload(ctx context.Context, body []byte) (retryAfter time.Duration, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+
+	for k, v := range c.headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	if c.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return -1, err
+		}
+
+		// the collector may be restarting
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	msg, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return -1, err
+	}
+
+	switch code := resp.StatusCode; {
+	case code >= 200 && code < 300:
+		reportPartialSuccess(msg)
+		return -1, nil
+	case code == http.StatusTooManyRequests, code == http.StatusBadGateway,
+		code == http.StatusServiceUnavailable, code == http.StatusGatewayTimeout:
+		return parseRetryAfter(resp.Header.Get("Retry-After")),
+			fmt.Errorf("OTLP collector responded %d: %s", code, bytes.TrimSpace(msg))
+	default:
+		return -1, fmt.Errorf("OTLP collector responded %d: %s", code, bytes.TrimSpace(msg))
+	}
+}
+
+// reportPartialSuccess hands spans the collector rejected to the OTel error handler.
+// A body that isn't a response message is ignored; collectors may send nothing
+func reportPartialSuccess(body []byte) {
+	var resp coltracepb.ExportTraceServiceResponse
+	if len(body) == 0 || proto.Unmarshal(body, &resp) != nil {
+		return
+	}
+
+	ps := resp.GetPartialSuccess()
+	if ps == nil || ps.GetRejectedSpans() == 0 && ps.GetErrorMessage() == "" {
+		return
+	}
+
+	otel.Handle(fmt.Errorf("OTLP partial success: %s (%d spans rejected)", ps.GetErrorMessage(), ps.GetRejectedSpans()))
+}
+
+// parseRetryAfter reads a Retry-After header in seconds or as a date. Anything else is 0
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(v); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,38 @@
+package cmdline
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
+)
+
+// TraceLogHandler adds the trace_id and span_id of the span in a record's context, if
+// any, so a log line can be looked up in the tracing backend
+type TraceLogHandler struct {
+	slog.Handler
+}
+
+// NewTraceLogHandler wraps h
+func NewTraceLogHandler(h slog.Handler) *TraceLogHandler {
+	return &TraceLogHandler{Handler: h}
+}
+
+func (h *TraceLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(
+			slog.String("trace_id", sc.TraceID().String()),
+			slog.String("span_id", sc.SpanID().String()),
+		)
+	}
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *TraceLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &TraceLogHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *TraceLogHandler) WithGroup(name string) slog.Handler {
+	return &TraceLogHandler{Handler: h.Handler.WithGroup(name)}
+}
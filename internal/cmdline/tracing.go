@@ -2,42 +2,120 @@ package cmdline
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"net/url"
 	"os"
 	"runtime/debug"
 	"strings"
 	"time"
 
+	"github.com/spf13/pflag"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/exporters/jaeger"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
 	"go.opentelemetry.io/otel/sdk/resource"
 	"go.opentelemetry.io/otel/sdk/trace"
 	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"google.golang.org/grpc/credentials"
 )
 
-// MustCreateTracer creates a tracer to use for checking performance. Pass the app's context, a format, and a URI-like
-// string. The format can be one of the following:
-//
-//	"stdout"   // STDOUT style export: if you pass a non-empty string for the URI, it will be redirected to a file
-//	"otlp"     // OTLP style export: export to an OTLP endpoint
-//	"jaegar"   // Jaegar export: export to a jaegar endpoint
-//	"none"|""  // Create a no-op tracer
-//
-// Anything else will error out
-func (a *App) CreateTracer(ctx context.Context, traceFormat, traceExportURI string, timeout time.Duration) (*trace.TracerProvider, error) {
+const (
+	TraceExporter         = "trace-exporter"
+	TraceExportURL        = "trace-export-url"
+	TraceExporterTimeout  = "trace-exporter-timeout"
+	TraceExporterHeaders  = "trace-exporter-headers"
+	TraceExporterInsecure = "trace-exporter-insecure"
+	TraceExporterCAFile   = "trace-exporter-ca-file"
+	TraceSampleRatio      = "trace-sample-ratio"
+)
+
+// TracerOptionsFromCobra reads TracerOptions from the Trace* flags
+func TracerOptionsFromCobra(flags *pflag.FlagSet) (TracerOptions, error) {
+	var opts TracerOptions
+	var err error
+	if opts.Exporter, err = flags.GetString(TraceExporter); err != nil {
+		return opts, err
+	}
+
+	if opts.URL, err = flags.GetString(TraceExportURL); err != nil {
+		return opts, err
+	}
+
+	if opts.Timeout, err = flags.GetDuration(TraceExporterTimeout); err != nil {
+		return opts, err
+	}
+
+	headers, err := flags.GetString(TraceExporterHeaders)
+	if err != nil {
+		return opts, err
+	}
+
+	if opts.Headers, err = ParseHeaders(headers); err != nil {
+		return opts, err
+	}
+
+	if opts.Insecure, err = flags.GetBool(TraceExporterInsecure); err != nil {
+		return opts, err
+	}
+
+	if opts.CAFile, err = flags.GetString(TraceExporterCAFile); err != nil {
+		return opts, err
+	}
+
+	opts.SampleRatio, err = flags.GetFloat64(TraceSampleRatio)
+	return opts, err
+}
+
+// TracerOptions configure CreateTracer
+type TracerOptions struct {
+	// Exporter is one of:
+	//
+	//	"stdout"            // STDOUT style export: if URL is set, spans are appended to that file instead
+	//	"otlp"|"otlp-grpc"  // OTLP export over gRPC to URL (host:port), localhost:4317 by default
+	//	"otlp-http"         // OTLP export over HTTP to URL (host:port or a full URL), localhost:4318 by default
+	//	"jaeger"            // Jaeger export to the collector at URL
+	//	"none"|""           // Create a no-op tracer
+	Exporter string
+	URL      string
+
+	// Timeout is how long an export may take before it's abandoned
+	Timeout time.Duration
+
+	// Headers are sent with every OTLP export, e.g. for the collector's auth
+	Headers map[string]string
+
+	// Insecure sends OTLP in plaintext. Otherwise it's TLS, verified with CAFile if
+	// set and the system roots if not
+	Insecure bool
+	CAFile   string
+
+	// SampleRatio is the fraction of traces sampled when there's no parent span to
+	// follow. 1 samples everything
+	SampleRatio float64
+}
+
+// CreateTracer creates a tracer provider to use for checking performance. Spans whose
+// parent was sampled are always sampled; new traces are sampled at opts.SampleRatio
+func (a *App) CreateTracer(ctx context.Context, opts TracerOptions) (*trace.TracerProvider, error) {
+	if opts.SampleRatio < 0 || opts.SampleRatio > 1 {
+		return nil, fmt.Errorf("trace sample ratio must be between 0 and 1, got %v", opts.SampleRatio)
+	}
+
 	var exporter trace.SpanExporter
-	switch strings.ToLower(traceFormat) {
+	switch strings.ToLower(opts.Exporter) {
 	case "stdout":
 		file := os.Stdout
-		if traceExportURI != "" {
-			f, err := os.Open(traceExportURI)
+		if opts.URL != "" {
+			f, err := os.OpenFile(opts.URL, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 			if err != nil {
 				a.logger.Error("failed opening the file supplied for tracing",
 					"err", err,
-					"path", traceExportURI,
+					"path", opts.URL,
 				)
 				return nil, err
 			}
@@ -56,35 +134,59 @@ func (a *App) CreateTracer(ctx context.Context, traceFormat, traceExportURI stri
 		}
 
 		exporter = exp
-	case "otlp":
-		extraOpts := make([]otlptracegrpc.Option, 0, 1)
-		if traceExportURI != "" {
-			extraOpts = append(extraOpts, otlptracegrpc.WithEndpoint(traceExportURI))
+	case "otlp", "otlp-grpc":
+		grpcOpts := []otlptracegrpc.Option{
+			otlptracegrpc.WithReconnectionPeriod(time.Second),
+			otlptracegrpc.WithTimeout(opts.Timeout),
+			otlptracegrpc.WithHeaders(opts.Headers),
 		}
 
-		exp, err := otlptracegrpc.New(ctx,
-			append(extraOpts,
-				otlptracegrpc.WithInsecure(),
-				otlptracegrpc.WithReconnectionPeriod(time.Second),
-				otlptracegrpc.WithTimeout(timeout),
-			)...,
-		)
+		if opts.URL != "" {
+			grpcOpts = append(grpcOpts, otlptracegrpc.WithEndpoint(opts.URL))
+		}
+
+		if opts.Insecure {
+			grpcOpts = append(grpcOpts, otlptracegrpc.WithInsecure())
+		} else {
+			tlsConfig, err := loadTLSConfig(opts.CAFile)
+			if err != nil {
+				a.logger.Error("failed loading the trace collector's CA", "err", err, "path", opts.CAFile)
+				return nil, err
+			}
+
+			grpcOpts = append(grpcOpts, otlptracegrpc.WithTLSCredentials(credentials.NewTLS(tlsConfig)))
+		}
 
+		exp, err := otlptracegrpc.New(ctx, grpcOpts...)
 		if err != nil {
 			a.logger.Error("error creating otlptracegrpc exporter",
-				"otlp-export-url", traceExportURI,
-				"timeout", timeout,
+				"otlp-export-url", opts.URL,
+				"timeout", opts.Timeout,
 				"err", err,
 			)
 
 			return nil, err
 		}
 
+		exporter = exp
+	case "otlp-http":
+		client, err := newOTLPHTTPClient(opts)
+		if err != nil {
+			a.logger.Error("error creating OTLP/HTTP exporter", "otlp-export-url", opts.URL, "err", err)
+			return nil, err
+		}
+
+		exp, err := otlptrace.New(ctx, client)
+		if err != nil {
+			a.logger.Error("error creating OTLP/HTTP exporter", "otlp-export-url", opts.URL, "err", err)
+			return nil, err
+		}
+
 		exporter = exp
 	case "jaeger":
 		extraOpts := make([]jaeger.CollectorEndpointOption, 0, 1)
-		if traceExportURI != "" {
-			extraOpts = append(extraOpts, jaeger.WithEndpoint(traceExportURI))
+		if opts.URL != "" {
+			extraOpts = append(extraOpts, jaeger.WithEndpoint(opts.URL))
 		}
 
 		exp, err := jaeger.New(
@@ -94,7 +196,7 @@ func (a *App) CreateTracer(ctx context.Context, traceFormat, traceExportURI stri
 		if err != nil {
 			a.logger.Error("can't create jaeger tracer",
 				"error", err,
-				"trace-export-url", traceExportURI,
+				"trace-export-url", opts.URL,
 			)
 
 			return nil, err
@@ -104,22 +206,69 @@ func (a *App) CreateTracer(ctx context.Context, traceFormat, traceExportURI stri
 	case "none", "":
 		exporter = tracetest.NewNoopExporter()
 	default:
-		a.logger.Error("invalid tracer", "tracer", traceFormat)
-		panic("invalid tracer exporter format passed: " + traceFormat)
+		a.logger.Error("invalid tracer", "tracer", opts.Exporter)
+		return nil, fmt.Errorf("invalid trace exporter %q: expected stdout | otlp | otlp-grpc | otlp-http | jaeger | none", opts.Exporter)
 	}
 
 	a.logger.Info("Creating tracer",
-		"exporter", traceFormat,
-		"export-url", traceExportURI,
+		"exporter", opts.Exporter,
+		"export-url", opts.URL,
 		"exporter-type", fmt.Sprintf("%T", exporter),
+		"sample-ratio", opts.SampleRatio,
 	)
 
 	return trace.NewTracerProvider(
 		trace.WithBatcher(exporter),
 		trace.WithResource(a.newResource()),
+		trace.WithSampler(trace.ParentBased(trace.TraceIDRatioBased(opts.SampleRatio))),
 	), nil
 }
 
+// ParseHeaders parses headers in the OTEL_EXPORTER_OTLP_HEADERS format:
+// key1=value1,key2=value2, with values URL encoded
+func ParseHeaders(s string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("header %q isn't key=value", pair)
+		}
+
+		v, err := url.QueryUnescape(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("header %q has a badly encoded value: %w", k, err)
+		}
+
+		headers[strings.TrimSpace(k)] = v
+	}
+
+	return headers, nil
+}
+
+// loadTLSConfig trusts the PEM certificates in caFile, or the system roots if it's blank
+func loadTLSConfig(caFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return cfg, nil
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.RootCAs = x509.NewCertPool()
+	if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates in %s", caFile)
+	}
+
+	return cfg, nil
+}
+
 // newResource returns a resource describing this application.
 func (a *App) newResource() *resource.Resource {
 	attrs := []attribute.KeyValue{
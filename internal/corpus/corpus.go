@@ -0,0 +1,156 @@
+package corpus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// MetadataFile is the name of the JSON sidecar written next to every image
+	MetadataFile = "metadata.json"
+
+	// ImageBase is the base name (without extension) of every stored image
+	ImageBase = "image"
+)
+
+// Attribute keys for the text the crawler captures around an image
+const (
+	AttrAlt        = "alt"
+	AttrTitle      = "title"
+	AttrFigcaption = "figcaption"
+)
+
+var ErrNoImage = errors.New("no image found in item directory")
+
+// Metadata is the sidecar stored as metadata.json next to a downloaded image.
+// Every ingester writes one, and every exporter reads them back
+type Metadata struct {
+	ID          string            `json:"id"`
+	Source      string            `json:"source"`
+	SourceURL   string            `json:"source_url"`
+	Caption     string            `json:"caption,omitempty"`
+	GroupID     string            `json:"group_id,omitempty"`
+	Width       int               `json:"width,omitempty"`
+	Height      int               `json:"height,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Size        int64             `json:"size,omitempty"`
+	SHA256      string            `json:"sha256,omitempty"`
+	License     string            `json:"license,omitempty"`
+	Retrieved   time.Time         `json:"retrieved"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+}
+
+// Captions returns every distinct piece of descriptive text for the image: the
+// caption first, then alt, title and figcaption text captured by the crawler
+func (m *Metadata) Captions() []string {
+	var captions []string
+	seen := map[string]bool{}
+	for _, c := range []string{m.Caption, m.Attributes[AttrAlt], m.Attributes[AttrTitle], m.Attributes[AttrFigcaption]} {
+		c = strings.TrimSpace(c)
+		if c == "" || seen[c] {
+			continue
+		}
+
+		seen[c] = true
+		captions = append(captions, c)
+	}
+
+	return captions
+}
+
+// Item is a single image in the corpus along with its parsed sidecar
+type Item struct {
+	Dir       string
+	ImagePath string
+	Meta      Metadata
+}
+
+// Ext returns the image extension without the leading dot, e.g. "jpg"
+func (i *Item) Ext() string {
+	return strings.TrimPrefix(filepath.Ext(i.ImagePath), ".")
+}
+
+// WriteMetadata writes the sidecar for an item into dir
+func WriteMetadata(dir string, m *Metadata) error {
+	buf, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, MetadataFile), buf, 0600)
+}
+
+// ReadMetadata reads the sidecar for the item stored in dir
+func ReadMetadata(dir string) (*Metadata, error) {
+	buf, err := os.ReadFile(filepath.Join(dir, MetadataFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var m Metadata
+	if err = json.Unmarshal(buf, &m); err != nil {
+		return nil, fmt.Errorf("invalid metadata in %s: %w", dir, err)
+	}
+
+	return &m, nil
+}
+
+// LoadItem reads the item stored in dir. Items without a sidecar or an image return an error
+func LoadItem(dir string) (*Item, error) {
+	m, err := ReadMetadata(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dir, ImageBase+".*"))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoImage, dir)
+	}
+
+	sort.Strings(matches)
+	if m.ID == "" {
+		m.ID = filepath.Base(dir)
+	}
+
+	return &Item{Dir: dir, ImagePath: matches[0], Meta: *m}, nil
+}
+
+// Load reads every item under root, which is laid out as root/<id>/{image.*,metadata.json}.
+// Items are sorted by ID so the result is the same on every run. Directories missing
+// a sidecar are skipped; malformed sidecars are returned as errors
+func Load(root string) ([]Item, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]Item, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		item, err := LoadItem(filepath.Join(root, e.Name()))
+		switch {
+		case err == nil:
+			items = append(items, *item)
+		case errors.Is(err, os.ErrNotExist), errors.Is(err, ErrNoImage):
+			continue
+		default:
+			return nil, err
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].Meta.ID < items[j].Meta.ID })
+	return items, nil
+}
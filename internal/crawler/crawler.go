@@ -3,18 +3,33 @@ package crawler
 import (
 	"net/http"
 	"net/url"
+	"sync"
 
+	"github.com/AnthonyHewins/imgscrape/internal/canon"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/exp/slog"
 )
 
+const defaultWorkers = 8
+
 type Crawler struct {
 	logger *slog.Logger
 	tracer trace.Tracer
 
 	urls       []*url.URL
 	httpClient *http.Client
+
+	frontier Frontier
+	maxDepth int
+	workers  int
+
+	sitemaps      bool
+	sitemapImages bool
+
+	canon      *canon.Canonicalizer
+	seenMu     sync.Mutex
+	seenImages map[string]struct{}
 }
 
 func New(traceName string, logger *slog.Logger, client *http.Client) *Crawler {
@@ -26,5 +41,58 @@ func New(traceName string, logger *slog.Logger, client *http.Client) *Crawler {
 		logger:     logger,
 		tracer:     otel.Tracer(traceName),
 		httpClient: client,
+		frontier:   NewMemoryFrontier(canon.Default),
+		workers:    defaultWorkers,
+		canon:      canon.Default,
+		seenImages: map[string]struct{}{},
 	}
 }
+
+// WithCanonicalizer sets how image URLs are canonicalized before they're deduplicated.
+// Pass the same canonicalizer to the frontier so pages are deduplicated the same way
+func (a *Crawler) WithCanonicalizer(c *canon.Canonicalizer) *Crawler {
+	a.canon = c
+	return a
+}
+
+// WithFrontier replaces the default in-memory frontier, e.g. with one from OpenFileFrontier
+// so the crawl can be resumed
+func (a *Crawler) WithFrontier(f Frontier) *Crawler {
+	a.frontier = f
+	return a
+}
+
+// WithMaxDepth follows same-host links up to depth hops away from the seed URLs.
+// 0, the default, only crawls the seeds
+func (a *Crawler) WithMaxDepth(depth int) *Crawler {
+	a.maxDepth = depth
+	return a
+}
+
+// firstSighting reports whether an image URL with the same canonical form hasn't been
+// returned by this crawler before
+func (a *Crawler) firstSighting(imageURL string) bool {
+	key, err := a.canon.String(imageURL)
+	if err != nil {
+		key = imageURL
+	}
+
+	a.seenMu.Lock()
+	defer a.seenMu.Unlock()
+
+	if _, ok := a.seenImages[key]; ok {
+		return false
+	}
+
+	a.seenImages[key] = struct{}{}
+	return true
+}
+
+// WithWorkers sets how many pages are fetched concurrently
+func (a *Crawler) WithWorkers(n int) *Crawler {
+	if n > 0 {
+		a.workers = n
+	}
+
+	return a
+}
@@ -0,0 +1,315 @@
+package crawler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AnthonyHewins/imgscrape/internal/canon"
+)
+
+// State is where a URL is in the crawl
+type State string
+
+const (
+	StateQueued     State = "queued"
+	StateInProgress State = "in_progress"
+	StateDone       State = "done"
+	StateFailed     State = "failed"
+)
+
+// Entry is a URL tracked by the frontier
+type Entry struct {
+	URL            string    `json:"url"`
+	Depth          int       `json:"depth"`
+	DiscoveredFrom string    `json:"discovered_from,omitempty"`
+	State          State     `json:"state"`
+	Attempts       int       `json:"attempts"`
+	Error          string    `json:"error,omitempty"`
+	Updated        time.Time `json:"updated"`
+}
+
+// Frontier is the set of URLs a crawl has seen. URLs are deduplicated by their
+// canonical form, so adding a URL that's already tracked is a no-op
+type Frontier interface {
+	// Add queues URLs that haven't been seen before and returns how many were new
+	Add(ctx context.Context, entries ...Entry) (int, error)
+
+	// Next claims up to n queued entries, marking them in progress
+	Next(ctx context.Context, n int) ([]Entry, error)
+
+	// Complete marks an entry done, or failed if err is non-nil
+	Complete(ctx context.Context, rawURL string, err error) error
+
+	// Counts returns how many entries are in each state
+	Counts() map[State]int
+
+	Close() error
+}
+
+// frontier is an in-memory frontier that optionally journals every change to a
+// file so a crawl can be resumed
+type frontier struct {
+	canon *canon.Canonicalizer
+
+	mu      sync.Mutex
+	entries map[string]*Entry
+	keys    []string // every key in the order it was first added
+	queue   []string
+
+	journal *os.File
+	w       *bufio.Writer
+}
+
+// NewMemoryFrontier returns a frontier that lives only as long as the process.
+// URLs are deduplicated by their canonical form; pass nil to use canon.Default
+func NewMemoryFrontier(c *canon.Canonicalizer) Frontier {
+	if c == nil {
+		c = canon.Default
+	}
+
+	return &frontier{canon: c, entries: map[string]*Entry{}}
+}
+
+// OpenFileFrontier opens (or creates) a frontier journaled to path. Every state change is
+// appended to the file as a JSON line. When an existing journal is opened it's replayed,
+// anything left in progress by a crash is queued again, and the journal is compacted.
+// Pass retryFailed to queue previously failed URLs again as well
+func OpenFileFrontier(path string, retryFailed bool, c *canon.Canonicalizer) (Frontier, error) {
+	f := NewMemoryFrontier(c).(*frontier)
+
+	if err := f.replay(path); err != nil {
+		return nil, err
+	}
+
+	for _, key := range f.keys {
+		e := f.entries[key]
+		if e.State == StateInProgress || (retryFailed && e.State == StateFailed) {
+			e.State = StateQueued
+		}
+
+		if e.State == StateQueued {
+			f.queue = append(f.queue, key)
+		}
+	}
+
+	// compact: rewrite the journal with one line per URL, then append from there
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	f.journal, f.w = file, bufio.NewWriter(file)
+	for _, key := range f.keys {
+		if err = f.record(f.entries[key]); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	if err = f.flush(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if err = os.Rename(tmp, path); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *frontier) replay(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// a crash mid-write can only ever truncate the last line, so a bad line
+	// is only an error if something follows it
+	var corrupt error
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if corrupt != nil {
+			return corrupt
+		}
+
+		var e Entry
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			corrupt = fmt.Errorf("corrupt frontier journal %s at line %d: %w", path, line, err)
+			continue
+		}
+
+		key, err := f.canon.String(e.URL)
+		if err != nil {
+			key = e.URL
+		}
+
+		if prev, ok := f.entries[key]; ok {
+			*prev = e
+			continue
+		}
+
+		f.entries[key] = &e
+		f.keys = append(f.keys, key)
+	}
+
+	return scanner.Err()
+}
+
+func (f *frontier) Add(ctx context.Context, entries ...Entry) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var added int
+	for i := range entries {
+		e := entries[i]
+		key, err := f.canon.String(e.URL)
+		if err != nil {
+			return added, err
+		}
+
+		if _, ok := f.entries[key]; ok {
+			continue
+		}
+
+		// the canonical form is only the key; the URL is fetched as given
+		e.State = StateQueued
+		e.Updated = time.Now().UTC()
+		f.entries[key] = &e
+		f.keys = append(f.keys, key)
+		f.queue = append(f.queue, key)
+		added++
+
+		if err = f.record(&e); err != nil {
+			return added, err
+		}
+	}
+
+	return added, f.flush()
+}
+
+func (f *frontier) Next(ctx context.Context, n int) ([]Entry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var claimed []Entry
+	for len(claimed) < n && len(f.queue) > 0 {
+		key := f.queue[0]
+		f.queue = f.queue[1:]
+
+		e := f.entries[key]
+		if e.State != StateQueued {
+			continue
+		}
+
+		e.State = StateInProgress
+		e.Attempts++
+		e.Updated = time.Now().UTC()
+		if err := f.record(e); err != nil {
+			return nil, err
+		}
+
+		claimed = append(claimed, *e)
+	}
+
+	return claimed, f.flush()
+}
+
+func (f *frontier) Complete(ctx context.Context, rawURL string, err error) error {
+	key, nerr := f.canon.String(rawURL)
+	if nerr != nil {
+		return nerr
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	e, ok := f.entries[key]
+	if !ok {
+		return fmt.Errorf("URL not in frontier: %s", rawURL)
+	}
+
+	e.State, e.Error = StateDone, ""
+	if err != nil {
+		e.State, e.Error = StateFailed, err.Error()
+	}
+
+	e.Updated = time.Now().UTC()
+	if err = f.record(e); err != nil {
+		return err
+	}
+
+	return f.flush()
+}
+
+func (f *frontier) Counts() map[State]int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	counts := map[State]int{}
+	for _, e := range f.entries {
+		counts[e.State]++
+	}
+
+	return counts
+}
+
+func (f *frontier) Close() error {
+	if f.journal == nil {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.flush(); err != nil {
+		f.journal.Close()
+		return err
+	}
+
+	if err := f.journal.Sync(); err != nil {
+		f.journal.Close()
+		return err
+	}
+
+	return f.journal.Close()
+}
+
+func (f *frontier) record(e *Entry) error {
+	if f.w == nil {
+		return nil
+	}
+
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.w.Write(append(buf, '\n')); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// flush pushes journal lines to the OS so they survive the process being killed
+func (f *frontier) flush() error {
+	if f.w == nil {
+		return nil
+	}
+
+	return f.w.Flush()
+}
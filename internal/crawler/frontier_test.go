@@ -0,0 +1,247 @@
+package crawler
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+func urls(entries []Entry) []string {
+	out := make([]string, len(entries))
+	for i, e := range entries {
+		out[i] = e.URL
+	}
+
+	return out
+}
+
+func TestFrontierOrder(t *testing.T) {
+	ctx := context.Background()
+	f := NewMemoryFrontier(nil)
+
+	n, err := f.Add(ctx,
+		Entry{URL: "https://a.example/1"},
+		Entry{URL: "https://b.example/1"},
+		Entry{URL: "https://a.example/2"},
+		Entry{URL: "HTTPS://A.EXAMPLE:443/1"}, // same as the first once canonical
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 3 {
+		t.Fatalf("added %d, want 3", n)
+	}
+
+	got, err := f.Next(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"https://a.example/1", "https://b.example/1"}; !reflect.DeepEqual(urls(got), want) {
+		t.Fatalf("first claim %v, want %v", urls(got), want)
+	}
+
+	for _, e := range got {
+		if e.State != StateInProgress || e.Attempts != 1 {
+			t.Fatalf("claimed %+v, want in progress on its first attempt", e)
+		}
+	}
+
+	// found later, so queued after everything already there
+	if _, err = f.Add(ctx, Entry{URL: "https://c.example/", Depth: 1, DiscoveredFrom: "https://a.example/1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = f.Next(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"https://a.example/2", "https://c.example/"}; !reflect.DeepEqual(urls(got), want) {
+		t.Fatalf("second claim %v, want %v", urls(got), want)
+	}
+
+	if got[1].Depth != 1 || got[1].DiscoveredFrom != "https://a.example/1" {
+		t.Fatalf("entry lost where it came from: %+v", got[1])
+	}
+
+	if got, _ = f.Next(ctx, 10); len(got) != 0 {
+		t.Fatalf("claimed %v from an empty queue", urls(got))
+	}
+
+	// completing by a URL with the same canonical form as the tracked one
+	if err = f.Complete(ctx, "https://A.example/1", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Complete(ctx, "https://b.example/1", errors.New("boom")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Complete(ctx, "https://unknown.example/", nil); err == nil {
+		t.Fatal("completed a URL that was never added")
+	}
+
+	want := map[State]int{StateDone: 1, StateFailed: 1, StateInProgress: 2}
+	if got := f.Counts(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("counts %v, want %v", got, want)
+	}
+
+	// re-adding a finished URL doesn't queue it again
+	if n, _ = f.Add(ctx, Entry{URL: "https://a.example/1"}); n != 0 {
+		t.Fatalf("re-added a done URL")
+	}
+}
+
+func TestFileFrontierResume(t *testing.T) {
+	tests := []struct {
+		name        string
+		retryFailed bool
+		want        []string
+	}{
+		{name: "in progress is queued again", want: []string{"https://a.example/2", "https://a.example/4"}},
+		{name: "retry failed", retryFailed: true, want: []string{"https://a.example/2", "https://a.example/3", "https://a.example/4"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			path := filepath.Join(t.TempDir(), "frontier.jsonl")
+
+			f, err := OpenFileFrontier(path, false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			f.Add(ctx,
+				Entry{URL: "https://a.example/1"},
+				Entry{URL: "https://a.example/2"},
+				Entry{URL: "https://a.example/3"},
+				Entry{URL: "https://a.example/4"},
+			)
+			f.Next(ctx, 3)
+			f.Complete(ctx, "https://a.example/1", nil)
+			f.Complete(ctx, "https://a.example/3", errors.New("boom"))
+			if err = f.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// 2 was left in progress, as if the process crashed
+			f, err = OpenFileFrontier(path, tc.retryFailed, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			got, err := f.Next(ctx, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(urls(got), tc.want) {
+				t.Fatalf("claimed %v, want %v", urls(got), tc.want)
+			}
+
+			if got[0].Attempts != 2 {
+				t.Fatalf("resumed entry has %d attempts, want 2", got[0].Attempts)
+			}
+		})
+	}
+}
+
+func TestFileFrontierCompacts(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "frontier.jsonl")
+
+	f, err := OpenFileFrontier(path, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Add(ctx, Entry{URL: "https://a.example/1"}, Entry{URL: "https://a.example/2"})
+	f.Next(ctx, 2)
+	f.Complete(ctx, "https://a.example/1", nil)
+	f.Close()
+
+	if f, err = OpenFileFrontier(path, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := strings.Count(string(buf), "\n"); lines != 2 {
+		t.Fatalf("compacted journal has %d lines, want one per URL:\n%s", lines, buf)
+	}
+}
+
+func TestFileFrontierCorruptJournal(t *testing.T) {
+	line := `{"url":"https://a.example/1","state":"queued"}` + "\n"
+	tests := []struct {
+		name    string
+		journal string
+		wantErr bool
+	}{
+		{name: "truncated last line", journal: line + `{"url":"https://a.exa`},
+		{name: "corrupt line in the middle", journal: line + "{nope\n" + line, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "frontier.jsonl")
+			if err := os.WriteFile(path, []byte(tc.journal), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err := OpenFileFrontier(path, false, nil)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got err %v, want one: %v", err, tc.wantErr)
+			}
+
+			if err == nil {
+				defer f.Close()
+				if got := f.Counts()[StateQueued]; got != 1 {
+					t.Fatalf("%d queued, want 1", got)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractLinksStaysOnHost(t *testing.T) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(`<html><body>
+		<a href="/relative">same host</a>
+		<a href="https://EXAMPLE.com/upper">same host, other case</a>
+		<a href="http://example.com:8080/port">same host, other port</a>
+		<a href="https://other.com/">other host</a>
+		<a href="https://sub.example.com/">subdomain</a>
+		<a href="mailto:someone@example.com">not http</a>
+		<a href="javascript:void(0)">not http</a>
+	</body></html>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pageURL, _ := url.Parse("https://example.com/dir/page")
+	got := extractLinks(newPage(doc, pageURL))
+	want := []string{
+		"https://example.com/relative",
+		"https://EXAMPLE.com/upper",
+		"http://example.com:8080/port",
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("links %v, want %v", got, want)
+	}
+}
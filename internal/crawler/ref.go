@@ -0,0 +1,224 @@
+package crawler
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/AnthonyHewins/imgscrape/internal/corpus"
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+)
+
+// Extractor names recorded on every ImageRef
+const (
+	ExtractorImg  = "img"
+	ExtractorMeta = "meta"
+)
+
+// ImageRef is a single image found on a page, with the surrounding text that
+// can be used as a weak label
+type ImageRef struct {
+	// URL is Src resolved against the page (and its <base>, if any). It's fetched as is;
+	// its canonical form is only used to deduplicate
+	URL string `json:"url"`
+	Src string `json:"src"`
+
+	Alt        string `json:"alt,omitempty"`
+	Title      string `json:"title,omitempty"`
+	Figcaption string `json:"figcaption,omitempty"`
+
+	// LinkHref is the resolved href of the closest enclosing <a>, if any
+	LinkHref string `json:"link_href,omitempty"`
+
+	PageURL   string `json:"page_url"`
+	PageTitle string `json:"page_title,omitempty"`
+
+	// Position is the zero based order the image appears in the document, counting
+	// the refs of every extractor
+	Position  int    `json:"position"`
+	Extractor string `json:"extractor"`
+
+	node *html.Node
+}
+
+// Attributes returns the ref's text as corpus sidecar attributes
+func (r *ImageRef) Attributes() map[string]string {
+	attrs := map[string]string{
+		"page_url":  r.PageURL,
+		"extractor": r.Extractor,
+	}
+
+	for k, v := range map[string]string{
+		corpus.AttrAlt:        r.Alt,
+		corpus.AttrTitle:      r.Title,
+		corpus.AttrFigcaption: r.Figcaption,
+		"link_href":           r.LinkHref,
+		"page_title":          r.PageTitle,
+	} {
+		if v != "" {
+			attrs[k] = v
+		}
+	}
+
+	return attrs
+}
+
+type page struct {
+	doc   *goquery.Document
+	base  *url.URL
+	host  string
+	url   string
+	title string
+}
+
+func newPage(doc *goquery.Document, pageURL *url.URL) *page {
+	base := pageURL
+	if href, ok := doc.Find("base[href]").First().Attr("href"); ok {
+		if u, err := pageURL.Parse(strings.TrimSpace(href)); err == nil {
+			base = u
+		}
+	}
+
+	return &page{
+		doc:   doc,
+		base:  base,
+		host:  pageURL.Hostname(),
+		url:   pageURL.String(),
+		title: clean(doc.Find("title").First().Text()),
+	}
+}
+
+func (p *page) resolve(ref string) string {
+	u, err := p.base.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return ""
+	}
+
+	return u.String()
+}
+
+func (p *page) ref(extractor, src string, node *goquery.Selection) ImageRef {
+	return ImageRef{
+		URL:       p.resolve(src),
+		Src:       src,
+		PageURL:   p.url,
+		PageTitle: p.title,
+		Extractor: extractor,
+		node:      node.Get(0),
+	}
+}
+
+// extractors run over every page. Their refs are put in document order
+var extractors = []func(p *page) []ImageRef{
+	extractImg,
+	extractMeta,
+}
+
+func extract(p *page) []ImageRef {
+	refs := []ImageRef{}
+	for _, fn := range extractors {
+		refs = append(refs, fn(p)...)
+	}
+
+	order := map[*html.Node]int{}
+	p.doc.Find("*").Each(func(i int, s *goquery.Selection) {
+		order[s.Get(0)] = i
+	})
+
+	sort.SliceStable(refs, func(i, j int) bool { return order[refs[i].node] < order[refs[j].node] })
+	for i := range refs {
+		refs[i].Position = i
+	}
+
+	return refs
+}
+
+// extractImg collects every <img src>, along with its alt/title, the text of the
+// enclosing <figure>'s <figcaption> and the enclosing link
+func extractImg(p *page) []ImageRef {
+	refs := []ImageRef{}
+	p.doc.Find("img").Each(func(_ int, img *goquery.Selection) {
+		src, _ := img.Attr("src")
+		if strings.TrimSpace(src) == "" {
+			return
+		}
+
+		ref := p.ref(ExtractorImg, src, img)
+		if ref.URL == "" {
+			return
+		}
+
+		ref.Alt = clean(img.AttrOr("alt", ""))
+		ref.Title = clean(img.AttrOr("title", ""))
+		ref.Figcaption = clean(img.Closest("figure").Find("figcaption").First().Text())
+
+		if href, ok := img.Closest("a[href]").Attr("href"); ok {
+			ref.LinkHref = p.resolve(href)
+		}
+
+		refs = append(refs, ref)
+	})
+
+	return refs
+}
+
+// extractMeta collects the page's social preview images (og:image, twitter:image).
+// Each takes its alt text from the og:image:alt or twitter:image:alt that follows it
+func extractMeta(p *page) []ImageRef {
+	refs := []ImageRef{}
+	last := map[string]int{} // og or twitter to the index of its latest ref
+	p.doc.Find(`meta[property="og:image"], meta[property="og:image:alt"], meta[name="twitter:image"], meta[name="twitter:image:alt"]`).Each(func(_ int, meta *goquery.Selection) {
+		name := meta.AttrOr("property", meta.AttrOr("name", ""))
+		kind, _, _ := strings.Cut(name, ":")
+		content := meta.AttrOr("content", "")
+
+		if strings.HasSuffix(name, ":alt") {
+			if i, ok := last[kind]; ok && refs[i].Alt == "" {
+				refs[i].Alt = clean(content)
+			}
+
+			return
+		}
+
+		// an alt after an image that's skipped isn't the next image's
+		delete(last, kind)
+		if strings.TrimSpace(content) == "" {
+			return
+		}
+
+		ref := p.ref(ExtractorMeta, content, meta)
+		if ref.URL == "" {
+			return
+		}
+
+		last[kind] = len(refs)
+		refs = append(refs, ref)
+	})
+
+	return refs
+}
+
+// extractLinks returns every http(s) link on the page that stays on the page's host
+func extractLinks(p *page) []string {
+	links := []string{}
+	p.doc.Find("a[href]").Each(func(_ int, a *goquery.Selection) {
+		u, err := p.base.Parse(strings.TrimSpace(a.AttrOr("href", "")))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return
+		}
+
+		if !strings.EqualFold(u.Hostname(), p.host) {
+			return
+		}
+
+		links = append(links, u.String())
+	})
+
+	return links
+}
+
+// clean collapses runs of whitespace so captions are single lines
+func clean(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
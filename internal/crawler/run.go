@@ -2,54 +2,256 @@ package crawler
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"net/url"
 
+	"github.com/AnthonyHewins/imgscrape/internal/httpcache"
+	"github.com/AnthonyHewins/imgscrape/internal/metrics"
 	"github.com/PuerkitoBio/goquery"
-	"github.com/sourcegraph/conc/pool"
+	"go.opentelemetry.io/otel/attribute"
+	otelCodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
 )
 
-func (a *Crawler) Run(ctx context.Context) ([][]string, error) {
-	p := pool.NewWithResults[[]string]().WithContext(ctx)
+// PageResult is the outcome of crawling a single page. Err is set if the page
+// couldn't be fetched or parsed, in which case Refs is empty
+type PageResult struct {
+	URL   string
+	Depth int
+	Refs  []ImageRef
+	Err   error
+}
 
-	for i, v := range a.urls {
-		uri := v.String()
-		l := a.logger.With("worker index", i, "url", uri)
+// Stream seeds the frontier with the crawler's URLs (and their sitemaps, if enabled), then crawls everything queued in it
+// and sends each page's result as soon as it finishes. Links found on a page are queued
+// while they're within the max depth. The channel is closed once the frontier has nothing
+// left to crawl or ctx is canceled. A failing page never affects the others
+func (a *Crawler) Stream(ctx context.Context) <-chan PageResult {
+	results := make(chan PageResult)
 
-		p.Go(func(ctx context.Context) ([]string, error) {
-			l.DebugCtx(ctx, "spawning worker")
-			req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
-			if err != nil {
-				l.ErrorCtx(ctx, "failed creating request object", "err", err)
-				return nil, err
+	go func() {
+		defer close(results)
+
+		seeds := make([]Entry, len(a.urls))
+		for i, v := range a.urls {
+			seeds[i] = Entry{URL: v.String()}
+		}
+
+		if _, err := a.frontier.Add(ctx, seeds...); err != nil {
+			a.logger.ErrorContext(ctx, "failed seeding frontier", "err", err)
+			select {
+			case results <- PageResult{Err: err}:
+			case <-ctx.Done():
 			}
+			return
+		}
 
-			l.DebugCtx(ctx, "performing HTTP GET")
-			resp, err := a.httpClient.Do(req)
-			if err != nil {
-				l.ErrorCtx(ctx, "failed fetching page", "err", err)
-				return nil, err
+		if a.sitemaps {
+			a.seedSitemaps(ctx, results)
+		}
+
+		done := make(chan struct{}, a.workers)
+		var inflight int
+		defer func() {
+			for ; inflight > 0; inflight-- {
+				<-done
+			}
+		}()
+
+		for ctx.Err() == nil {
+			if inflight == a.workers {
+				<-done
+				inflight--
+				continue
 			}
 
-			doc, err := goquery.NewDocumentFromReader(resp.Body)
+			entries, err := a.frontier.Next(ctx, a.workers-inflight)
 			if err != nil {
-				l.ErrorCtx(ctx, "failed parsing document", "err", err)
-				return nil, err
+				a.logger.ErrorContext(ctx, "failed claiming from frontier", "err", err)
+				select {
+				case results <- PageResult{Err: err}:
+				case <-ctx.Done():
+				}
+				return
 			}
 
-			images := []string{}
-			doc.Find("*").Each(func(_ int, item *goquery.Selection) {
-				link, exists := item.Find("img").Attr("src")
-				if !exists || link == "" {
+			if len(entries) == 0 {
+				// nothing queued; either every page is done or one in flight will queue more
+				if inflight == 0 {
 					return
 				}
 
-				l.DebugCtx(ctx, "found link", "link", link)
-				images = append(images, link)
-			})
+				select {
+				case <-done:
+					inflight--
+				case <-ctx.Done():
+				}
+				continue
+			}
+
+			for _, e := range entries {
+				inflight++
+				go func(e Entry) {
+					defer func() { done <- struct{}{} }()
+
+					result := a.visit(ctx, e)
+					select {
+					case results <- result:
+					case <-ctx.Done():
+					}
+				}(e)
+			}
+		}
+	}()
+
+	return results
+}
 
-			return images, nil
-		})
+// Run crawls everything and waits for it to finish. Results from pages that succeeded are
+// returned even when others fail; the error summarizes the failures
+func (a *Crawler) Run(ctx context.Context) ([][]ImageRef, error) {
+	pages := [][]ImageRef{}
+	var failed, total int
+	var firstErr error
+	for result := range a.Stream(ctx) {
+		total++
+		if result.Err != nil {
+			if failed == 0 {
+				firstErr = fmt.Errorf("%s: %w", result.URL, result.Err)
+			}
+
+			failed++
+			continue
+		}
+
+		pages = append(pages, result.Refs)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return pages, err
+	}
+
+	if failed > 0 {
+		return pages, fmt.Errorf("%d of %d pages failed, first error: %w", failed, total, firstErr)
 	}
 
-	return p.Wait()
+	return pages, nil
+}
+
+// visit crawls a single frontier entry, queues the links it finds and marks it complete
+func (a *Crawler) visit(ctx context.Context, e Entry) PageResult {
+	l := a.logger.With("url", e.URL, "depth", e.Depth)
+	result := PageResult{URL: e.URL, Depth: e.Depth}
+
+	ctx, span := a.tracer.Start(ctx, "crawl page", trace.WithAttributes(
+		attribute.String("page.url", e.URL),
+		attribute.Int("page.depth", e.Depth),
+	))
+	defer span.End()
+
+	pageURL, err := url.Parse(e.URL)
+	if err != nil {
+		result.Err = err
+	} else {
+		var links []string
+		result.Refs, links, result.Err = a.crawlPage(ctx, l, pageURL)
+
+		if result.Err == nil && e.Depth < a.maxDepth {
+			next := make([]Entry, len(links))
+			for i, link := range links {
+				next[i] = Entry{URL: link, Depth: e.Depth + 1, DiscoveredFrom: e.URL}
+			}
+
+			n, err := a.frontier.Add(ctx, next...)
+			if err != nil {
+				l.ErrorContext(ctx, "failed queueing links", "err", err)
+			}
+
+			l.DebugContext(ctx, "queued links", "found", len(links), "new", n)
+		}
+	}
+
+	if ctx.Err() != nil {
+		// leave it in progress; it's queued again when the frontier is reopened
+		return result
+	}
+
+	span.SetAttributes(attribute.Int("page.images", len(result.Refs)))
+	if result.Err != nil {
+		span.RecordError(result.Err)
+		span.SetStatus(otelCodes.Error, "Failed crawling page")
+		metrics.PagesFetched.WithLabelValues("failed").Inc()
+	} else {
+		metrics.PagesFetched.WithLabelValues("ok").Inc()
+		countRefs(result.Refs)
+	}
+
+	if err := a.frontier.Complete(ctx, e.URL, result.Err); err != nil {
+		l.ErrorContext(ctx, "failed updating frontier", "err", err)
+	}
+
+	return result
+}
+
+func (a *Crawler) crawlPage(ctx context.Context, l *slog.Logger, pageURL *url.URL) ([]ImageRef, []string, error) {
+	l.DebugCtx(ctx, "spawning worker")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL.String(), nil)
+	if err != nil {
+		l.ErrorCtx(ctx, "failed creating request object", "err", err)
+		return nil, nil, err
+	}
+
+	l.DebugCtx(ctx, "performing HTTP GET")
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		l.ErrorCtx(ctx, "failed fetching page", "err", err)
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if code := resp.StatusCode; code < 200 || code >= 300 {
+		l.ErrorCtx(ctx, "bad response code", "code", code)
+		return nil, nil, fmt.Errorf("bad response code received: %d", code)
+	}
+
+	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	if err != nil {
+		l.ErrorCtx(ctx, "failed parsing document", "err", err)
+		return nil, nil, err
+	}
+
+	p := newPage(doc, pageURL)
+	images := []ImageRef{}
+	if httpcache.Unchanged(resp) {
+		// nothing new to extract, but links still lead to pages that may have changed
+		l.DebugCtx(ctx, "page unchanged since last crawl")
+		return images, extractLinks(p), nil
+	}
+
+	_, span := a.tracer.Start(ctx, "extract")
+	defer span.End()
+
+	refs, links := extract(p), extractLinks(p)
+	span.SetAttributes(attribute.Int("extract.refs", len(refs)), attribute.Int("extract.links", len(links)))
+
+	for _, ref := range refs {
+		if !a.firstSighting(ref.URL) {
+			l.DebugCtx(ctx, "skipping duplicate image", "link", ref.URL, "extractor", ref.Extractor)
+			continue
+		}
+
+		l.DebugCtx(ctx, "found link", "link", ref.URL, "extractor", ref.Extractor)
+		images = append(images, ref)
+	}
+
+	return images, links, nil
+}
+
+// countRefs counts newly found images in metrics.ImagesDiscovered
+func countRefs(refs []ImageRef) {
+	for _, ref := range refs {
+		metrics.ImagesDiscovered.WithLabelValues(ref.Extractor).Inc()
+	}
 }
@@ -0,0 +1,257 @@
+package crawler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ExtractorSitemap is recorded on image refs taken from <image:loc> entries
+const ExtractorSitemap = "sitemap"
+
+const (
+	// sitemaps are capped at 50MB uncompressed by the protocol
+	maxSitemapSize = 50 << 20
+
+	// how deep sitemap indexes may nest
+	maxSitemapDepth = 5
+)
+
+// Sitemap is everything found by walking a site's sitemaps
+type Sitemap struct {
+	Pages  []Entry
+	Images []ImageRef
+}
+
+type sitemapDoc struct {
+	URLs []struct {
+		Loc    string `xml:"loc"`
+		Images []struct {
+			Loc     string `xml:"loc"`
+			Title   string `xml:"title"`
+			Caption string `xml:"caption"`
+		} `xml:"image"`
+	} `xml:"url"`
+
+	Sitemaps []struct {
+		Loc string `xml:"loc"`
+	} `xml:"sitemap"`
+}
+
+// WithSitemaps seeds the crawl from the sitemaps of every seed URL's site before crawling.
+// Sitemaps are discovered from robots.txt, falling back to /sitemap.xml. Every page listed
+// is queued at depth 0; with images, <image:loc> entries are also returned straight away
+// as a PageResult for the sitemap they came from, without having to crawl the page
+func (a *Crawler) WithSitemaps(images bool) *Crawler {
+	a.sitemaps = true
+	a.sitemapImages = images
+	return a
+}
+
+// DiscoverSitemaps returns the sitemaps advertised in the site's robots.txt, or
+// /sitemap.xml if robots.txt doesn't list any and it exists
+func (a *Crawler) DiscoverSitemaps(ctx context.Context, site *url.URL) ([]string, error) {
+	root := &url.URL{Scheme: site.Scheme, Host: site.Host}
+	l := a.logger.With("site", root.String())
+
+	robots, err := a.fetch(ctx, root.JoinPath("robots.txt").String())
+	if err != nil {
+		l.DebugContext(ctx, "no robots.txt", "err", err)
+	}
+
+	var sitemaps []string
+	scanner := bufio.NewScanner(bytes.NewReader(robots))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(key), "sitemap") {
+			continue
+		}
+
+		if u, err := root.Parse(strings.TrimSpace(value)); err == nil {
+			sitemaps = append(sitemaps, u.String())
+		}
+	}
+
+	if len(sitemaps) > 0 {
+		l.DebugContext(ctx, "found sitemaps in robots.txt", "sitemaps", sitemaps)
+		return sitemaps, nil
+	}
+
+	fallback := root.JoinPath("sitemap.xml").String()
+	if _, err = a.fetch(ctx, fallback); err != nil {
+		l.InfoContext(ctx, "site has no sitemap", "err", err)
+		return nil, nil
+	}
+
+	return []string{fallback}, nil
+}
+
+// ReadSitemap reads a sitemap, following nested sitemap indexes. Gzipped sitemaps are
+// decompressed transparently
+func (a *Crawler) ReadSitemap(ctx context.Context, sitemapURL string) (*Sitemap, error) {
+	s := &Sitemap{}
+	return s, a.readSitemap(ctx, sitemapURL, 0, map[string]bool{}, s)
+}
+
+func (a *Crawler) readSitemap(ctx context.Context, sitemapURL string, depth int, seen map[string]bool, s *Sitemap) error {
+	if seen[sitemapURL] {
+		return nil
+	}
+	seen[sitemapURL] = true
+
+	if depth > maxSitemapDepth {
+		return fmt.Errorf("sitemap indexes nested more than %d deep at %s", maxSitemapDepth, sitemapURL)
+	}
+
+	l := a.logger.With("sitemap", sitemapURL)
+	body, err := a.fetch(ctx, sitemapURL)
+	if err != nil {
+		l.ErrorContext(ctx, "failed fetching sitemap", "err", err)
+		return err
+	}
+
+	if len(body) > 2 && body[0] == 0x1f && body[1] == 0x8b {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+
+		if body, err = io.ReadAll(io.LimitReader(zr, maxSitemapSize)); err != nil {
+			l.ErrorContext(ctx, "failed decompressing sitemap", "err", err)
+			return err
+		}
+	}
+
+	var doc sitemapDoc
+	if err = xml.Unmarshal(body, &doc); err != nil {
+		l.ErrorContext(ctx, "failed parsing sitemap", "err", err)
+		return fmt.Errorf("invalid sitemap %s: %w", sitemapURL, err)
+	}
+
+	base, err := url.Parse(sitemapURL)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range doc.URLs {
+		pageURL, err := base.Parse(strings.TrimSpace(u.Loc))
+		if err != nil || u.Loc == "" {
+			continue
+		}
+
+		page := pageURL.String()
+		s.Pages = append(s.Pages, Entry{URL: page, DiscoveredFrom: sitemapURL})
+
+		for i, img := range u.Images {
+			imgURL, err := pageURL.Parse(strings.TrimSpace(img.Loc))
+			if err != nil || img.Loc == "" {
+				continue
+			}
+
+			s.Images = append(s.Images, ImageRef{
+				URL:        imgURL.String(),
+				Src:        img.Loc,
+				Title:      clean(img.Title),
+				Figcaption: clean(img.Caption),
+				PageURL:    page,
+				Position:   i,
+				Extractor:  ExtractorSitemap,
+			})
+		}
+	}
+
+	l.DebugContext(ctx, "read sitemap", "pages", len(doc.URLs), "nested", len(doc.Sitemaps))
+	for _, nested := range doc.Sitemaps {
+		u, err := base.Parse(strings.TrimSpace(nested.Loc))
+		if err != nil || nested.Loc == "" {
+			continue
+		}
+
+		if err = a.readSitemap(ctx, u.String(), depth+1, seen, s); err != nil {
+			// one broken child shouldn't lose the rest of the index
+			l.WarnContext(ctx, "skipping nested sitemap", "nested", u.String(), "err", err)
+		}
+	}
+
+	return nil
+}
+
+// seedSitemaps queues the pages from every seed site's sitemaps, sending image refs and
+// errors on results as it goes
+func (a *Crawler) seedSitemaps(ctx context.Context, results chan<- PageResult) {
+	send := func(r PageResult) {
+		select {
+		case results <- r:
+		case <-ctx.Done():
+		}
+	}
+
+	sites := map[string]bool{}
+	for _, seed := range a.urls {
+		if sites[seed.Host] {
+			continue
+		}
+		sites[seed.Host] = true
+
+		sitemaps, err := a.DiscoverSitemaps(ctx, seed)
+		if err != nil {
+			send(PageResult{URL: seed.String(), Err: err})
+			continue
+		}
+
+		for _, sitemapURL := range sitemaps {
+			s, err := a.ReadSitemap(ctx, sitemapURL)
+			if err != nil {
+				send(PageResult{URL: sitemapURL, Err: err})
+				continue
+			}
+
+			n, err := a.frontier.Add(ctx, s.Pages...)
+			if err != nil {
+				send(PageResult{URL: sitemapURL, Err: err})
+				continue
+			}
+
+			a.logger.InfoContext(ctx, "seeded from sitemap", "sitemap", sitemapURL, "pages", len(s.Pages), "new", n, "images", len(s.Images))
+			if !a.sitemapImages || len(s.Images) == 0 {
+				continue
+			}
+
+			refs := []ImageRef{}
+			for _, ref := range s.Images {
+				if a.firstSighting(ref.URL) {
+					refs = append(refs, ref)
+				}
+			}
+
+			countRefs(refs)
+			send(PageResult{URL: sitemapURL, Refs: refs})
+		}
+	}
+}
+
+func (a *Crawler) fetch(ctx context.Context, uri string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if code := resp.StatusCode; code < 200 || code >= 300 {
+		return nil, fmt.Errorf("bad response code received: %d", code)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxSitemapSize))
+}
@@ -0,0 +1,27 @@
+package download
+
+import "mime"
+
+// extensions for image types, which mime.ExtensionsByType doesn't know reliably on every system
+var extensions = map[string]string{
+	"image/jpeg":    ".jpg",
+	"image/png":     ".png",
+	"image/gif":     ".gif",
+	"image/webp":    ".webp",
+	"image/bmp":     ".bmp",
+	"image/tiff":    ".tif",
+	"image/svg+xml": ".svg",
+	"image/avif":    ".avif",
+}
+
+// Extension is the file extension, with its dot, to store an image of contentType with.
+// Parameters like charset are ignored. It reports false for types it doesn't know
+func Extension(contentType string) (string, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", false
+	}
+
+	ext, ok := extensions[mediaType]
+	return ext, ok
+}
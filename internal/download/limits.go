@@ -0,0 +1,158 @@
+package download
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/AnthonyHewins/imgscrape/internal/metrics"
+)
+
+// DefaultMaxBytes is the largest body Default allows
+const DefaultMaxBytes = 64 << 20
+
+var (
+	// ErrTooLarge is returned when a body is bigger than the limit, either as declared
+	// by Content-Length or once that many bytes have been read
+	ErrTooLarge = errors.New("response body too large")
+
+	// ErrNotImage is returned when a response's content type isn't an allowed type
+	ErrNotImage = errors.New("response is not an image")
+)
+
+// Limits caps what a download is allowed to be
+type Limits struct {
+	// MaxBytes is the most a body may be. 0 means unlimited
+	MaxBytes int64
+
+	// AllowedTypes are the MIME types accepted. A type ending in "/*" matches
+	// everything under it. Empty allows everything
+	AllowedTypes []string
+}
+
+// Default allows images up to DefaultMaxBytes
+var Default = Limits{MaxBytes: DefaultMaxBytes, AllowedTypes: []string{"image/*"}}
+
+// Body checks resp against the limits before anything is read, then returns its body wrapped
+// so that reading past MaxBytes fails with ErrTooLarge. If the server doesn't declare a
+// useful Content-Type, the first bytes are sniffed instead. On error the body is closed.
+// Rejections and the bytes read are counted in metrics
+func (l Limits) Body(resp *http.Response) (io.ReadCloser, error) {
+	body, err := l.body(resp)
+	if err != nil {
+		resp.Body.Close()
+		if errors.Is(err, ErrTooLarge) {
+			metrics.Rejected(metrics.ReasonTooLarge)
+		} else if errors.Is(err, ErrNotImage) {
+			metrics.Rejected(metrics.ReasonNotImage)
+		}
+
+		return nil, err
+	}
+
+	return body, nil
+}
+
+func (l Limits) body(resp *http.Response) (io.ReadCloser, error) {
+	if l.MaxBytes > 0 && resp.ContentLength > l.MaxBytes {
+		return nil, fmt.Errorf("%w: Content-Length %d exceeds %d bytes", ErrTooLarge, resp.ContentLength, l.MaxBytes)
+	}
+
+	var r io.Reader = countingReader{resp.Body}
+	if l.MaxBytes > 0 {
+		r = &limitReader{r: r, n: l.MaxBytes}
+	}
+
+	if len(l.AllowedTypes) == 0 {
+		return readCloser{r, resp.Body}, nil
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "" || mediaType == "application/octet-stream" {
+		buffered := bufio.NewReaderSize(r, 512)
+		head, err := buffered.Peek(512)
+		if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+
+		contentType, r = http.DetectContentType(head), buffered
+	}
+
+	if !l.Allowed(contentType) {
+		return nil, fmt.Errorf("%w: content type %q", ErrNotImage, contentType)
+	}
+
+	return readCloser{r, resp.Body}, nil
+}
+
+// Allowed reports whether contentType matches AllowedTypes
+func (l Limits) Allowed(contentType string) bool {
+	if len(l.AllowedTypes) == 0 {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, t := range l.AllowedTypes {
+		t = strings.ToLower(strings.TrimSpace(t))
+		switch {
+		case strings.HasSuffix(t, "/*"):
+			if strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*")) {
+				return true
+			}
+		case t == mediaType:
+			return true
+		}
+	}
+
+	return false
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// limitReader is io.LimitReader, except going over the limit is an error rather than EOF
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, ErrTooLarge
+	}
+
+	// read one byte past the limit to tell a body of exactly n bytes from a bigger one
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		metrics.Rejected(metrics.ReasonTooLarge)
+		return n + int(l.n), ErrTooLarge
+	}
+
+	return n, err
+}
+
+// countingReader adds everything read to metrics.DownloadBytes
+type countingReader struct {
+	r io.Reader
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	metrics.DownloadBytes.Add(float64(n))
+	return n, err
+}
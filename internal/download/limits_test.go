@@ -0,0 +1,211 @@
+package download
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// png is the start of a PNG file, enough for http.DetectContentType
+var png = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+type trackedBody struct {
+	io.Reader
+	closed bool
+}
+
+func (b *trackedBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestLimitsBody(t *testing.T) {
+	limits := Limits{MaxBytes: 32, AllowedTypes: []string{"image/*"}}
+
+	tests := []struct {
+		name          string
+		limits        Limits
+		contentType   string
+		contentLength int64 // -1 for unknown
+		body          []byte
+		wantErr       error // from Body
+		wantReadErr   error // from reading the body
+	}{
+		{
+			name:          "allowed",
+			limits:        limits,
+			contentType:   "image/png",
+			contentLength: int64(len(png)),
+			body:          png,
+		},
+		{
+			name:          "allowed type with parameters",
+			limits:        limits,
+			contentType:   "image/jpeg; charset=binary",
+			contentLength: -1,
+			body:          png,
+		},
+		{
+			name:          "exactly max bytes",
+			limits:        limits,
+			contentType:   "image/png",
+			contentLength: -1,
+			body:          bytes.Repeat([]byte{1}, 32),
+		},
+		{
+			name:          "body over max bytes",
+			limits:        limits,
+			contentType:   "image/png",
+			contentLength: -1,
+			body:          bytes.Repeat([]byte{1}, 33),
+			wantReadErr:   ErrTooLarge,
+		},
+		{
+			name:          "body over max bytes while sniffing",
+			limits:        Limits{MaxBytes: 8, AllowedTypes: []string{"image/*"}},
+			contentLength: -1,
+			body:          png,
+			wantErr:       ErrTooLarge,
+		},
+		{
+			name:          "declared content length over max bytes",
+			limits:        limits,
+			contentType:   "image/png",
+			contentLength: 33,
+			body:          png,
+			wantErr:       ErrTooLarge,
+		},
+		{
+			name:          "no max bytes",
+			limits:        Limits{AllowedTypes: []string{"image/png"}},
+			contentType:   "image/png",
+			contentLength: 1 << 40,
+			body:          png,
+		},
+		{
+			name:          "disallowed type",
+			limits:        limits,
+			contentType:   "text/html; charset=utf-8",
+			contentLength: -1,
+			body:          []byte("<html></html>"),
+			wantErr:       ErrNotImage,
+		},
+		{
+			name:          "exact type not in allowed",
+			limits:        Limits{AllowedTypes: []string{"image/png"}},
+			contentType:   "image/jpeg",
+			contentLength: -1,
+			body:          png,
+			wantErr:       ErrNotImage,
+		},
+		{
+			name:          "missing type sniffed as an image",
+			limits:        limits,
+			contentLength: -1,
+			body:          png,
+		},
+		{
+			name:          "octet-stream sniffed as an image",
+			limits:        limits,
+			contentType:   "application/octet-stream",
+			contentLength: -1,
+			body:          png,
+		},
+		{
+			name:          "missing type sniffed as something else",
+			limits:        limits,
+			contentLength: -1,
+			body:          []byte("<!DOCTYPE html><html></html>"),
+			wantErr:       ErrNotImage,
+		},
+		{
+			name:          "unparseable type sniffed",
+			limits:        limits,
+			contentType:   "image/",
+			contentLength: -1,
+			body:          png,
+		},
+		{
+			name:          "no allowed types",
+			limits:        Limits{MaxBytes: 32},
+			contentType:   "text/plain",
+			contentLength: -1,
+			body:          []byte("anything"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			raw := &trackedBody{Reader: bytes.NewReader(tc.body)}
+			resp := &http.Response{
+				Header:        http.Header{},
+				ContentLength: tc.contentLength,
+				Body:          raw,
+			}
+
+			if tc.contentType != "" {
+				resp.Header.Set("Content-Type", tc.contentType)
+			}
+
+			body, err := tc.limits.Body(resp)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Body: got err %v, want %v", err, tc.wantErr)
+			}
+
+			if err != nil {
+				if !raw.closed {
+					t.Fatal("body wasn't closed after it was rejected")
+				}
+				return
+			}
+
+			got, err := io.ReadAll(body)
+			if !errors.Is(err, tc.wantReadErr) {
+				t.Fatalf("reading: got err %v, want %v", err, tc.wantReadErr)
+			}
+
+			if err == nil && !bytes.Equal(got, tc.body) {
+				t.Fatalf("read %q, want %q", got, tc.body)
+			}
+
+			if err != nil && int64(len(got)) > tc.limits.MaxBytes {
+				t.Fatalf("read %d bytes past the %d byte limit", len(got), tc.limits.MaxBytes)
+			}
+
+			if err = body.Close(); err != nil || !raw.closed {
+				t.Fatalf("closing didn't close the response body: %v", err)
+			}
+		})
+	}
+}
+
+func TestLimitsAllowed(t *testing.T) {
+	limits := Limits{AllowedTypes: []string{"image/*", " Application/PDF "}}
+
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"image/png", true},
+		{"IMAGE/PNG", true},
+		{"image/jpeg; charset=binary", true},
+		{"application/pdf", true},
+		{"application/pdfx", false},
+		{"imagex/png", false},
+		{"text/html", false},
+		{"", false},
+		{"not a type", false},
+	}
+
+	for _, tc := range tests {
+		if got := limits.Allowed(tc.contentType); got != tc.want {
+			t.Errorf("Allowed(%q) = %v, want %v", tc.contentType, got, tc.want)
+		}
+	}
+
+	if !(Limits{}).Allowed("text/plain") {
+		t.Error("no allowed types should allow everything")
+	}
+}
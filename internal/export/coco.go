@@ -0,0 +1,133 @@
+package export
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/AnthonyHewins/imgscrape/internal/corpus"
+)
+
+// COCO is a COCO captions dataset: the same layout as captions_train2017.json
+type COCO struct {
+	Info        COCOInfo         `json:"info"`
+	Licenses    []COCOLicense    `json:"licenses"`
+	Images      []COCOImage      `json:"images"`
+	Annotations []COCOAnnotation `json:"annotations"`
+}
+
+type COCOInfo struct {
+	Description string `json:"description"`
+	Version     string `json:"version"`
+	DateCreated string `json:"date_created"`
+}
+
+type COCOLicense struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type COCOImage struct {
+	ID           int64  `json:"id"`
+	FileName     string `json:"file_name"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	License      int    `json:"license,omitempty"`
+	CocoURL      string `json:"coco_url,omitempty"`
+	DateCaptured string `json:"date_captured,omitempty"`
+	ImgscrapeID  string `json:"imgscrape_id"`
+}
+
+type COCOAnnotation struct {
+	ID      int64  `json:"id"`
+	ImageID int64  `json:"image_id"`
+	Caption string `json:"caption"`
+}
+
+// NewCOCO builds a COCO captions dataset from the same records as the manifest.
+// Every caption, alt, title and figcaption for an image becomes an annotation.
+// Image and annotation IDs are hashes of the corpus ID (and caption), so they
+// don't change between exports; images without any caption are left out
+func NewCOCO(root string, items []corpus.Item) (*COCO, error) {
+	records, err := Records(root, items)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &COCO{
+		Info: COCOInfo{
+			Description: "imgscrape captions export",
+			Version:     "1.0",
+			DateCreated: time.Now().UTC().Format(time.RFC3339),
+		},
+		Licenses:    []COCOLicense{},
+		Images:      []COCOImage{},
+		Annotations: []COCOAnnotation{},
+	}
+
+	licenses := map[string]int{}
+	for i := range records {
+		if l := records[i].License; l != "" {
+			licenses[l] = 0
+		}
+	}
+
+	names := make([]string, 0, len(licenses))
+	for name := range licenses {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for i, name := range names {
+		licenses[name] = i + 1
+		c.Licenses = append(c.Licenses, COCOLicense{ID: i + 1, Name: name})
+	}
+
+	for i := range records {
+		r := &records[i]
+		captions := items[i].Meta.Captions()
+		if len(captions) == 0 {
+			continue
+		}
+
+		imageID := stableID(r.ID)
+		img := COCOImage{
+			ID:          imageID,
+			FileName:    r.Path,
+			Width:       r.Width,
+			Height:      r.Height,
+			License:     licenses[r.License],
+			CocoURL:     r.SourceURL,
+			ImgscrapeID: r.ID,
+		}
+
+		if !r.Retrieved.IsZero() {
+			img.DateCaptured = r.Retrieved.Format("2006-01-02 15:04:05")
+		}
+
+		c.Images = append(c.Images, img)
+		for _, caption := range captions {
+			c.Annotations = append(c.Annotations, COCOAnnotation{
+				ID:      stableID(r.ID, caption),
+				ImageID: imageID,
+				Caption: caption,
+			})
+		}
+	}
+
+	return c, nil
+}
+
+// stableID hashes the parts into a positive integer that fits in a float64 mantissa,
+// so it survives JSON parsers that read every number as a double
+func stableID(parts ...string) int64 {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+
+	return int64(binary.BigEndian.Uint64(h.Sum(nil)[:8]) >> 11)
+}
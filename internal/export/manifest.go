@@ -0,0 +1,103 @@
+package export
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/AnthonyHewins/imgscrape/internal/corpus"
+)
+
+// Record is one row of the manifest: everything known about a single stored image
+type Record struct {
+	ID          string    `json:"id"`
+	Path        string    `json:"path"`
+	SourceURL   string    `json:"source_url"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	ContentType string    `json:"content_type"`
+	License     string    `json:"license"`
+	Caption     string    `json:"caption"`
+	GroupID     string    `json:"group_id"`
+	Source      string    `json:"source"`
+	Retrieved   time.Time `json:"retrieved"`
+}
+
+// Records builds a manifest record for every item. Paths are relative to root so
+// they can double as blob keys. Checksums missing from a sidecar are computed from the image
+func Records(root string, items []corpus.Item) ([]Record, error) {
+	records := make([]Record, len(items))
+	for i := range items {
+		item := &items[i]
+		m := &item.Meta
+
+		path, err := filepath.Rel(root, item.ImagePath)
+		if err != nil {
+			return nil, err
+		}
+
+		sum, size := m.SHA256, m.Size
+		if sum == "" || size == 0 {
+			if sum, size, err = checksum(item.ImagePath); err != nil {
+				return nil, err
+			}
+		}
+
+		var caption string
+		if captions := m.Captions(); len(captions) > 0 {
+			caption = captions[0]
+		}
+
+		records[i] = Record{
+			ID:          m.ID,
+			Path:        filepath.ToSlash(path),
+			SourceURL:   m.SourceURL,
+			Width:       m.Width,
+			Height:      m.Height,
+			Size:        size,
+			SHA256:      sum,
+			ContentType: m.ContentType,
+			License:     m.License,
+			Caption:     caption,
+			GroupID:     m.GroupID,
+			Source:      m.Source,
+			Retrieved:   m.Retrieved.UTC(),
+		}
+	}
+
+	return records, nil
+}
+
+// WriteJSONL writes one JSON object per line
+func WriteJSONL(w io.Writer, records []Record) error {
+	enc := json.NewEncoder(w)
+	for i := range records {
+		if err := enc.Encode(&records[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func checksum(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
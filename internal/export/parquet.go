@@ -0,0 +1,317 @@
+package export
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// This is a deliberately small Parquet writer: every column is REQUIRED, PLAIN
+// encoded and uncompressed, with one data page per column per row group, which is
+// all a manifest needs. See https://github.com/apache/parquet-format for the layout
+// being written; parquet_test.go decodes it back by that spec
+
+const (
+	parquetMagic        = "PAR1"
+	parquetCreatedBy    = "imgscrape"
+	parquetRowGroupSize = 50000
+)
+
+// physical types
+const (
+	parquetInt32     int32 = 1
+	parquetInt64     int32 = 2
+	parquetByteArray int32 = 6
+)
+
+// converted types; -1 means none
+const (
+	parquetNoConversion    int32 = -1
+	parquetUTF8            int32 = 0
+	parquetTimestampMillis int32 = 9
+)
+
+const (
+	parquetRequired     int32 = 0
+	parquetPlain        int32 = 0
+	parquetRLE          int32 = 3
+	parquetDataPage     int32 = 0
+	parquetUncompressed int32 = 0
+)
+
+type parquetColumn struct {
+	name      string
+	typ       int32
+	converted int32
+	encode    func(buf []byte, r *Record) []byte
+}
+
+var manifestColumns = []parquetColumn{
+	stringColumn("id", func(r *Record) string { return r.ID }),
+	stringColumn("path", func(r *Record) string { return r.Path }),
+	stringColumn("source_url", func(r *Record) string { return r.SourceURL }),
+	{name: "width", typ: parquetInt32, converted: parquetNoConversion, encode: func(buf []byte, r *Record) []byte {
+		return binary.LittleEndian.AppendUint32(buf, uint32(r.Width))
+	}},
+	{name: "height", typ: parquetInt32, converted: parquetNoConversion, encode: func(buf []byte, r *Record) []byte {
+		return binary.LittleEndian.AppendUint32(buf, uint32(r.Height))
+	}},
+	{name: "size", typ: parquetInt64, converted: parquetNoConversion, encode: func(buf []byte, r *Record) []byte {
+		return binary.LittleEndian.AppendUint64(buf, uint64(r.Size))
+	}},
+	stringColumn("sha256", func(r *Record) string { return r.SHA256 }),
+	stringColumn("content_type", func(r *Record) string { return r.ContentType }),
+	stringColumn("license", func(r *Record) string { return r.License }),
+	stringColumn("caption", func(r *Record) string { return r.Caption }),
+	stringColumn("group_id", func(r *Record) string { return r.GroupID }),
+	stringColumn("source", func(r *Record) string { return r.Source }),
+	{name: "retrieved", typ: parquetInt64, converted: parquetTimestampMillis, encode: func(buf []byte, r *Record) []byte {
+		return binary.LittleEndian.AppendUint64(buf, uint64(r.Retrieved.UnixMilli()))
+	}},
+}
+
+func stringColumn(name string, get func(r *Record) string) parquetColumn {
+	return parquetColumn{
+		name:      name,
+		typ:       parquetByteArray,
+		converted: parquetUTF8,
+		encode: func(buf []byte, r *Record) []byte {
+			s := get(r)
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(len(s)))
+			return append(buf, s...)
+		},
+	}
+}
+
+// WriteParquet writes the records as a single Parquet file
+func WriteParquet(w io.Writer, records []Record) error {
+	bw := bufio.NewWriter(w)
+	out := &countingWriter{w: bw}
+	if _, err := io.WriteString(out, parquetMagic); err != nil {
+		return err
+	}
+
+	var rowGroups []*rowGroup
+	for start := 0; start < len(records); start += parquetRowGroupSize {
+		end := start + parquetRowGroupSize
+		if end > len(records) {
+			end = len(records)
+		}
+
+		rg, err := writeRowGroup(out, records[start:end])
+		if err != nil {
+			return err
+		}
+
+		rowGroups = append(rowGroups, rg)
+	}
+
+	// FileMetaData
+	meta := &thriftWriter{}
+	meta.i32(1, 1)
+	meta.listBegin(2, thriftStruct, len(manifestColumns)+1)
+	meta.structBegin()
+	meta.str(4, "schema")
+	meta.i32(5, int32(len(manifestColumns)))
+	meta.structEnd()
+	for _, c := range manifestColumns {
+		meta.structBegin()
+		meta.i32(1, c.typ)
+		meta.i32(3, parquetRequired)
+		meta.str(4, c.name)
+		if c.converted != parquetNoConversion {
+			meta.i32(6, c.converted)
+		}
+		meta.structEnd()
+	}
+	meta.i64(3, int64(len(records)))
+	meta.listBegin(4, thriftStruct, len(rowGroups))
+	for _, rg := range rowGroups {
+		rg.encode(meta)
+	}
+	meta.str(6, parquetCreatedBy)
+	meta.stop()
+
+	footer := binary.LittleEndian.AppendUint32(meta.buf, uint32(len(meta.buf)))
+	if _, err := out.Write(append(footer, parquetMagic...)); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+type columnChunk struct {
+	col    *parquetColumn
+	offset int64
+	size   int64
+}
+
+type rowGroup struct {
+	rows   int
+	chunks []columnChunk
+}
+
+func writeRowGroup(out *countingWriter, records []Record) (*rowGroup, error) {
+	rg := &rowGroup{rows: len(records), chunks: make([]columnChunk, len(manifestColumns))}
+	for i := range manifestColumns {
+		col := &manifestColumns[i]
+
+		var data []byte
+		for j := range records {
+			data = col.encode(data, &records[j])
+		}
+
+		hdr := &thriftWriter{}
+		hdr.i32(1, parquetDataPage)
+		hdr.i32(2, int32(len(data)))
+		hdr.i32(3, int32(len(data)))
+		hdr.structField(5)
+		hdr.i32(1, int32(len(records)))
+		hdr.i32(2, parquetPlain)
+		hdr.i32(3, parquetRLE)
+		hdr.i32(4, parquetRLE)
+		hdr.structEnd()
+		hdr.stop()
+
+		offset := out.n
+		if _, err := out.Write(hdr.buf); err != nil {
+			return nil, err
+		}
+
+		if _, err := out.Write(data); err != nil {
+			return nil, err
+		}
+
+		rg.chunks[i] = columnChunk{col: col, offset: offset, size: out.n - offset}
+	}
+
+	return rg, nil
+}
+
+// encode appends the RowGroup struct as an element of the footer's row group list
+func (rg *rowGroup) encode(t *thriftWriter) {
+	var total int64
+	for _, c := range rg.chunks {
+		total += c.size
+	}
+
+	t.structBegin()
+	t.listBegin(1, thriftStruct, len(rg.chunks))
+	for _, c := range rg.chunks {
+		t.structBegin()
+		t.i64(2, c.offset)
+		t.structField(3)
+		t.i32(1, c.col.typ)
+		t.listBegin(2, thriftI32, 2)
+		t.varint(int64(parquetPlain))
+		t.varint(int64(parquetRLE))
+		t.listBegin(3, thriftBinary, 1)
+		t.bytes(c.col.name)
+		t.i32(4, parquetUncompressed)
+		t.i64(5, int64(rg.rows))
+		t.i64(6, c.size)
+		t.i64(7, c.size)
+		t.i64(9, c.offset)
+		t.structEnd()
+		t.structEnd()
+	}
+	t.i64(2, total)
+	t.i64(3, int64(rg.rows))
+	t.structEnd()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// thrift compact protocol types
+const (
+	thriftI32    byte = 5
+	thriftI64    byte = 6
+	thriftBinary byte = 8
+	thriftList   byte = 9
+	thriftStruct byte = 12
+)
+
+// thriftWriter is a minimal thrift compact protocol encoder covering what the
+// Parquet footer and page headers need
+type thriftWriter struct {
+	buf  []byte
+	last []int16
+	prev int16
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if delta := id - t.prev; delta > 0 && delta <= 15 {
+		t.buf = append(t.buf, byte(delta)<<4|typ)
+	} else {
+		t.buf = append(t.buf, typ)
+		t.varint(int64(id))
+	}
+
+	t.prev = id
+}
+
+func (t *thriftWriter) varint(v int64) {
+	t.buf = binary.AppendUvarint(t.buf, uint64((v<<1)^(v>>63)))
+}
+
+func (t *thriftWriter) bytes(s string) {
+	t.buf = binary.AppendUvarint(t.buf, uint64(len(s)))
+	t.buf = append(t.buf, s...)
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(v)
+}
+
+func (t *thriftWriter) str(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.bytes(s)
+}
+
+func (t *thriftWriter) listBegin(id int16, elem byte, size int) {
+	t.field(id, thriftList)
+	if size < 15 {
+		t.buf = append(t.buf, byte(size)<<4|elem)
+		return
+	}
+
+	t.buf = append(t.buf, 0xf0|elem)
+	t.buf = binary.AppendUvarint(t.buf, uint64(size))
+}
+
+// structField begins a struct-typed field
+func (t *thriftWriter) structField(id int16) {
+	t.field(id, thriftStruct)
+	t.structBegin()
+}
+
+// structBegin begins a struct, either as a list element or after structField
+func (t *thriftWriter) structBegin() {
+	t.last = append(t.last, t.prev)
+	t.prev = 0
+}
+
+func (t *thriftWriter) structEnd() {
+	t.stop()
+	t.prev = t.last[len(t.last)-1]
+	t.last = t.last[:len(t.last)-1]
+}
+
+func (t *thriftWriter) stop() {
+	t.buf = append(t.buf, 0)
+}
@@ -0,0 +1,325 @@
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWriteParquet(t *testing.T) {
+	for _, n := range []int{0, 1, 3, parquetRowGroupSize, 2*parquetRowGroupSize + 1} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			records := testRecords(n)
+
+			var buf bytes.Buffer
+			if err := WriteParquet(&buf, records); err != nil {
+				t.Fatal(err)
+			}
+
+			got := readParquet(t, buf.Bytes())
+			if len(got) != len(records) {
+				t.Fatalf("read %d records, wrote %d", len(got), len(records))
+			}
+
+			for i := range records {
+				if got[i] != records[i] {
+					t.Fatalf("record %d: read %+v, wrote %+v", i, got[i], records[i])
+				}
+			}
+		})
+	}
+}
+
+func testRecords(n int) []Record {
+	records := make([]Record, n)
+	for i := range records {
+		records[i] = Record{
+			ID:          fmt.Sprintf("id-%d", i),
+			Path:        fmt.Sprintf("images/%d/image.jpg", i),
+			SourceURL:   fmt.Sprintf("https://example.com/%d.jpg", i),
+			Width:       i % 4000,
+			Height:      -i, // negative values must survive the round trip too
+			Size:        int64(i) << 33,
+			SHA256:      fmt.Sprintf("%064x", i),
+			ContentType: "image/jpeg",
+			License:     "CC0-1.0",
+			Caption:     string(bytes.Repeat([]byte("é"), i%7)),
+			GroupID:     fmt.Sprint(i / 3),
+			Source:      "test",
+			Retrieved:   time.UnixMilli(1700000000000 + int64(i)).UTC(),
+		}
+	}
+
+	return records
+}
+
+// readParquet decodes a file following the format spec, independently of the writer,
+// and checks its structure along the way
+func readParquet(t *testing.T, file []byte) []Record {
+	t.Helper()
+
+	if len(file) < 12 || string(file[:4]) != parquetMagic || string(file[len(file)-4:]) != parquetMagic {
+		t.Fatal("missing PAR1 magic")
+	}
+
+	metaLen := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	metaStart := len(file) - 8 - metaLen
+	if metaStart < 4 {
+		t.Fatalf("footer length %d doesn't fit the file", metaLen)
+	}
+
+	r := &thriftReader{buf: file[metaStart : len(file)-8]}
+	meta := r.readStruct()
+	if r.err != nil || r.pos != len(r.buf) {
+		t.Fatalf("footer didn't decode exactly: %v, %d of %d bytes", r.err, r.pos, len(r.buf))
+	}
+
+	if v := meta[1]; v != int64(1) {
+		t.Errorf("version = %v", v)
+	}
+
+	if v := meta[6]; v != parquetCreatedBy {
+		t.Errorf("created_by = %v", v)
+	}
+
+	// schema: the root, then one leaf per column
+	schema := meta[2].([]any)
+	if len(schema) != len(manifestColumns)+1 {
+		t.Fatalf("%d schema elements", len(schema))
+	}
+
+	if root := schema[0].(map[int16]any); root[4] != "schema" || root[5] != int64(len(manifestColumns)) {
+		t.Fatalf("root schema element %v", root)
+	}
+
+	for i, c := range manifestColumns {
+		el := schema[i+1].(map[int16]any)
+		if el[4] != c.name || el[1] != int64(c.typ) || el[3] != int64(parquetRequired) {
+			t.Fatalf("schema element %d = %v, want column %s", i+1, el, c.name)
+		}
+
+		if converted, ok := el[6]; (c.converted == parquetNoConversion) == ok || ok && converted != int64(c.converted) {
+			t.Fatalf("column %s converted type %v", c.name, converted)
+		}
+	}
+
+	rowGroups := meta[4].([]any)
+	if want := (meta[3].(int64) + parquetRowGroupSize - 1) / parquetRowGroupSize; int64(len(rowGroups)) != want {
+		t.Fatalf("%d row groups for %d rows", len(rowGroups), meta[3])
+	}
+
+	var records []Record
+	for _, v := range rowGroups {
+		rg := v.(map[int16]any)
+		rows := int(rg[3].(int64))
+		chunks := rg[1].([]any)
+		if len(chunks) != len(manifestColumns) {
+			t.Fatalf("%d column chunks", len(chunks))
+		}
+
+		start := len(records)
+		records = append(records, make([]Record, rows)...)
+		group := records[start:]
+
+		var total int64
+		for i, v := range chunks {
+			chunk := v.(map[int16]any)
+			cm := chunk[3].(map[int16]any)
+			c := manifestColumns[i]
+
+			if path := cm[3].([]any); len(path) != 1 || path[0] != c.name {
+				t.Fatalf("chunk %d path %v, want %s", i, path, c.name)
+			}
+
+			if cm[1] != int64(c.typ) || cm[4] != int64(parquetUncompressed) || cm[5] != int64(rows) {
+				t.Fatalf("chunk %s metadata %v", c.name, cm)
+			}
+
+			offset, size := cm[9].(int64), cm[7].(int64)
+			total += size
+			if chunk[2] != offset || offset < 4 || offset+size > int64(metaStart) {
+				t.Fatalf("chunk %s at %d+%d is outside the data", c.name, offset, size)
+			}
+
+			page := &thriftReader{buf: file[offset : offset+size]}
+			hdr := page.readStruct()
+			if page.err != nil {
+				t.Fatal(page.err)
+			}
+
+			dph := hdr[5].(map[int16]any)
+			data := page.buf[page.pos:]
+			if hdr[1] != int64(parquetDataPage) || hdr[3] != int64(len(data)) || dph[1] != int64(rows) || dph[2] != int64(parquetPlain) {
+				t.Fatalf("chunk %s page header %v", c.name, hdr)
+			}
+
+			data = decodeColumn(t, c.name, data, group)
+			if len(data) != 0 {
+				t.Fatalf("chunk %s has %d bytes left over", c.name, len(data))
+			}
+		}
+
+		if rg[2] != total {
+			t.Fatalf("row group total_byte_size %v, chunks add up to %d", rg[2], total)
+		}
+	}
+
+	if int64(len(records)) != meta[3].(int64) {
+		t.Fatalf("footer says %v rows, row groups have %d", meta[3], len(records))
+	}
+
+	return records
+}
+
+// decodeColumn reads PLAIN values of a column into records
+func decodeColumn(t *testing.T, name string, data []byte, records []Record) []byte {
+	str := func() string {
+		n := int(binary.LittleEndian.Uint32(data))
+		s := string(data[4 : 4+n])
+		data = data[4+n:]
+		return s
+	}
+	i32 := func() int {
+		v := int32(binary.LittleEndian.Uint32(data))
+		data = data[4:]
+		return int(v)
+	}
+	i64 := func() int64 {
+		v := int64(binary.LittleEndian.Uint64(data))
+		data = data[8:]
+		return v
+	}
+
+	for i := range records {
+		r := &records[i]
+		switch name {
+		case "id":
+			r.ID = str()
+		case "path":
+			r.Path = str()
+		case "source_url":
+			r.SourceURL = str()
+		case "width":
+			r.Width = i32()
+		case "height":
+			r.Height = i32()
+		case "size":
+			r.Size = i64()
+		case "sha256":
+			r.SHA256 = str()
+		case "content_type":
+			r.ContentType = str()
+		case "license":
+			r.License = str()
+		case "caption":
+			r.Caption = str()
+		case "group_id":
+			r.GroupID = str()
+		case "source":
+			r.Source = str()
+		case "retrieved":
+			r.Retrieved = time.UnixMilli(i64()).UTC()
+		default:
+			t.Fatalf("unexpected column %s", name)
+		}
+	}
+
+	return data
+}
+
+// thriftReader decodes the thrift compact protocol into maps of field ID to value:
+// int64 for integers, string for binary, []any for lists, map[int16]any for structs
+type thriftReader struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (r *thriftReader) byte() byte {
+	if r.pos >= len(r.buf) {
+		r.err = fmt.Errorf("unexpected end at %d", r.pos)
+		return 0
+	}
+
+	b := r.buf[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.buf[r.pos:])
+	if n <= 0 {
+		r.err = fmt.Errorf("bad varint at %d", r.pos)
+		return 0
+	}
+
+	r.pos += n
+	return v
+}
+
+func (r *thriftReader) zigzag() int64 {
+	v := r.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *thriftReader) readStruct() map[int16]any {
+	fields := map[int16]any{}
+	var id int16
+	for r.err == nil {
+		b := r.byte()
+		if b == 0 {
+			return fields
+		}
+
+		if delta := int16(b >> 4); delta != 0 {
+			id += delta
+		} else {
+			id = int16(r.zigzag())
+		}
+
+		if _, ok := fields[id]; ok {
+			r.err = fmt.Errorf("field %d repeated", id)
+		}
+
+		fields[id] = r.value(b & 0x0f)
+	}
+
+	return fields
+}
+
+func (r *thriftReader) value(typ byte) any {
+	switch typ {
+	case thriftI32, thriftI64:
+		return r.zigzag()
+	case thriftBinary:
+		n := int(r.uvarint())
+		if r.pos+n > len(r.buf) {
+			r.err = fmt.Errorf("binary of %d bytes at %d overflows", n, r.pos)
+			return ""
+		}
+
+		s := string(r.buf[r.pos : r.pos+n])
+		r.pos += n
+		return s
+	case thriftList:
+		hdr := r.byte()
+		size := int(hdr >> 4)
+		if size == 15 {
+			size = int(r.uvarint())
+		}
+
+		list := make([]any, 0, size)
+		for i := 0; i < size && r.err == nil; i++ {
+			list = append(list, r.value(hdr&0x0f))
+		}
+
+		return list
+	case thriftStruct:
+		return r.readStruct()
+	default:
+		r.err = fmt.Errorf("unsupported thrift type %d at %d", typ, r.pos)
+		return nil
+	}
+}
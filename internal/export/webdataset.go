@@ -0,0 +1,306 @@
+package export
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/AnthonyHewins/imgscrape/internal/corpus"
+	"golang.org/x/exp/slog"
+)
+
+// widsKind is the kind the webdataset "wids" loader expects in a shard index
+const widsKind = "wids-shard-index-v1"
+
+// ShardInfo describes a single tar shard in the index
+type ShardInfo struct {
+	URL      string `json:"url"`
+	NSamples int    `json:"nsamples"`
+	Size     int64  `json:"filesize"`
+	SHA256   string `json:"sha256"`
+	FirstKey string `json:"first_key"`
+	LastKey  string `json:"last_key"`
+}
+
+// ShardIndex is written alongside the shards. It follows the wids shard index
+// format so it can be handed directly to webdataset.ShardListDataset
+type ShardIndex struct {
+	Kind      string      `json:"__kind__"`
+	Version   int         `json:"wids_version"`
+	Name      string      `json:"name"`
+	Seed      *int64      `json:"seed,omitempty"`
+	ShardList []ShardInfo `json:"shardlist"`
+}
+
+// WebDatasetWriter packs corpus items into WebDataset tar shards. Each sample is
+// stored as <key>.<ext> for the image, <key>.json for the metadata sidecar and
+// <key>.txt for the caption when there is one
+type WebDatasetWriter struct {
+	logger *slog.Logger
+
+	outDir, prefix string
+	maxCount       int
+	maxSize        int64
+}
+
+// NewWebDatasetWriter creates a writer that places shards named <prefix>-000000.tar, <prefix>-000001.tar...
+// in outDir. A shard is closed once it holds maxCount samples or adding another sample would push it
+// past maxSize bytes; pass 0 for either to leave it unbounded
+func NewWebDatasetWriter(logger *slog.Logger, outDir, prefix string, maxCount int, maxSize int64) *WebDatasetWriter {
+	if prefix == "" {
+		prefix = "shard"
+	}
+
+	return &WebDatasetWriter{
+		logger:   logger,
+		outDir:   outDir,
+		prefix:   prefix,
+		maxCount: maxCount,
+		maxSize:  maxSize,
+	}
+}
+
+// Shuffle deterministically shuffles items in place using seed
+func Shuffle(items []corpus.Item, seed int64) {
+	r := rand.New(rand.NewSource(seed))
+	r.Shuffle(len(items), func(i, j int) { items[i], items[j] = items[j], items[i] })
+}
+
+// SampleKey turns an item ID into a WebDataset key. Loaders split the file
+// name on the first '.', so dots can't appear in the key
+func SampleKey(id string) string {
+	return strings.NewReplacer(".", "_", "/", "_", "\\", "_").Replace(id)
+}
+
+// Write packs items into shards in the order given and writes the shard index to
+// <prefix>-index.json. The seed is only recorded in the index; pass nil if items weren't shuffled
+func (w *WebDatasetWriter) Write(ctx context.Context, items []corpus.Item, seed *int64) (*ShardIndex, error) {
+	if err := os.MkdirAll(w.outDir, 0755); err != nil {
+		return nil, err
+	}
+
+	idx := &ShardIndex{
+		Kind:      widsKind,
+		Version:   1,
+		Name:      w.prefix,
+		Seed:      seed,
+		ShardList: []ShardInfo{},
+	}
+
+	var s *shard
+	for i := range items {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		smp, err := newSample(&items[i])
+		if err != nil {
+			w.logger.ErrorContext(ctx, "failed reading sample", "dir", items[i].Dir, "err", err)
+			return nil, err
+		}
+
+		if s != nil && w.full(s, smp) {
+			info, err := s.close()
+			if err != nil {
+				return nil, err
+			}
+
+			idx.ShardList = append(idx.ShardList, *info)
+			s = nil
+		}
+
+		if s == nil {
+			name := fmt.Sprintf("%s-%06d.tar", w.prefix, len(idx.ShardList))
+			if s, err = newShard(filepath.Join(w.outDir, name)); err != nil {
+				return nil, err
+			}
+
+			w.logger.DebugContext(ctx, "opened shard", "shard", name)
+		}
+
+		if err = s.add(smp); err != nil {
+			s.abort()
+			return nil, err
+		}
+	}
+
+	if s != nil {
+		info, err := s.close()
+		if err != nil {
+			return nil, err
+		}
+
+		idx.ShardList = append(idx.ShardList, *info)
+	}
+
+	buf, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.WriteFile(filepath.Join(w.outDir, w.prefix+"-index.json"), buf, 0644); err != nil {
+		return nil, err
+	}
+
+	w.logger.InfoContext(ctx, "wrote webdataset", "shards", len(idx.ShardList), "samples", len(items))
+	return idx, nil
+}
+
+func (w *WebDatasetWriter) full(s *shard, next *sample) bool {
+	if w.maxCount > 0 && s.count >= w.maxCount {
+		return true
+	}
+
+	return w.maxSize > 0 && s.count > 0 && s.size+next.tarSize() > w.maxSize
+}
+
+type sampleFile struct {
+	name string
+	body []byte
+}
+
+type sample struct {
+	key   string
+	files []sampleFile
+}
+
+func newSample(item *corpus.Item) (*sample, error) {
+	img, err := os.ReadFile(item.ImagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := json.Marshal(item.Meta)
+	if err != nil {
+		return nil, err
+	}
+
+	key := SampleKey(item.Meta.ID)
+	s := &sample{
+		key: key,
+		files: []sampleFile{
+			{name: key + "." + item.Ext(), body: img},
+			{name: key + ".json", body: meta},
+		},
+	}
+
+	if c := item.Meta.Caption; c != "" {
+		s.files = append(s.files, sampleFile{name: key + ".txt", body: []byte(c)})
+	}
+
+	return s, nil
+}
+
+// tarSize is how many bytes the sample occupies in a tar stream: a 512 byte
+// header per file plus the body padded to the block size
+func (s *sample) tarSize() int64 {
+	var n int64
+	for _, f := range s.files {
+		n += 512 + (int64(len(f.body))+511)/512*512
+	}
+
+	return n
+}
+
+type shard struct {
+	path     string
+	file     *os.File
+	hash     hash.Hash
+	tw       *tar.Writer
+	count    int
+	size     int64
+	firstKey string
+	lastKey  string
+}
+
+func newShard(path string) (*shard, error) {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	return &shard{
+		path: path,
+		file: f,
+		hash: h,
+		tw:   tar.NewWriter(io.MultiWriter(f, h)),
+	}, nil
+}
+
+func (s *shard) add(smp *sample) error {
+	for _, f := range smp.files {
+		// fixed header fields so the same corpus always produces byte-identical shards
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     f.name,
+			Size:     int64(len(f.body)),
+			Mode:     0644,
+			ModTime:  time.Unix(0, 0),
+			Format:   tar.FormatUSTAR,
+		}
+
+		if err := s.tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if _, err := s.tw.Write(f.body); err != nil {
+			return err
+		}
+	}
+
+	if s.count == 0 {
+		s.firstKey = smp.key
+	}
+
+	s.lastKey = smp.key
+	s.count++
+	s.size += smp.tarSize()
+	return nil
+}
+
+func (s *shard) close() (*ShardInfo, error) {
+	if err := s.tw.Close(); err != nil {
+		s.abort()
+		return nil, err
+	}
+
+	info, err := s.file.Stat()
+	if err != nil {
+		s.abort()
+		return nil, err
+	}
+
+	if err = s.file.Close(); err != nil {
+		os.Remove(s.file.Name())
+		return nil, err
+	}
+
+	if err = os.Rename(s.file.Name(), s.path); err != nil {
+		return nil, err
+	}
+
+	return &ShardInfo{
+		URL:      filepath.Base(s.path),
+		NSamples: s.count,
+		Size:     info.Size(),
+		SHA256:   hex.EncodeToString(s.hash.Sum(nil)),
+		FirstKey: s.firstKey,
+		LastKey:  s.lastKey,
+	}, nil
+}
+
+func (s *shard) abort() {
+	s.file.Close()
+	os.Remove(s.file.Name())
+}
@@ -0,0 +1,253 @@
+// Package health runs periodic checks of a process's dependencies and reports them
+// through gRPC health statuses and liveness/readiness HTTP endpoints
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+	grpchealth "google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Check is one component to check
+type Check struct {
+	// Name is the component, also used as its gRPC health service name
+	Name string
+
+	// Fn returns nil if the component is healthy
+	Fn func(context.Context) error
+
+	// Live marks components a restart could fix. If one fails, so does liveness.
+	// Every check counts towards readiness
+	Live bool
+}
+
+// Result is the outcome of a component's last check
+type Result struct {
+	Healthy   bool      `json:"healthy"`
+	Err       string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Checker runs checks every interval
+type Checker struct {
+	logger   *slog.Logger
+	checks   []Check
+	interval time.Duration
+	timeout  time.Duration
+
+	grpc    *grpchealth.Server
+	overall string
+
+	mu       sync.RWMutex
+	results  map[string]Result
+	draining bool
+}
+
+// New creates a checker. Each check gets timeout to finish
+func New(logger *slog.Logger, interval, timeout time.Duration, checks ...Check) *Checker {
+	return &Checker{
+		logger:   logger,
+		checks:   checks,
+		interval: interval,
+		timeout:  timeout,
+		results:  make(map[string]Result, len(checks)),
+	}
+}
+
+// WithGRPCServer mirrors results onto h: each component under its own name, and all
+// of them together under overall and "". Everything is NOT_SERVING until the first checks finish
+func (c *Checker) WithGRPCServer(h *grpchealth.Server, overall string) *Checker {
+	c.grpc, c.overall = h, overall
+
+	h.SetServingStatus("", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	h.SetServingStatus(overall, grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	for _, check := range c.checks {
+		h.SetServingStatus(check.Name, grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	}
+
+	return c
+}
+
+// Run checks everything now and then every interval until ctx is done
+func (c *Checker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		c.checkAll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Checker) checkAll(ctx context.Context) {
+	results := make([]Result, len(c.checks))
+
+	var wg sync.WaitGroup
+	for i := range c.checks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+
+			results[i] = Result{Healthy: true, CheckedAt: time.Now().UTC()}
+			if err := c.checks[i].Fn(checkCtx); err != nil {
+				results[i].Healthy, results[i].Err = false, err.Error()
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, check := range c.checks {
+		prev, seen := c.results[check.Name]
+		r := results[i]
+		c.results[check.Name] = r
+
+		if seen && prev.Healthy == r.Healthy {
+			continue
+		}
+
+		if r.Healthy {
+			c.logger.InfoContext(ctx, "component healthy", "component", check.Name)
+		} else {
+			c.logger.ErrorContext(ctx, "component unhealthy", "component", check.Name, "err", r.Err)
+		}
+
+		if c.grpc != nil && !c.draining {
+			c.grpc.SetServingStatus(check.Name, servingStatus(r.Healthy))
+		}
+	}
+
+	if c.grpc != nil && !c.draining {
+		ready := c.ready()
+		c.grpc.SetServingStatus("", servingStatus(ready))
+		c.grpc.SetServingStatus(c.overall, servingStatus(ready))
+	}
+}
+
+// Drain marks the process not ready for good, so traffic moves elsewhere while it
+// shuts down. Liveness is unaffected
+func (c *Checker) Drain() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.draining = true
+	if c.grpc != nil {
+		c.grpc.Shutdown()
+	}
+}
+
+// ready must be called with mu held
+func (c *Checker) ready() bool {
+	if c.draining || len(c.results) < len(c.checks) {
+		return false
+	}
+
+	for _, r := range c.results {
+		if !r.Healthy {
+			return false
+		}
+	}
+
+	return true
+}
+
+// live must be called with mu held. Components that haven't been checked yet count as live
+func (c *Checker) live() bool {
+	for _, check := range c.checks {
+		if r, ok := c.results[check.Name]; check.Live && ok && !r.Healthy {
+			return false
+		}
+	}
+
+	return true
+}
+
+// LivenessHandler responds 200 unless a Live component is failing
+func (c *Checker) LivenessHandler() http.Handler {
+	return c.handler(c.live)
+}
+
+// ReadinessHandler responds 200 once every component has passed its latest check,
+// until Drain is called
+func (c *Checker) ReadinessHandler() http.Handler {
+	return c.handler(c.ready)
+}
+
+func (c *Checker) handler(ok func() bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mu.RLock()
+		body := struct {
+			Status     string            `json:"status"`
+			Components map[string]Result `json:"components"`
+		}{Status: "ok", Components: make(map[string]Result, len(c.results))}
+
+		for k, v := range c.results {
+			body.Components[k] = v
+		}
+
+		code := http.StatusOK
+		if !ok() {
+			body.Status, code = "unavailable", http.StatusServiceUnavailable
+		}
+		c.mu.RUnlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(body)
+	})
+}
+
+// DirWritable checks files can be created in dir
+func DirWritable(dir string) func(context.Context) error {
+	return func(context.Context) error {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+
+		f, err := os.CreateTemp(dir, ".healthcheck-*")
+		if err != nil {
+			return err
+		}
+
+		_, err = f.Write([]byte("ok"))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+
+		if rmErr := os.Remove(f.Name()); err == nil {
+			err = rmErr
+		}
+
+		return err
+	}
+}
+
+func servingStatus(healthy bool) grpc_health_v1.HealthCheckResponse_ServingStatus {
+	if healthy {
+		return grpc_health_v1.HealthCheckResponse_SERVING
+	}
+
+	return grpc_health_v1.HealthCheckResponse_NOT_SERVING
+}
@@ -0,0 +1,395 @@
+package httpcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Header is set on every response the transport returns, with one of the Status values
+const Header = "X-Imgscrape-Cache"
+
+// Status values for Header
+const (
+	StatusMiss        = "miss"        // fetched in full from the origin
+	StatusHit         = "hit"         // served from cache without contacting the origin
+	StatusRevalidated = "revalidated" // origin answered 304; served from cache
+	StatusUnchanged   = "unchanged"   // like revalidated, but in ModeChangedOnly
+)
+
+// ErrNotModified is for callers in ModeChangedOnly that want to stop processing
+// responses Unchanged reports as unchanged
+var ErrNotModified = errors.New("resource not modified since it was cached")
+
+// Mode controls when cached responses are revalidated
+type Mode byte
+
+const (
+	// ModeDefault serves fresh responses from cache and revalidates stale ones
+	ModeDefault Mode = iota
+
+	// ModeRevalidate revalidates every cached response with the origin regardless of freshness
+	ModeRevalidate
+
+	// ModeChangedOnly revalidates everything, and marks responses the origin
+	// says haven't changed with StatusUnchanged so callers can skip them
+	ModeChangedOnly
+)
+
+// ParseMode parses default | revalidate | changed-only
+func ParseMode(s string) (Mode, error) {
+	switch strings.ToLower(s) {
+	case "", "default":
+		return ModeDefault, nil
+	case "revalidate":
+		return ModeRevalidate, nil
+	case "changed-only":
+		return ModeChangedOnly, nil
+	default:
+		return 0, fmt.Errorf("invalid cache mode %q; use default, revalidate or changed-only", s)
+	}
+}
+
+// Unchanged reports whether resp is a cached response the origin confirmed hasn't
+// changed while in ModeChangedOnly
+func Unchanged(resp *http.Response) bool {
+	return resp != nil && resp.Header.Get(Header) == StatusUnchanged
+}
+
+// Transport is an http.RoundTripper caching GET responses on disk. It honors
+// Cache-Control and Expires for freshness and revalidates stale entries using
+// If-None-Match/If-Modified-Since with the stored ETag/Last-Modified. One response
+// is kept per URL; if it has a Vary header it's only used for requests with the same
+// values of the headers it names, and responses with Vary: * aren't stored
+type Transport struct {
+	dir  string
+	mode Mode
+	base http.RoundTripper
+	now  func() time.Time
+}
+
+// New creates a transport caching to dir. Pass nil for base to use http.DefaultTransport
+func New(dir string, mode Mode, base http.RoundTripper) (*Transport, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &Transport{dir: dir, mode: mode, base: base, now: time.Now}, nil
+}
+
+// entry is the metadata stored next to each cached body
+type entry struct {
+	URL        string      `json:"url"`
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Stored     time.Time   `json:"stored"`
+
+	// Varied are the request headers named by the response's Vary header, as they
+	// were in the request it answered
+	Varied http.Header `json:"varied,omitempty"`
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" || noStore(req.Header) {
+		return t.base.RoundTrip(req)
+	}
+
+	path := t.path(req.URL.String())
+	cached, err := t.load(path)
+	if err != nil || cached != nil && !cached.matches(req.Header) {
+		// a corrupt entry, or one for another variant, is just a miss
+		cached = nil
+	}
+
+	if cached != nil && t.mode == ModeDefault && t.fresh(cached, req.Header) {
+		return t.response(req, path, cached, StatusHit)
+	}
+
+	outReq := req
+	if cached != nil {
+		outReq = req.Clone(req.Context())
+		if etag := cached.Header.Get("ETag"); etag != "" {
+			outReq.Header.Set("If-None-Match", etag)
+		}
+
+		if lm := cached.Header.Get("Last-Modified"); lm != "" {
+			outReq.Header.Set("If-Modified-Since", lm)
+		}
+	}
+
+	resp, err := t.base.RoundTrip(outReq)
+	if err != nil {
+		return nil, err
+	}
+
+	if cached != nil && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+
+		// the 304 carries updated freshness headers
+		for _, h := range []string{"Cache-Control", "Expires", "ETag", "Last-Modified", "Date"} {
+			if v := resp.Header.Get(h); v != "" {
+				cached.Header.Set(h, v)
+			}
+		}
+
+		cached.Stored = t.now().UTC()
+		if err = t.saveMeta(path, cached); err != nil {
+			return nil, err
+		}
+
+		status := StatusRevalidated
+		if t.mode == ModeChangedOnly {
+			status = StatusUnchanged
+		}
+
+		return t.response(req, path, cached, status)
+	}
+
+	resp.Header.Set(Header, StatusMiss)
+	varied, ok := vary(resp.Header, req.Header)
+	if resp.StatusCode != http.StatusOK || noStore(resp.Header) || !ok {
+		return resp, nil
+	}
+
+	resp.Body = t.tee(path, &entry{
+		URL:        req.URL.String(),
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header.Clone(),
+		Stored:     t.now().UTC(),
+		Varied:     varied,
+	}, resp.Body)
+
+	return resp, nil
+}
+
+func (t *Transport) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(t.dir, name[:2], name)
+}
+
+func (t *Transport) load(path string) (*entry, error) {
+	buf, err := os.ReadFile(path + ".json")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var e entry
+	if err = json.Unmarshal(buf, &e); err != nil {
+		return nil, err
+	}
+
+	if _, err = os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+func (t *Transport) saveMeta(path string, e *entry) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".json.tmp"
+	if err = os.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path+".json")
+}
+
+func (t *Transport) response(req *http.Request, path string, e *entry, status string) (*http.Response, error) {
+	body, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := body.Stat()
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+
+	h := e.Header.Clone()
+	h.Set(Header, status)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode)),
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          body,
+		ContentLength: info.Size(),
+		Request:       req,
+	}, nil
+}
+
+// fresh reports whether the entry can be served without revalidation
+func (t *Transport) fresh(e *entry, reqHeader http.Header) bool {
+	cc := cacheControl(e.Header)
+	if _, ok := cc["no-cache"]; ok {
+		return false
+	}
+
+	if _, ok := cacheControl(reqHeader)["no-cache"]; ok {
+		return false
+	}
+
+	age := t.now().Sub(e.Stored)
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[directive]; ok {
+			seconds, err := strconv.Atoi(v)
+			return err == nil && age < time.Duration(seconds)*time.Second
+		}
+	}
+
+	if exp := e.Header.Get("Expires"); exp != "" {
+		expires, err := http.ParseTime(exp)
+		return err == nil && t.now().Before(expires)
+	}
+
+	return false
+}
+
+// vary returns the request headers a response varies on with their values in the
+// request, and false for Vary: *, which can't be matched
+func vary(respHeader, reqHeader http.Header) (http.Header, bool) {
+	var varied http.Header
+	for _, v := range respHeader.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			switch name {
+			case "":
+				continue
+			case "*":
+				return nil, false
+			}
+
+			if varied == nil {
+				varied = http.Header{}
+			}
+
+			varied[name] = reqHeader.Values(name)
+		}
+	}
+
+	return varied, true
+}
+
+// matches reports whether the entry was stored for a request with the same values of
+// the headers it varies on as reqHeader
+func (e *entry) matches(reqHeader http.Header) bool {
+	if e.Varied == nil && e.Header.Get("Vary") != "" {
+		return false // stored before varied headers were recorded
+	}
+
+	for name, values := range e.Varied {
+		if strings.Join(values, ",") != strings.Join(reqHeader.Values(name), ",") {
+			return false
+		}
+	}
+
+	return true
+}
+
+func cacheControl(h http.Header) map[string]string {
+	cc := map[string]string{}
+	for _, part := range strings.Split(h.Get("Cache-Control"), ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if k != "" {
+			cc[strings.ToLower(k)] = strings.Trim(v, `"`)
+		}
+	}
+
+	return cc
+}
+
+func noStore(h http.Header) bool {
+	_, ok := cacheControl(h)["no-store"]
+	return ok
+}
+
+// tee stores the body as it's read. The entry is only committed once the whole
+// body has been read, so an aborted download never leaves a truncated entry
+func (t *Transport) tee(path string, e *entry, body io.ReadCloser) io.ReadCloser {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return body
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return body
+	}
+
+	return &teeBody{t: t, path: path, entry: e, body: body, tmp: tmp}
+}
+
+type teeBody struct {
+	t     *Transport
+	path  string
+	entry *entry
+	body  io.ReadCloser
+	tmp   *os.File
+	err   error
+	done  bool
+}
+
+func (b *teeBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if n > 0 && b.err == nil {
+		_, b.err = b.tmp.Write(p[:n])
+	}
+
+	if err == io.EOF && !b.done {
+		b.done = true
+		b.commit()
+	}
+
+	return n, err
+}
+
+func (b *teeBody) commit() {
+	if err := b.tmp.Close(); err != nil || b.err != nil {
+		os.Remove(b.tmp.Name())
+		return
+	}
+
+	if err := os.Rename(b.tmp.Name(), b.path); err != nil {
+		os.Remove(b.tmp.Name())
+		return
+	}
+
+	if err := b.t.saveMeta(b.path, b.entry); err != nil {
+		os.Remove(b.path)
+	}
+}
+
+func (b *teeBody) Close() error {
+	if !b.done {
+		b.done = true
+		b.tmp.Close()
+		os.Remove(b.tmp.Name())
+	}
+
+	return b.body.Close()
+}
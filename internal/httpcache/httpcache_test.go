@@ -0,0 +1,321 @@
+package httpcache
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// origin answers conditional requests the way a server would, from its current state
+type origin struct {
+	header http.Header // sent with every response
+	body   string
+	calls  int
+	last   *http.Request
+}
+
+func (o *origin) RoundTrip(req *http.Request) (*http.Response, error) {
+	o.calls++
+	o.last = req
+
+	etag, lm := o.header.Get("ETag"), o.header.Get("Last-Modified")
+	status, body := http.StatusOK, o.body
+	if inm := req.Header.Get("If-None-Match"); inm != "" && inm == etag ||
+		etag == "" && lm != "" && req.Header.Get("If-Modified-Since") == lm {
+		status, body = http.StatusNotModified, ""
+	}
+
+	return &http.Response{
+		StatusCode: status,
+		Header:     o.header.Clone(),
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+// step is one request made through the cache
+type step struct {
+	advance   time.Duration     // clock moves this much first
+	change    map[string]string // origin headers to change first; "body" changes the body
+	reqHeader http.Header
+
+	wantStatus string
+	wantCalls  int    // origin requests made so far
+	wantINM    string // If-None-Match the origin saw last
+	wantIMS    string // If-Modified-Since the origin saw last
+	wantBody   string
+}
+
+func TestTransport(t *testing.T) {
+	lastModified := "Mon, 02 Jan 2006 15:04:05 GMT"
+
+	tests := []struct {
+		name   string
+		mode   Mode
+		header http.Header
+		steps  []step
+	}{
+		{
+			name:   "fresh by max-age, then revalidated by ETag",
+			header: http.Header{"Cache-Control": {"max-age=60"}, "Etag": {`"v1"`}},
+			steps: []step{
+				{wantStatus: StatusMiss, wantCalls: 1, wantBody: "v1"},
+				{advance: 30 * time.Second, wantStatus: StatusHit, wantCalls: 1, wantBody: "v1"},
+				{advance: 31 * time.Second, wantStatus: StatusRevalidated, wantCalls: 2, wantINM: `"v1"`, wantBody: "v1"},
+				// revalidating restarted the clock
+				{advance: 30 * time.Second, wantStatus: StatusHit, wantCalls: 2, wantBody: "v1"},
+			},
+		},
+		{
+			name:   "changed ETag replaces the entry",
+			header: http.Header{"Etag": {`"v1"`}},
+			steps: []step{
+				{wantStatus: StatusMiss, wantCalls: 1, wantBody: "v1"},
+				{change: map[string]string{"ETag": `"v2"`, "body": "v2"}, wantStatus: StatusMiss, wantCalls: 2, wantINM: `"v1"`, wantBody: "v2"},
+				{wantStatus: StatusRevalidated, wantCalls: 3, wantINM: `"v2"`, wantBody: "v2"},
+			},
+		},
+		{
+			name:   "revalidated by Last-Modified",
+			header: http.Header{"Last-Modified": {lastModified}},
+			steps: []step{
+				{wantStatus: StatusMiss, wantCalls: 1, wantBody: "v1"},
+				{wantStatus: StatusRevalidated, wantCalls: 2, wantIMS: lastModified, wantBody: "v1"},
+			},
+		},
+		{
+			name:   "fresh by Expires",
+			header: http.Header{"Expires": {"Mon, 02 Jan 2006 15:05:05 GMT"}, "Etag": {`"v1"`}},
+			steps: []step{
+				{wantStatus: StatusMiss, wantCalls: 1, wantBody: "v1"},
+				{wantStatus: StatusHit, wantCalls: 1, wantBody: "v1"},
+				{advance: time.Minute, wantStatus: StatusRevalidated, wantCalls: 2, wantINM: `"v1"`, wantBody: "v1"},
+			},
+		},
+		{
+			name:   "no-cache response is always revalidated",
+			header: http.Header{"Cache-Control": {"max-age=60, no-cache"}, "Etag": {`"v1"`}},
+			steps: []step{
+				{wantStatus: StatusMiss, wantCalls: 1, wantBody: "v1"},
+				{wantStatus: StatusRevalidated, wantCalls: 2, wantINM: `"v1"`, wantBody: "v1"},
+			},
+		},
+		{
+			name:   "no-cache request revalidates",
+			header: http.Header{"Cache-Control": {"max-age=60"}, "Etag": {`"v1"`}},
+			steps: []step{
+				{wantStatus: StatusMiss, wantCalls: 1, wantBody: "v1"},
+				{reqHeader: http.Header{"Cache-Control": {"no-cache"}}, wantStatus: StatusRevalidated, wantCalls: 2, wantINM: `"v1"`, wantBody: "v1"},
+			},
+		},
+		{
+			name:   "no-store isn't cached",
+			header: http.Header{"Cache-Control": {"no-store"}, "Etag": {`"v1"`}},
+			steps: []step{
+				{wantStatus: StatusMiss, wantCalls: 1, wantBody: "v1"},
+				{wantStatus: StatusMiss, wantCalls: 2, wantBody: "v1"},
+			},
+		},
+		{
+			name:   "revalidate mode ignores freshness",
+			mode:   ModeRevalidate,
+			header: http.Header{"Cache-Control": {"max-age=60"}, "Etag": {`"v1"`}},
+			steps: []step{
+				{wantStatus: StatusMiss, wantCalls: 1, wantBody: "v1"},
+				{wantStatus: StatusRevalidated, wantCalls: 2, wantINM: `"v1"`, wantBody: "v1"},
+			},
+		},
+		{
+			name:   "changed-only mode marks unchanged responses",
+			mode:   ModeChangedOnly,
+			header: http.Header{"Cache-Control": {"max-age=60"}, "Etag": {`"v1"`}},
+			steps: []step{
+				{wantStatus: StatusMiss, wantCalls: 1, wantBody: "v1"},
+				{wantStatus: StatusUnchanged, wantCalls: 2, wantINM: `"v1"`, wantBody: "v1"},
+				{change: map[string]string{"ETag": `"v2"`, "body": "v2"}, wantStatus: StatusMiss, wantCalls: 3, wantINM: `"v1"`, wantBody: "v2"},
+			},
+		},
+		{
+			name:   "Vary keys entries by the request headers it names",
+			header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept"}},
+			steps: []step{
+				{reqHeader: http.Header{"Accept": {"image/webp"}}, wantStatus: StatusMiss, wantCalls: 1, wantBody: "v1"},
+				{reqHeader: http.Header{"Accept": {"image/webp"}}, wantStatus: StatusHit, wantCalls: 1, wantBody: "v1"},
+				{reqHeader: http.Header{"Accept": {"image/png"}}, wantStatus: StatusMiss, wantCalls: 2, wantBody: "v1"},
+				{reqHeader: http.Header{"Accept": {"image/png"}}, wantStatus: StatusHit, wantCalls: 2, wantBody: "v1"},
+				// one entry per URL, so the first variant was replaced
+				{reqHeader: http.Header{"Accept": {"image/webp"}}, wantStatus: StatusMiss, wantCalls: 3, wantBody: "v1"},
+				{wantStatus: StatusMiss, wantCalls: 4, wantBody: "v1"},
+			},
+		},
+		{
+			name:   "Vary: * isn't cached",
+			header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept, *"}},
+			steps: []step{
+				{wantStatus: StatusMiss, wantCalls: 1, wantBody: "v1"},
+				{wantStatus: StatusMiss, wantCalls: 2, wantBody: "v1"},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			o := &origin{header: tc.header, body: "v1"}
+			tr, err := New(t.TempDir(), tc.mode, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			now := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+			tr.now = func() time.Time { return now }
+
+			for i, s := range tc.steps {
+				now = now.Add(s.advance)
+				for k, v := range s.change {
+					if k == "body" {
+						o.body = v
+					} else {
+						o.header.Set(k, v)
+					}
+				}
+
+				req, _ := http.NewRequest(http.MethodGet, "https://example.com/a.jpg", nil)
+				for k, v := range s.reqHeader {
+					req.Header[k] = v
+				}
+
+				resp, err := tr.RoundTrip(req)
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+
+				body, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+
+				if got := resp.Header.Get(Header); got != s.wantStatus {
+					t.Fatalf("step %d: status %q, want %q", i, got, s.wantStatus)
+				}
+
+				if Unchanged(resp) != (s.wantStatus == StatusUnchanged) {
+					t.Fatalf("step %d: Unchanged is %v", i, Unchanged(resp))
+				}
+
+				if o.calls != s.wantCalls {
+					t.Fatalf("step %d: origin called %d times, want %d", i, o.calls, s.wantCalls)
+				}
+
+				if string(body) != s.wantBody {
+					t.Fatalf("step %d: body %q, want %q", i, body, s.wantBody)
+				}
+
+				if s.wantStatus == StatusHit {
+					continue // the origin's last request is an earlier step's
+				}
+
+				if got := o.last.Header.Get("If-None-Match"); got != s.wantINM {
+					t.Fatalf("step %d: If-None-Match %q, want %q", i, got, s.wantINM)
+				}
+
+				if got := o.last.Header.Get("If-Modified-Since"); got != s.wantIMS {
+					t.Fatalf("step %d: If-Modified-Since %q, want %q", i, got, s.wantIMS)
+				}
+			}
+		})
+	}
+}
+
+func TestTransportAbortedBodyIsntStored(t *testing.T) {
+	o := &origin{header: http.Header{"Cache-Control": {"max-age=60"}}, body: "a long enough body"}
+	tr, err := New(t.TempDir(), ModeDefault, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com/a.jpg", nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Read(make([]byte, 4))
+	resp.Body.Close()
+
+	if resp, err = tr.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if got := resp.Header.Get(Header); got != StatusMiss {
+		t.Fatalf("status %q after an aborted read, want %q", got, StatusMiss)
+	}
+}
+
+func TestTransportPassesThrough(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		header http.Header
+	}{
+		{name: "not GET", method: http.MethodPost},
+		{name: "range request", method: http.MethodGet, header: http.Header{"Range": {"bytes=0-10"}}},
+		{name: "no-store request", method: http.MethodGet, header: http.Header{"Cache-Control": {"no-store"}}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			o := &origin{header: http.Header{"Cache-Control": {"max-age=60"}}, body: "v1"}
+			tr, err := New(t.TempDir(), ModeDefault, o)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 2; i++ {
+				req, _ := http.NewRequest(tc.method, "https://example.com/a.jpg", nil)
+				for k, v := range tc.header {
+					req.Header[k] = v
+				}
+
+				resp, err := tr.RoundTrip(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.ReadAll(resp.Body)
+				resp.Body.Close()
+
+				if got := resp.Header.Get(Header); got != "" {
+					t.Fatalf("request %d went through the cache: %q", i, got)
+				}
+			}
+
+			if o.calls != 2 {
+				t.Fatalf("origin called %d times, want 2", o.calls)
+			}
+		})
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Mode
+		wantErr bool
+	}{
+		{in: "", want: ModeDefault},
+		{in: "default", want: ModeDefault},
+		{in: "Revalidate", want: ModeRevalidate},
+		{in: "changed-only", want: ModeChangedOnly},
+		{in: "changed_only", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		got, err := ParseMode(tc.in)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("ParseMode(%q) = %v, %v; want %v, error %v", tc.in, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
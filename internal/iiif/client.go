@@ -3,6 +3,7 @@ package iiif
 import (
 	"net/http"
 
+	"github.com/AnthonyHewins/imgscrape/internal/download"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/exp/slog"
@@ -13,6 +14,7 @@ type Client struct {
 	tracer     trace.Tracer
 	httpClient *http.Client
 	baseURL    string
+	limits     download.Limits
 }
 
 func NewClient(traceName string, logger *slog.Logger, httpClient *http.Client, baseURL string) *Client {
@@ -21,5 +23,13 @@ func NewClient(traceName string, logger *slog.Logger, httpClient *http.Client, b
 		tracer:     otel.Tracer(traceName),
 		httpClient: httpClient,
 		baseURL:    baseURL,
+		limits:     download.Default,
 	}
 }
+
+// WithLimits sets the size and content type limits enforced on every image.
+// Defaults to download.Default
+func (c *Client) WithLimits(limits download.Limits) *Client {
+	c.limits = limits
+	return c
+}
@@ -6,7 +6,11 @@ import (
 	"io"
 	"math"
 	"net/http"
+	"strings"
 
+	"github.com/AnthonyHewins/imgscrape/internal/download"
+	"github.com/AnthonyHewins/imgscrape/internal/httpcache"
+	"github.com/AnthonyHewins/imgscrape/internal/metrics"
 	otelCodes "go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/exp/slog"
@@ -39,10 +43,11 @@ type ImageReq struct {
 	logger     *slog.Logger
 	tracer     trace.Tracer
 	httpClient *http.Client
+	limits     download.Limits
 
-	baseURL, id              string
-	region, size             string
-	rotation string
+	baseURL, id  string
+	region, size string
+	rotation     string
 	quality
 	format
 }
@@ -52,11 +57,18 @@ func (c *Client) NewImageReq(id string) *ImageReq {
 		logger:     c.logger,
 		tracer:     c.tracer,
 		httpClient: c.httpClient,
+		limits:     c.limits,
 		baseURL:    c.baseURL,
 		id:         id,
 	}
 }
 
+// Region sets the raw IIIF region parameter, e.g. full, square or x,y,w,h
+func (r *ImageReq) Region(region string) *ImageReq {
+	r.region = region
+	return r
+}
+
 func (r *ImageReq) Square() *ImageReq {
 	r.region = "square"
 	return r
@@ -72,6 +84,12 @@ func (r *ImageReq) RegionPercentXYWH(x, y, w, h uint64) *ImageReq {
 	return r
 }
 
+// Size sets the raw IIIF size parameter, e.g. max, w, or !w,h
+func (r *ImageReq) Size(size string) *ImageReq {
+	r.size = size
+	return r
+}
+
 func (r *ImageReq) SizeFull() *ImageReq {
 	r.size = "full"
 	return r
@@ -123,6 +141,17 @@ func (r *ImageReq) Rotate(degrees float64) *ImageReq {
 	return r
 }
 
+// Format sets the format from its extension: jpg, tif, png, gif, jp2, pdf or webp
+func (r *ImageReq) Format(ext string) (*ImageReq, error) {
+	f, err := formatString(ext)
+	if err != nil {
+		return nil, err
+	}
+
+	r.format = f
+	return r, nil
+}
+
 func (r *ImageReq) Jpg() *ImageReq  { r.format = jpg; return r }
 func (r *ImageReq) Tif() *ImageReq  { r.format = tif; return r }
 func (r *ImageReq) PNG() *ImageReq  { r.format = png; return r }
@@ -136,7 +165,14 @@ func (r *ImageReq) Color() *ImageReq          { r.quality = qualityColor; return
 func (r *ImageReq) Gray() *ImageReq           { r.quality = qualityGray; return r }
 func (r *ImageReq) Bitonal() *ImageReq        { r.quality = qualityBitonal; return r }
 
-func (r *ImageReq) Resolve(ctx context.Context) (io.Reader, error) {
+// Resolve requests the image; the caller must close the body. The response must satisfy
+// the client's limits: a body that's too big fails with download.ErrTooLarge (possibly
+// while it's being read) and a response that isn't an allowed type fails with
+// download.ErrNotImage. If the client's transport is an httpcache.Transport in
+// changed-only mode and the image hasn't changed since it was cached, Resolve returns
+// httpcache.ErrNotModified. The image is counted in metrics.ImagesDownloaded once it's
+// been read to the end
+func (r *ImageReq) Resolve(ctx context.Context) (io.ReadCloser, error) {
 	ctx, span := r.tracer.Start(ctx, "Making request to "+r.id)
 	defer span.End()
 
@@ -152,7 +188,7 @@ func (r *ImageReq) Resolve(ctx context.Context) (io.Reader, error) {
 	}()
 
 	path := r.buildURL()
-	l := r.logger.With("object", r, "path", path)
+	l := r.logger.With("id", r.id, "path", path)
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
 	if err != nil {
@@ -166,53 +202,84 @@ func (r *ImageReq) Resolve(ctx context.Context) (io.Reader, error) {
 		return nil, err
 	}
 
-	switch code := resp.StatusCode {
-	case 400, 401, 403, 404, 500, 501, 503:
-		errMsg, err := io.ReadAll(resp.Body)
-		if err != nil {
-			l.ErrorContext(ctx, "failed reading err response body", "err", err)
-			return nil, err
-		}
+	if code := resp.StatusCode; code < 200 || code >= 300 {
+		defer resp.Body.Close()
+		metrics.Rejected(metrics.ReasonBadStatus)
+		err = r.readErrorResponse(ctx, l, resp)
+		return nil, err
+	}
 
-		l.ErrorContext("msg", "bad response received", "code", code, "response", errMsg)
-		return nil, fmt.Errorf("received %d: %s", errMsg)
+	if httpcache.Unchanged(resp) {
+		resp.Body.Close()
+		l.DebugContext(ctx, "image unchanged since last fetch")
+		err = httpcache.ErrNotModified
+		return nil, err
 	}
 
-	if code < 200 || code >= 300 {
-		l.ErrorContext(ctx, "bad response code", "err", err)
-		return nil, fmt.Errorf("bad response code received: %d", code)
+	body, err := r.limits.Body(resp)
+	if err != nil {
+		l.ErrorContext(ctx, "rejected response", "err", err)
+		return nil, err
 	}
 
-	return resp.Body, err
+	return &imageBody{ReadCloser: body}, nil
 }
 
-func (r *ImageReq) readErrorResponse(resp *http.Response) error {
-		errMsg, err := io.ReadAll(resp.Body)
-		if err != nil {
-			l.ErrorContext(ctx, "failed reading err response body", "err", err)
-			return nil, err
-		}
+// imageBody counts the image as downloaded when it's read to EOF
+type imageBody struct {
+	io.ReadCloser
+	counted bool
+}
+
+func (b *imageBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF && !b.counted {
+		b.counted = true
+		metrics.ImagesDownloaded.WithLabelValues("iiif").Inc()
+	}
+
+	return n, err
+}
+
+// URL is the URL Resolve requests
+func (r *ImageReq) URL() string {
+	return r.buildURL()
+}
+
+func (r *ImageReq) readErrorResponse(ctx context.Context, l *slog.Logger, resp *http.Response) error {
+	code := resp.StatusCode
+	errMsg, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		l.ErrorContext(ctx, "failed reading err response body", "code", code, "err", err)
+		return fmt.Errorf("bad response code received: %d", code)
+	}
 
-		l.ErrorContext("msg", "bad response received", "code", code, "response", errMsg)
-		return nil, fmt.Errorf("received %d: %s", errMsg)
+	l.ErrorContext(ctx, "bad response received", "code", code, "response", string(errMsg))
+	return fmt.Errorf("received %d: %s", code, errMsg)
 }
 
 func (r *ImageReq) buildURL() string {
-	var rotation string
-	if mr := r.mirrorRotation; mr != 0 {
-		rotation = fmt.Sprintf("!%f", mr)
-	} else {
-		rotation = fmt.Sprint(r.rotation)
+	region, size, rotation := r.region, r.size, r.rotation
+	if region == "" {
+		region = "full"
+	}
+
+	if size == "" {
+		size = "max"
+	}
+
+	if rotation == "" {
+		rotation = "0"
 	}
 
 	return fmt.Sprintf(
 		"%s/%s/%s/%s/%s/%s.%s",
 		r.baseURL,
 		r.id,
-		r.region,
-		r.size,
+		region,
+		size,
 		rotation,
-		r.quality,
+		strings.ToLower(r.quality.String()),
 		r.format,
 	)
 }
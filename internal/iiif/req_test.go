@@ -0,0 +1,120 @@
+package iiif
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AnthonyHewins/imgscrape/internal/download"
+	"golang.org/x/exp/slog"
+)
+
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func TestResolve(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		if rest != "full/max/0/default.jpg" {
+			http.Error(w, "unexpected path "+r.URL.Path, http.StatusBadRequest)
+			return
+		}
+
+		switch id {
+		case "png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(pngHeader)
+		case "typed":
+			w.Header().Set("Content-Type", "image/jpeg; charset=binary")
+			w.Write(pngHeader)
+		case "untyped":
+			w.Header()["Content-Type"] = nil // don't let the server sniff it
+			w.Write(pngHeader)
+		case "html":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html></html>"))
+		case "declared-large":
+			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("Content-Length", "1024")
+			w.Write(bytes.Repeat([]byte{1}, 1024))
+		case "chunked-large":
+			w.Header().Set("Content-Type", "image/png")
+			for i := 0; i < 4; i++ {
+				w.Write(bytes.Repeat([]byte{1}, 256))
+				w.(http.Flusher).Flush()
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	client := NewClient("", logger, srv.Client(), srv.URL).
+		WithLimits(download.Limits{MaxBytes: 512, AllowedTypes: []string{"image/*"}})
+
+	tests := []struct {
+		id          string
+		want        []byte
+		wantErr     error
+		wantReadErr error
+		wantAnyErr  bool
+	}{
+		{id: "png", want: pngHeader},
+		{id: "typed", want: pngHeader},
+		{id: "untyped", want: pngHeader},
+		{id: "html", wantErr: download.ErrNotImage},
+		{id: "declared-large", wantErr: download.ErrTooLarge},
+		{id: "chunked-large", wantReadErr: download.ErrTooLarge},
+		{id: "missing", wantAnyErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.id, func(t *testing.T) {
+			body, err := client.NewImageReq(tc.id).Resolve(context.Background())
+			if tc.wantAnyErr {
+				if err == nil {
+					body.Close()
+					t.Fatal("expected an error")
+				}
+				return
+			}
+
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Resolve: got err %v, want %v", err, tc.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+			defer body.Close()
+
+			got, err := io.ReadAll(body)
+			if !errors.Is(err, tc.wantReadErr) {
+				t.Fatalf("reading: got err %v, want %v", err, tc.wantReadErr)
+			}
+
+			if err == nil && !bytes.Equal(got, tc.want) {
+				t.Fatalf("read %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveDefaultLimits(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"not": "an image"}`))
+	}))
+	defer srv.Close()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	_, err := NewClient("", logger, srv.Client(), srv.URL).NewImageReq("x").Resolve(context.Background())
+	if !errors.Is(err, download.ErrNotImage) {
+		t.Fatalf("got err %v, want %v", err, download.ErrNotImage)
+	}
+}
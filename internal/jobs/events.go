@@ -0,0 +1,48 @@
+package jobs
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Events returns up to limit of a job's events with a seq after the given one, oldest first
+func (m *Manager) Events(ctx context.Context, jobID string, after int64, limit int) ([]Event, error) {
+	var events []Event
+	err := m.reader.SelectContext(ctx, &events,
+		`SELECT job_id, seq, type, url, path, error, state, created_at
+		FROM job_events WHERE job_id = $1 AND seq > $2
+		ORDER BY seq
+		LIMIT $3`,
+		jobID, after, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range events {
+		events[i].At = events[i].At.UTC()
+	}
+
+	return events, nil
+}
+
+// emit records an event, applying set (e.g. "pages_done = pages_done + 1") to the job
+// in the same statement. The seq comes from the job row, whose lock is held until
+// the statement's transaction commits, so seqs become visible in order
+func emit(ctx context.Context, db sqlx.ExecerContext, set string, e Event) error {
+	if set != "" {
+		set = ", " + set
+	}
+
+	_, err := db.ExecContext(ctx,
+		`WITH j AS (
+			UPDATE scrape_jobs SET events = events + 1`+set+` WHERE id = $1 RETURNING id, events
+		)
+		INSERT INTO job_events (job_id, seq, type, url, path, error, state)
+		SELECT j.id, j.events, $2, $3, $4, $5, $6 FROM j`,
+		e.JobID, e.Type, e.URL, e.Path, e.Error, e.State,
+	)
+
+	return err
+}
@@ -0,0 +1,180 @@
+package jobs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+var (
+	ErrNotFound    = errors.New("job not found")
+	ErrFinished    = errors.New("job already finished")
+	ErrInvalidSpec = errors.New("invalid job spec")
+)
+
+// Kind is what a job scrapes
+type Kind string
+
+const (
+	KindCrawl Kind = "crawl"
+	KindIIIF  Kind = "iiif"
+)
+
+// State is where a job is in its lifecycle
+type State string
+
+const (
+	StateQueued    State = "queued"
+	StateRunning   State = "running"
+	StateSucceeded State = "succeeded"
+	StateFailed    State = "failed"
+	StateCanceled  State = "canceled"
+)
+
+// Finished reports whether the job will never change state again
+func (s State) Finished() bool {
+	return s == StateSucceeded || s == StateFailed || s == StateCanceled
+}
+
+// CrawlSpec mirrors the flags of the CLI's crawl
+type CrawlSpec struct {
+	URLs          []string `json:"urls"`
+	MaxDepth      int      `json:"max_depth,omitempty"`
+	Sitemaps      bool     `json:"sitemaps,omitempty"`
+	SitemapImages bool     `json:"sitemap_images,omitempty"`
+	StripParams   []string `json:"strip_params,omitempty"`
+}
+
+func (s *CrawlSpec) validate() error {
+	if len(s.URLs) == 0 {
+		return fmt.Errorf("%w: no URLs to crawl", ErrInvalidSpec)
+	}
+
+	for _, raw := range s.URLs {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%w: %q is not an absolute http(s) URL", ErrInvalidSpec, raw)
+		}
+	}
+
+	if s.MaxDepth < 0 {
+		return fmt.Errorf("%w: negative max depth", ErrInvalidSpec)
+	}
+
+	return nil
+}
+
+// IIIFSpec downloads images from a IIIF image API
+type IIIFSpec struct {
+	BaseURL     string   `json:"base_url"`
+	Identifiers []string `json:"identifiers"`
+	Region      string   `json:"region,omitempty"`
+	Size        string   `json:"size,omitempty"`
+	Format      string   `json:"format,omitempty"`
+}
+
+func (s *IIIFSpec) validate() error {
+	u, err := url.Parse(s.BaseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: base URL %q is not an absolute http(s) URL", ErrInvalidSpec, s.BaseURL)
+	}
+
+	if len(s.Identifiers) == 0 {
+		return fmt.Errorf("%w: no identifiers to download", ErrInvalidSpec)
+	}
+
+	return nil
+}
+
+// Progress counts what a job has done so far
+type Progress struct {
+	PagesDone        int64 `json:"pages_done"`
+	PagesFailed      int64 `json:"pages_failed"`
+	ImagesFound      int64 `json:"images_found"`
+	ImagesDownloaded int64 `json:"images_downloaded"`
+	ImagesFailed     int64 `json:"images_failed"`
+}
+
+type Job struct {
+	ID    string `json:"id"`
+	Kind  Kind   `json:"kind"`
+	State State  `json:"state"`
+
+	// exactly one is set, depending on Kind
+	Crawl *CrawlSpec `json:"crawl,omitempty"`
+	IIIF  *IIIFSpec  `json:"iiif,omitempty"`
+
+	Progress Progress `json:"progress"`
+	Error    string   `json:"error,omitempty"`
+
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// Image is an image a job found. Path is relative to the storage directory and
+// empty if the image wasn't downloaded
+type Image struct {
+	ID         string    `json:"id" db:"id"`
+	JobID      string    `json:"job_id" db:"job_id"`
+	URL        string    `json:"url" db:"url"`
+	PageURL    string    `json:"page_url,omitempty" db:"page_url"`
+	Alt        string    `json:"alt,omitempty" db:"alt"`
+	Title      string    `json:"title,omitempty" db:"title"`
+	Figcaption string    `json:"figcaption,omitempty" db:"figcaption"`
+	Extractor  string    `json:"extractor,omitempty" db:"extractor"`
+	Path       string    `json:"path,omitempty" db:"path"`
+	FoundAt    time.Time `json:"found_at" db:"found_at"`
+}
+
+// EventType is what happened in an Event
+type EventType string
+
+const (
+	EventPageFetched     EventType = "page_fetched"
+	EventPageFailed      EventType = "page_failed"
+	EventImageDiscovered EventType = "image_discovered"
+	EventImageDownloaded EventType = "image_downloaded"
+	EventImageRejected   EventType = "image_rejected" // over the size limit or not an image
+	EventImageFailed     EventType = "image_failed"   // out of attempts
+	EventJobState        EventType = "job_state"
+)
+
+// Event is something that happened while a job ran. Seq counts up from 1 per job
+// with no gaps, so it doubles as a cursor to resume from
+type Event struct {
+	Seq   int64     `json:"seq" db:"seq"`
+	JobID string    `json:"job_id" db:"job_id"`
+	Type  EventType `json:"type" db:"type"`
+
+	// page or image URL, for page and image events
+	URL string `json:"url,omitempty" db:"url"`
+
+	// where a downloaded image was stored, relative to the storage directory
+	Path string `json:"path,omitempty" db:"path"`
+
+	Error string `json:"error,omitempty" db:"error"`
+
+	// the job's new state, for EventJobState
+	State State `json:"state,omitempty" db:"state"`
+
+	At time.Time `json:"at" db:"created_at"`
+}
+
+// Filter narrows List. Zero values match everything
+type Filter struct {
+	State State
+	Kind  Kind
+}
+
+func newID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,606 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AnthonyHewins/imgscrape/internal/auth"
+	"github.com/AnthonyHewins/imgscrape/internal/download"
+	"github.com/AnthonyHewins/imgscrape/internal/metrics"
+	"github.com/AnthonyHewins/imgscrape/internal/quota"
+	"github.com/jmoiron/sqlx"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
+)
+
+// Options tune the workers. Zero values get defaults
+type Options struct {
+	// JobWorkers is how many jobs are crawled/expanded at once. Defaults to 2
+	JobWorkers int
+
+	// ImageWorkers is how many images are downloaded at once. Defaults to 8
+	ImageWorkers int
+
+	// PollInterval is how long an idle worker waits before checking the queue again. Defaults to 2s
+	PollInterval time.Duration
+
+	// Lease is how long a claim survives without a heartbeat before another worker
+	// may take it over. Heartbeats are sent every Lease/3. Defaults to 1m
+	Lease time.Duration
+
+	// MaxAttempts is how many times jobs and image tasks are tried. Defaults to 3
+	MaxAttempts int
+
+	// Limits are enforced on every image download. Defaults to download.Default
+	Limits *download.Limits
+
+	// Quotas, if set, limit how many jobs a caller can have queued or running, and
+	// hold back their image downloads once they've used up their daily quota
+	Quotas *quota.Store
+}
+
+func (o *Options) defaults() {
+	if o.JobWorkers < 1 {
+		o.JobWorkers = 2
+	}
+
+	if o.ImageWorkers < 1 {
+		o.ImageWorkers = 8
+	}
+
+	if o.PollInterval <= 0 {
+		o.PollInterval = 2 * time.Second
+	}
+
+	if o.Lease <= 0 {
+		o.Lease = time.Minute
+	}
+
+	if o.MaxAttempts < 1 {
+		o.MaxAttempts = 3
+	}
+
+	if o.Limits == nil {
+		o.Limits = &download.Default
+	}
+}
+
+// Manager queues jobs in Postgres and runs workers that claim them with
+// SELECT ... FOR UPDATE SKIP LOCKED, so any number of server processes can share
+// one queue. Jobs crawl (or expand IIIF identifiers) into per-image tasks, which
+// image workers download into the storage directory
+type Manager struct {
+	logger     *slog.Logger
+	tracer     trace.Tracer
+	traceName  string
+	reader     *sqlx.DB
+	writer     *sqlx.DB
+	httpClient *http.Client
+	storageDir string
+	opts       Options
+	workerID   string
+
+	ctx  context.Context
+	stop context.CancelFunc
+	wg   sync.WaitGroup
+
+	// for Check
+	started  atomic.Bool
+	failures atomic.Int32
+	lastErr  atomic.Value
+}
+
+// NewManager creates a manager. Reads go to reader and writes to writer. Call Start to
+// begin processing the queue; without it the manager only submits and reads jobs
+func NewManager(traceName string, logger *slog.Logger, reader, writer *sqlx.DB, httpClient *http.Client, storageDir string, opts Options) *Manager {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	opts.defaults()
+	host, _ := os.Hostname()
+
+	ctx, stop := context.WithCancel(context.Background())
+	return &Manager{
+		logger:     logger,
+		tracer:     otel.Tracer(traceName),
+		traceName:  traceName,
+		reader:     reader,
+		writer:     writer,
+		httpClient: httpClient,
+		storageDir: storageDir,
+		opts:       opts,
+		workerID:   fmt.Sprintf("%s-%d-%s", host, os.Getpid(), newID()[:8]),
+		ctx:        ctx,
+		stop:       stop,
+	}
+}
+
+const jobColumns = `id, kind, state, spec, error, pages_done, pages_failed, images_found, images_downloaded, images_failed, created_at, started_at, finished_at`
+
+type jobRow struct {
+	ID               string     `db:"id"`
+	Kind             Kind       `db:"kind"`
+	State            State      `db:"state"`
+	Spec             []byte     `db:"spec"`
+	Error            string     `db:"error"`
+	PagesDone        int64      `db:"pages_done"`
+	PagesFailed      int64      `db:"pages_failed"`
+	ImagesFound      int64      `db:"images_found"`
+	ImagesDownloaded int64      `db:"images_downloaded"`
+	ImagesFailed     int64      `db:"images_failed"`
+	CreatedAt        time.Time  `db:"created_at"`
+	StartedAt        *time.Time `db:"started_at"`
+	FinishedAt       *time.Time `db:"finished_at"`
+}
+
+func (r *jobRow) job() (*Job, error) {
+	j := &Job{
+		ID:    r.ID,
+		Kind:  r.Kind,
+		State: r.State,
+		Progress: Progress{
+			PagesDone:        r.PagesDone,
+			PagesFailed:      r.PagesFailed,
+			ImagesFound:      r.ImagesFound,
+			ImagesDownloaded: r.ImagesDownloaded,
+			ImagesFailed:     r.ImagesFailed,
+		},
+		Error:      r.Error,
+		CreatedAt:  r.CreatedAt.UTC(),
+		StartedAt:  utc(r.StartedAt),
+		FinishedAt: utc(r.FinishedAt),
+	}
+
+	var spec any
+	switch r.Kind {
+	case KindCrawl:
+		j.Crawl = &CrawlSpec{}
+		spec = j.Crawl
+	case KindIIIF:
+		j.IIIF = &IIIFSpec{}
+		spec = j.IIIF
+	default:
+		return nil, fmt.Errorf("job %s has unknown kind %q", r.ID, r.Kind)
+	}
+
+	if err := json.Unmarshal(r.Spec, spec); err != nil {
+		return nil, fmt.Errorf("job %s has a corrupt spec: %w", r.ID, err)
+	}
+
+	return j, nil
+}
+
+// SubmitCrawl queues a crawl
+func (m *Manager) SubmitCrawl(ctx context.Context, spec CrawlSpec) (*Job, error) {
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+
+	return m.submit(ctx, KindCrawl, spec)
+}
+
+// SubmitIIIF queues a IIIF download
+func (m *Manager) SubmitIIIF(ctx context.Context, spec IIIFSpec) (*Job, error) {
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+
+	return m.submit(ctx, KindIIIF, spec)
+}
+
+func (m *Manager) submit(ctx context.Context, kind Kind, spec any) (*Job, error) {
+	buf, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := m.writer.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if m.opts.Quotas != nil {
+		if err = m.opts.Quotas.ReserveJob(ctx, tx, caller(ctx)); err != nil {
+			return nil, err
+		}
+	}
+
+	var row jobRow
+	err = tx.GetContext(ctx, &row,
+		`INSERT INTO scrape_jobs (id, kind, spec, max_attempts, caller) VALUES ($1, $2, $3, $4, $5) RETURNING `+jobColumns,
+		newID(), kind, string(buf), m.opts.MaxAttempts, caller(ctx), // lib/pq would send []byte as bytea
+	)
+	if err != nil {
+		m.logger.ErrorContext(ctx, "failed inserting job", "err", err)
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	m.logger.InfoContext(ctx, "job submitted", "job", row.ID, "kind", kind)
+	return row.job()
+}
+
+// Get returns a job. Callers only see their own jobs unless they're admins
+func (m *Manager) Get(ctx context.Context, id string) (*Job, error) {
+	var row jobRow
+	err := m.reader.GetContext(ctx, &row,
+		`SELECT `+jobColumns+` FROM scrape_jobs WHERE id = $1 AND ($2 = '' OR caller = $2)`,
+		id, owner(ctx),
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return row.job()
+}
+
+// List returns up to limit jobs matching f, newest first, skipping the first offset.
+// next is the offset of the following page, or 0 if there isn't one. Callers only see
+// their own jobs unless they're admins
+func (m *Manager) List(ctx context.Context, f Filter, offset, limit int) (jobs []Job, next int, err error) {
+	var rows []jobRow
+	err = m.reader.SelectContext(ctx, &rows,
+		`SELECT `+jobColumns+` FROM scrape_jobs
+		WHERE ($1 = '' OR state = $1) AND ($2 = '' OR kind = $2) AND ($5 = '' OR caller = $5)
+		ORDER BY created_at DESC, id DESC
+		LIMIT $3 OFFSET $4`,
+		f.State, f.Kind, limit+1, offset, owner(ctx),
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(rows) > limit {
+		rows, next = rows[:limit], offset+limit
+	}
+
+	jobs = make([]Job, len(rows))
+	for i := range rows {
+		j, err := rows[i].job()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		jobs[i] = *j
+	}
+
+	return jobs, next, nil
+}
+
+// Cancel stops a queued or running job along with its outstanding image tasks.
+// Callers can only cancel their own jobs unless they're admins
+func (m *Manager) Cancel(ctx context.Context, id string) (*Job, error) {
+	tx, err := m.writer.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// someone else's job is as good as missing
+	var state State
+	err = tx.GetContext(ctx, &state,
+		`SELECT state FROM scrape_jobs WHERE id = $1 AND ($2 = '' OR caller = $2)`,
+		id, owner(ctx),
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// tasks first; workers lock a task before its job, and taking them in the
+	// same order keeps the two from deadlocking
+	_, err = tx.ExecContext(ctx,
+		`UPDATE image_tasks SET state = 'canceled', finished_at = now(), locked_by = NULL, heartbeat_at = NULL
+		WHERE job_id = $1 AND state IN ('queued', 'running')`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var row jobRow
+	err = tx.GetContext(ctx, &row,
+		`UPDATE scrape_jobs SET state = 'canceled', finished_at = now(), locked_by = NULL, heartbeat_at = NULL
+		WHERE id = $1 AND state IN ('queued', 'running')
+		RETURNING `+jobColumns,
+		id,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		// it may have finished since it was looked up
+		if err = tx.GetContext(ctx, &state, `SELECT state FROM scrape_jobs WHERE id = $1`, id); err != nil {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("%w: %s is %s", ErrFinished, id, state)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = emit(ctx, tx, "", Event{JobID: id, Type: EventJobState, State: StateCanceled}); err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	m.logger.InfoContext(ctx, "job canceled", "job", id)
+	return row.job()
+}
+
+// Images returns up to limit of the images a job found, in the order they were
+// found, skipping the first offset. next is the offset of the following page, or 0.
+// Like Get, it fails with ErrNotFound for other callers' jobs
+func (m *Manager) Images(ctx context.Context, jobID string, offset, limit int) (images []Image, next int, err error) {
+	if _, err = m.Get(ctx, jobID); err != nil {
+		return nil, 0, err
+	}
+
+	err = m.reader.SelectContext(ctx, &images,
+		`SELECT id::text AS id, job_id, url, page_url, alt, title, figcaption, extractor, path, found_at
+		FROM image_tasks WHERE job_id = $1
+		ORDER BY id
+		LIMIT $2 OFFSET $3`,
+		jobID, limit+1, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(images) > limit {
+		images, next = images[:limit], offset+limit
+	}
+
+	for i := range images {
+		images[i].FoundAt = images[i].FoundAt.UTC()
+	}
+
+	return images, next, nil
+}
+
+// Start launches the job and image workers
+func (m *Manager) Start() {
+	m.logger.Info("starting job workers",
+		"worker_id", m.workerID,
+		"job_workers", m.opts.JobWorkers,
+		"image_workers", m.opts.ImageWorkers,
+	)
+
+	m.started.Store(true)
+	for i := 0; i < m.opts.JobWorkers; i++ {
+		m.wg.Add(1)
+		go m.poll(m.logger.With("worker", "job", "n", i), m.claimJob)
+	}
+
+	for i := 0; i < m.opts.ImageWorkers; i++ {
+		m.wg.Add(1)
+		go m.poll(m.logger.With("worker", "image", "n", i), m.claimImage)
+	}
+
+	m.wg.Add(1)
+	go m.gaugeQueues()
+}
+
+// Shutdown stops the workers, handing anything they'd claimed back to the queue,
+// and waits for them to stop or for ctx to expire
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.stop()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Check reports whether the workers are up and able to reach the queue. It passes if
+// they were never started
+func (m *Manager) Check(context.Context) error {
+	if !m.started.Load() {
+		return nil
+	}
+
+	if m.ctx.Err() != nil {
+		return errors.New("job workers stopped")
+	}
+
+	// a few failures in a row across all workers means the queue is unreachable,
+	// not that one task is bad
+	if n := m.failures.Load(); n >= 3 {
+		return fmt.Errorf("job workers failed %d times in a row, last with: %v", n, m.lastErr.Load())
+	}
+
+	return nil
+}
+
+// poll runs claim until the manager stops, backing off for the poll interval
+// whenever the queue is empty or claiming fails
+func (m *Manager) poll(l *slog.Logger, claim func(context.Context, *slog.Logger) (bool, error)) {
+	defer m.wg.Done()
+
+	for m.ctx.Err() == nil {
+		worked, err := claim(m.ctx, l)
+		switch {
+		case err != nil && m.ctx.Err() == nil:
+			l.Error("failed processing queue", "err", err)
+			m.failures.Add(1)
+			m.lastErr.Store(err)
+		case err == nil:
+			m.failures.Store(0)
+		}
+
+		if worked && err == nil {
+			continue
+		}
+
+		select {
+		case <-m.ctx.Done():
+		case <-time.After(m.opts.PollInterval):
+		}
+	}
+}
+
+// queueDepthInterval is how often gaugeQueues counts the queues
+const queueDepthInterval = 15 * time.Second
+
+// gaugeQueues keeps metrics.QueueDepth up to date until the manager stops
+func (m *Manager) gaugeQueues() {
+	defer m.wg.Done()
+
+	for {
+		var rows []struct {
+			Queue string `db:"queue"`
+			State string `db:"state"`
+			N     int64  `db:"n"`
+		}
+
+		err := m.reader.SelectContext(m.ctx, &rows,
+			`SELECT 'jobs' AS queue, state, count(*) AS n FROM scrape_jobs WHERE state IN ('queued', 'running') GROUP BY state
+			UNION ALL
+			SELECT 'images', state, count(*) FROM image_tasks WHERE state IN ('queued', 'running') GROUP BY state`,
+		)
+
+		switch {
+		case m.ctx.Err() != nil:
+			return
+		case err != nil:
+			m.logger.Warn("failed counting queue depth", "err", err)
+		default:
+			// states with nothing in them have no row
+			for _, q := range []string{metrics.QueueJobs, metrics.QueueImages} {
+				for _, state := range []State{StateQueued, StateRunning} {
+					metrics.QueueDepth.WithLabelValues(q, string(state)).Set(0)
+				}
+			}
+
+			for _, r := range rows {
+				metrics.QueueDepth.WithLabelValues(r.Queue, r.State).Set(float64(r.N))
+			}
+		}
+
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-time.After(queueDepthInterval):
+		}
+	}
+}
+
+// heartbeats bump a claimed row's heartbeat_at, by table. id is compared as the table's
+// own key type so the primary key index is used
+var heartbeats = map[string]string{
+	"scrape_jobs": `UPDATE scrape_jobs SET heartbeat_at = now() WHERE id = $1 AND locked_by = $2 AND state = 'running'`,
+	"image_tasks": `UPDATE image_tasks SET heartbeat_at = now() WHERE id = $1::bigint AND locked_by = $2 AND state = 'running'`,
+}
+
+// hold heartbeats a claimed row of table until the returned stop func is called. The
+// returned context is canceled if the claim is lost, e.g. because the job was canceled
+func (m *Manager) hold(ctx context.Context, l *slog.Logger, table, id string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(m.opts.Lease / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			res, err := m.writer.ExecContext(ctx, heartbeats[table], id, m.workerID)
+			if err != nil {
+				l.WarnContext(ctx, "failed heartbeat", "err", err)
+				continue
+			}
+
+			if n, _ := res.RowsAffected(); n == 0 {
+				l.InfoContext(ctx, "lost claim; stopping work")
+				cancel()
+				return
+			}
+		}
+	}()
+
+	return ctx, func() {
+		close(done)
+		cancel()
+	}
+}
+
+// backoff is how long to wait before retrying after the given attempt
+func backoff(attempt int) time.Duration {
+	d := 10 * time.Second
+	for i := 1; i < attempt && d < 10*time.Minute; i++ {
+		d *= 2
+	}
+
+	if d > 10*time.Minute {
+		d = 10 * time.Minute
+	}
+
+	return d
+}
+
+// caller is who's making a request, or "" if auth is off
+func caller(ctx context.Context) string {
+	if id := auth.FromContext(ctx); id != nil {
+		return id.Subject
+	}
+
+	return ""
+}
+
+// owner is the caller whose jobs a request is limited to, or "" for every job: when
+// auth is off or the caller has the admin scope
+func owner(ctx context.Context) string {
+	id := auth.FromContext(ctx)
+	if id == nil || id.Has(auth.ScopeAdmin) {
+		return ""
+	}
+
+	return id.Subject
+}
+
+func utc(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+
+	u := t.UTC()
+	return &u
+}
@@ -0,0 +1,641 @@
+package jobs
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/AnthonyHewins/imgscrape/internal/canon"
+	"github.com/AnthonyHewins/imgscrape/internal/corpus"
+	"github.com/AnthonyHewins/imgscrape/internal/crawler"
+	"github.com/AnthonyHewins/imgscrape/internal/download"
+	"github.com/AnthonyHewins/imgscrape/internal/iiif"
+	"github.com/AnthonyHewins/imgscrape/internal/metrics"
+	"github.com/AnthonyHewins/imgscrape/internal/quota"
+	"github.com/AnthonyHewins/imgscrape/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	otelCodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
+)
+
+// errNoRetry marks failures that would fail the same way again
+var errNoRetry = errors.New("permanent failure")
+
+// claimJob claims one queued job (or one whose worker stopped heartbeating) and
+// expands it into image tasks. It reports whether there was anything to claim
+func (m *Manager) claimJob(ctx context.Context, l *slog.Logger) (bool, error) {
+	var row struct {
+		jobRow
+		Attempts    int `db:"attempts"`
+		MaxAttempts int `db:"max_attempts"`
+	}
+
+	err := m.writer.GetContext(ctx, &row,
+		`UPDATE scrape_jobs
+		SET state = 'running', attempts = attempts + 1, locked_by = $1, heartbeat_at = now(),
+			started_at = COALESCE(started_at, now()), pages_done = 0, pages_failed = 0, error = ''
+		WHERE id = (
+			SELECT id FROM scrape_jobs
+			WHERE (state = 'queued' AND run_after <= now())
+				OR (state = 'running' AND locked_by IS NOT NULL AND heartbeat_at < now() - make_interval(secs => $2))
+			ORDER BY run_after, created_at
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1
+		)
+		RETURNING `+jobColumns+`, attempts, max_attempts`,
+		m.workerID, m.opts.Lease.Seconds(),
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	metrics.WorkersInFlight.WithLabelValues(metrics.QueueJobs).Inc()
+	defer metrics.WorkersInFlight.WithLabelValues(metrics.QueueJobs).Dec()
+
+	j, err := row.job()
+	if err != nil {
+		return true, m.failJob(l, row.ID, row.Attempts, fmt.Errorf("%w: %v", errNoRetry, err))
+	}
+
+	l = l.With("job", j.ID, "kind", j.Kind, "attempt", row.Attempts)
+	if row.Attempts > row.MaxAttempts {
+		// claimed back from a worker that died on its last attempt
+		return true, m.failJob(l, j.ID, row.Attempts, fmt.Errorf("%w: gave up after %d attempts", errNoRetry, row.MaxAttempts))
+	}
+
+	workCtx, release := m.hold(ctx, l, "scrape_jobs", j.ID)
+	defer release()
+
+	workCtx, span := m.tracer.Start(tracing.WithAttempt(workCtx, row.Attempts), "job "+string(j.Kind), trace.WithAttributes(
+		attribute.String("job.id", j.ID),
+		attribute.Int("job.attempt", row.Attempts),
+	))
+	defer span.End()
+
+	l.InfoContext(workCtx, "job claimed")
+	if err = emit(workCtx, m.writer, "", Event{JobID: j.ID, Type: EventJobState, State: StateRunning}); err != nil {
+		l.WarnContext(workCtx, "failed recording job state event", "err", err)
+	}
+
+	switch j.Kind {
+	case KindCrawl:
+		err = m.crawl(workCtx, l, j)
+	case KindIIIF:
+		err = m.iiif(workCtx, l, j)
+	}
+
+	switch {
+	case m.ctx.Err() != nil:
+		// shutting down; let another worker pick it up without using up an attempt
+		_, err = m.writer.ExecContext(context.Background(),
+			`UPDATE scrape_jobs SET state = 'queued', attempts = attempts - 1, locked_by = NULL, heartbeat_at = NULL
+			WHERE id = $1 AND locked_by = $2 AND state = 'running'`,
+			j.ID, m.workerID,
+		)
+		return true, err
+	case workCtx.Err() != nil:
+		// canceled or taken over; whoever holds it now decides its state
+		return true, nil
+	case err != nil:
+		span.RecordError(err)
+		return true, m.failJob(l, j.ID, row.Attempts, err)
+	}
+
+	_, err = m.writer.ExecContext(ctx,
+		`UPDATE scrape_jobs SET locked_by = NULL, heartbeat_at = NULL, expanded_at = now()
+		WHERE id = $1 AND locked_by = $2 AND state = 'running'`,
+		j.ID, m.workerID,
+	)
+	if err != nil {
+		return true, err
+	}
+
+	l.InfoContext(ctx, "job expanded into image tasks")
+	return true, m.finalize(ctx, j.ID)
+}
+
+// failJob queues a job again after a backoff, or fails it if it's out of attempts or
+// the error is permanent. A failed job's outstanding image tasks are canceled with it
+func (m *Manager) failJob(l *slog.Logger, id string, attempt int, cause error) error {
+	ctx := context.Background()
+	retry := !errors.Is(cause, errNoRetry)
+
+	tx, err := m.writer.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// tasks first, in the same order as Cancel and the image workers
+	_, err = tx.ExecContext(ctx,
+		`SELECT 1 FROM image_tasks WHERE job_id = $1 AND state IN ('queued', 'running') FOR UPDATE`,
+		id,
+	)
+	if err != nil {
+		return err
+	}
+
+	var state State
+	err = tx.GetContext(ctx, &state,
+		`WITH j AS (
+			UPDATE scrape_jobs
+			SET state = CASE WHEN $3 AND attempts < max_attempts THEN 'queued' ELSE 'failed' END,
+				finished_at = CASE WHEN $3 AND attempts < max_attempts THEN NULL ELSE now() END,
+				run_after = now() + make_interval(secs => $4),
+				error = $5, locked_by = NULL, heartbeat_at = NULL, events = events + 1
+			WHERE id = $1 AND (locked_by = $2 OR locked_by IS NULL) AND state = 'running'
+			RETURNING id, events, state, error
+		)
+		INSERT INTO job_events (job_id, seq, type, state, error)
+		SELECT id, events, 'job_state', state, error FROM j
+		RETURNING state`,
+		id, m.workerID, retry, backoff(attempt).Seconds(), cause.Error(),
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if state == StateFailed {
+		_, err = tx.ExecContext(ctx,
+			`UPDATE image_tasks SET state = 'canceled', finished_at = now(), locked_by = NULL, heartbeat_at = NULL
+			WHERE job_id = $1 AND state IN ('queued', 'running')`,
+			id,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	if state == StateQueued {
+		metrics.Retries.WithLabelValues(metrics.QueueJobs).Inc()
+	}
+
+	l.WarnContext(ctx, "job attempt failed", "err", cause, "state", state)
+	return nil
+}
+
+// crawl queues an image task for every image ref the crawl finds
+func (m *Manager) crawl(ctx context.Context, l *slog.Logger, j *Job) error {
+	spec := j.Crawl
+	c := canon.Default.With(spec.StripParams...)
+
+	a := crawler.New(m.traceName, l, m.httpClient).
+		WithMaxDepth(spec.MaxDepth).
+		WithCanonicalizer(c).
+		WithFrontier(crawler.NewMemoryFrontier(c))
+
+	if spec.Sitemaps {
+		a.WithSitemaps(spec.SitemapImages)
+	}
+
+	if err := a.AddURLString(spec.URLs...); err != nil {
+		return fmt.Errorf("%w: %v", errNoRetry, err)
+	}
+
+	var pages, failed int64
+	for result := range a.Stream(ctx) {
+		set, e := "pages_done = pages_done + 1", Event{JobID: j.ID, Type: EventPageFetched, URL: result.URL}
+		if result.Err != nil {
+			failed++
+			set, e.Type, e.Error = "pages_failed = pages_failed + 1", EventPageFailed, result.Err.Error()
+			l.WarnContext(ctx, "page failed", "url", result.URL, "err", result.Err)
+		} else {
+			pages++
+		}
+
+		if err := emit(ctx, m.writer, set, e); err != nil {
+			return err
+		}
+
+		for _, ref := range result.Refs {
+			if err := m.queueImage(ctx, j.ID, Image{
+				URL:        ref.URL,
+				PageURL:    ref.PageURL,
+				Alt:        ref.Alt,
+				Title:      ref.Title,
+				Figcaption: ref.Figcaption,
+				Extractor:  ref.Extractor,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if pages == 0 && failed > 0 {
+		return fmt.Errorf("all %d pages failed", failed)
+	}
+
+	return nil
+}
+
+// iiif queues an image task for every identifier
+func (m *Manager) iiif(ctx context.Context, l *slog.Logger, j *Job) error {
+	spec := j.IIIF
+	client := iiif.NewClient(m.traceName, l, m.httpClient, spec.BaseURL)
+
+	for _, id := range spec.Identifiers {
+		req := client.NewImageReq(id).Region(spec.Region).Size(spec.Size)
+		if spec.Format != "" {
+			var err error
+			if req, err = req.Format(spec.Format); err != nil {
+				return fmt.Errorf("%w: %v", errNoRetry, err)
+			}
+		}
+
+		if err := m.queueImage(ctx, j.ID, Image{URL: req.URL(), Title: id, Extractor: "iiif"}); err != nil {
+			return err
+		}
+
+		metrics.ImagesDiscovered.WithLabelValues("iiif").Inc()
+	}
+
+	return nil
+}
+
+// queueImage inserts an image task. If it's new, it counts towards the job's images
+// and is recorded as discovered
+func (m *Manager) queueImage(ctx context.Context, jobID string, img Image) error {
+	_, err := m.writer.ExecContext(ctx,
+		`WITH ins AS (
+			INSERT INTO image_tasks (job_id, url, page_url, alt, title, figcaption, extractor, max_attempts)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			ON CONFLICT (job_id, url) DO NOTHING
+			RETURNING job_id, url
+		), j AS (
+			UPDATE scrape_jobs SET images_found = images_found + 1, events = events + 1
+			FROM ins WHERE scrape_jobs.id = ins.job_id
+			RETURNING scrape_jobs.id, scrape_jobs.events
+		)
+		INSERT INTO job_events (job_id, seq, type, url)
+		SELECT j.id, j.events, 'image_discovered', ins.url FROM j, ins`,
+		jobID, img.URL, img.PageURL, img.Alt, img.Title, img.Figcaption, img.Extractor, m.opts.MaxAttempts,
+	)
+
+	return err
+}
+
+type imageTask struct {
+	Image
+	Kind        Kind   `db:"kind"`
+	Caller      string `db:"caller"`
+	Attempts    int    `db:"attempts"`
+	MaxAttempts int    `db:"max_attempts"`
+}
+
+// claimImage claims one image task and downloads it. It reports whether there was anything to claim
+func (m *Manager) claimImage(ctx context.Context, l *slog.Logger) (bool, error) {
+	var t imageTask
+	err := m.writer.GetContext(ctx, &t,
+		`UPDATE image_tasks t
+		SET state = 'running', attempts = t.attempts + 1, locked_by = $1, heartbeat_at = now()
+		FROM scrape_jobs j
+		WHERE j.id = t.job_id AND t.id = (
+			SELECT id FROM image_tasks
+			WHERE (state = 'queued' AND run_after <= now())
+				OR (state = 'running' AND heartbeat_at < now() - make_interval(secs => $2))
+			ORDER BY run_after, id
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1
+		)
+		RETURNING t.id::text AS id, t.job_id, t.url, t.page_url, t.alt, t.title, t.figcaption, t.extractor, t.path, t.found_at,
+			t.attempts, t.max_attempts, j.kind, j.caller`,
+		m.workerID, m.opts.Lease.Seconds(),
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	metrics.WorkersInFlight.WithLabelValues(metrics.QueueImages).Inc()
+	defer metrics.WorkersInFlight.WithLabelValues(metrics.QueueImages).Dec()
+
+	l = l.With("job", t.JobID, "task", t.ID, "url", t.URL, "attempt", t.Attempts)
+	if t.Attempts > t.MaxAttempts {
+		return true, m.failImage(l, &t, fmt.Errorf("%w: gave up after %d attempts", errNoRetry, t.MaxAttempts))
+	}
+
+	// the image is counted against the caller's quota up front, and given back
+	// unless it's downloaded
+	day, reserved, downloaded := quota.Today(), false, false
+	if m.opts.Quotas != nil {
+		var exceeded *quota.ExceededError
+		switch err = m.opts.Quotas.ReserveImage(ctx, m.writer, t.Caller, day); {
+		case errors.As(err, &exceeded):
+			return true, m.holdBack(ctx, l, &t, exceeded)
+		case err != nil:
+			l.WarnContext(ctx, "failed checking quota; downloading anyway", "err", err)
+		default:
+			reserved = true
+		}
+	}
+
+	defer func() {
+		if !reserved || downloaded {
+			return
+		}
+
+		if err := m.opts.Quotas.ReleaseImage(context.Background(), m.writer, t.Caller, day); err != nil {
+			l.Warn("failed giving back the caller's quota for an image that wasn't downloaded", "err", err)
+		}
+	}()
+
+	workCtx, release := m.hold(ctx, l, "image_tasks", t.ID)
+	defer release()
+
+	workCtx, span := m.tracer.Start(tracing.WithAttempt(workCtx, t.Attempts), "image task", trace.WithAttributes(
+		attribute.String("job.id", t.JobID),
+		attribute.String("image.task", t.ID),
+		attribute.String("image.url", t.URL),
+		attribute.Int("image.attempt", t.Attempts),
+	))
+	defer span.End()
+
+	rel, size, err := m.download(workCtx, &t)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelCodes.Error, "Failed downloading image")
+	}
+
+	switch {
+	case m.ctx.Err() != nil:
+		_, err = m.writer.ExecContext(context.Background(),
+			`UPDATE image_tasks SET state = 'queued', attempts = attempts - 1, locked_by = NULL, heartbeat_at = NULL
+			WHERE id = $1 AND locked_by = $2 AND state = 'running'`,
+			t.ID, m.workerID,
+		)
+		return true, err
+	case workCtx.Err() != nil:
+		return true, nil
+	case err != nil:
+		if err = m.failImage(l, &t, err); err != nil {
+			return true, err
+		}
+
+		return true, m.finalize(ctx, t.JobID)
+	}
+
+	// reserved images are already counted
+	countImage := 1
+	if reserved {
+		countImage = 0
+	}
+
+	res, err := m.writer.ExecContext(ctx,
+		`WITH t AS (
+			UPDATE image_tasks SET state = 'done', path = $3, error = '', locked_by = NULL, heartbeat_at = NULL, finished_at = now()
+			WHERE id = $1 AND locked_by = $2 AND state = 'running'
+			RETURNING job_id, url, path
+		), j AS (
+			UPDATE scrape_jobs SET images_downloaded = images_downloaded + 1, events = events + 1
+			FROM t WHERE scrape_jobs.id = t.job_id
+			RETURNING scrape_jobs.id, scrape_jobs.events, scrape_jobs.caller
+		), usage AS (
+			INSERT INTO caller_usage (subject, day, images, bytes)
+			SELECT j.caller, $5::date, $6::int, $4::bigint FROM j
+			ON CONFLICT (subject, day) DO UPDATE
+			SET images = caller_usage.images + EXCLUDED.images, bytes = caller_usage.bytes + EXCLUDED.bytes
+		)
+		INSERT INTO job_events (job_id, seq, type, url, path)
+		SELECT j.id, j.events, 'image_downloaded', t.url, t.path FROM j, t`,
+		t.ID, m.workerID, rel, size, day, countImage,
+	)
+	if err != nil {
+		return true, err
+	}
+
+	// nothing recorded means another worker took the task over
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		downloaded = true
+	}
+
+	metrics.ImagesDownloaded.WithLabelValues(string(t.Kind)).Inc()
+	l.DebugContext(ctx, "image downloaded", "path", rel)
+	return true, m.finalize(ctx, t.JobID)
+}
+
+// holdBack requeues a task, and every other queued task of the caller's, until the
+// caller's quota frees up
+func (m *Manager) holdBack(ctx context.Context, l *slog.Logger, t *imageTask, exceeded *quota.ExceededError) error {
+	_, err := m.writer.ExecContext(ctx,
+		`WITH t AS (
+			UPDATE image_tasks SET state = 'queued', attempts = attempts - 1, locked_by = NULL, heartbeat_at = NULL,
+				run_after = now() + make_interval(secs => $3)
+			WHERE id = $1 AND locked_by = $2 AND state = 'running'
+		)
+		UPDATE image_tasks SET run_after = now() + make_interval(secs => $3)
+		WHERE state = 'queued' AND run_after < now() + make_interval(secs => $3)
+			AND job_id IN (SELECT id FROM scrape_jobs WHERE caller = $4 AND state = 'running')`,
+		t.ID, m.workerID, exceeded.RetryAfter.Seconds(), t.Caller,
+	)
+	if err != nil {
+		return err
+	}
+
+	l.InfoContext(ctx, "caller over quota; holding back their downloads",
+		"caller", t.Caller,
+		"quota", exceeded.Quota,
+		"until", time.Now().Add(exceeded.RetryAfter).UTC(),
+	)
+	return nil
+}
+
+// failImage queues a task again after a backoff, or fails it and counts it against its job
+func (m *Manager) failImage(l *slog.Logger, t *imageTask, cause error) error {
+	rejected := errors.Is(cause, download.ErrTooLarge) || errors.Is(cause, download.ErrNotImage)
+	retry := !rejected && !errors.Is(cause, errNoRetry)
+
+	eventType := EventImageFailed
+	if rejected {
+		eventType = EventImageRejected
+	}
+
+	_, err := m.writer.ExecContext(context.Background(),
+		`WITH t AS (
+			UPDATE image_tasks
+			SET state = CASE WHEN $3 AND attempts < max_attempts THEN 'queued' ELSE 'failed' END,
+				finished_at = CASE WHEN $3 AND attempts < max_attempts THEN NULL ELSE now() END,
+				run_after = now() + make_interval(secs => $4),
+				error = $5, locked_by = NULL, heartbeat_at = NULL
+			WHERE id = $1 AND (locked_by = $2 OR locked_by IS NULL) AND state = 'running'
+			RETURNING job_id, url, state, error
+		), j AS (
+			UPDATE scrape_jobs SET images_failed = images_failed + 1, events = events + 1
+			FROM t WHERE scrape_jobs.id = t.job_id AND t.state = 'failed'
+			RETURNING scrape_jobs.id, scrape_jobs.events
+		)
+		INSERT INTO job_events (job_id, seq, type, url, error)
+		SELECT j.id, j.events, $6, t.url, t.error FROM j, t`,
+		t.ID, m.workerID, retry, backoff(t.Attempts).Seconds(), cause.Error(), eventType,
+	)
+	if err != nil {
+		return err
+	}
+
+	// mirrors the CASE above: attempts was already bumped when the task was claimed
+	retry = retry && t.Attempts < t.MaxAttempts
+	if retry {
+		metrics.Retries.WithLabelValues(metrics.QueueImages).Inc()
+	}
+
+	l.WarnContext(context.Background(), "image attempt failed", "err", cause, "retry", retry)
+	return nil
+}
+
+// finalize finishes a job once it's been expanded and none of its tasks are outstanding.
+// It fails if every image failed, and succeeds otherwise
+func (m *Manager) finalize(ctx context.Context, jobID string) error {
+	res, err := m.writer.ExecContext(ctx,
+		`WITH done AS (
+			UPDATE scrape_jobs j
+			SET state = CASE WHEN j.images_found > 0 AND j.images_failed >= j.images_found THEN 'failed' ELSE 'succeeded' END,
+				error = CASE WHEN j.images_found > 0 AND j.images_failed >= j.images_found THEN 'every image failed' ELSE '' END,
+				finished_at = now(), events = j.events + 1
+			WHERE j.id = $1 AND j.state = 'running' AND j.expanded_at IS NOT NULL AND j.locked_by IS NULL
+				AND NOT EXISTS (SELECT 1 FROM image_tasks t WHERE t.job_id = j.id AND t.state IN ('queued', 'running'))
+			RETURNING j.id, j.events, j.state, j.error
+		)
+		INSERT INTO job_events (job_id, seq, type, state, error)
+		SELECT id, events, 'job_state', state, error FROM done`,
+		jobID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n > 0 {
+		m.logger.InfoContext(ctx, "job finished", "job", jobID)
+	}
+
+	return nil
+}
+
+// download fetches a task's image into <storage>/<job>/<task>/ as a corpus item and
+// returns that directory relative to the storage directory, and the image's size
+func (m *Manager) download(ctx context.Context, t *imageTask) (string, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.URL, nil)
+	if err != nil {
+		return "", 0, fmt.Errorf("%w: %v", errNoRetry, err)
+	}
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+
+	switch code := resp.StatusCode; {
+	case code >= 200 && code < 300:
+	case code >= 400 && code < 500 && code != http.StatusTooManyRequests && code != http.StatusRequestTimeout:
+		resp.Body.Close()
+		metrics.Rejected(metrics.ReasonBadStatus)
+		return "", 0, fmt.Errorf("%w: bad response code received: %d", errNoRetry, code)
+	default:
+		resp.Body.Close()
+		metrics.Rejected(metrics.ReasonBadStatus)
+		return "", 0, fmt.Errorf("bad response code received: %d", code)
+	}
+
+	body, err := m.opts.Limits.Body(resp)
+	if err != nil {
+		return "", 0, err
+	}
+	defer body.Close()
+
+	buf, err := io.ReadAll(body)
+	if err != nil {
+		return "", 0, err
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "" || mediaType == "application/octet-stream" {
+		contentType = http.DetectContentType(buf)
+	}
+
+	ext, ok := download.Extension(contentType)
+	if !ok {
+		if ext = path.Ext(req.URL.Path); ext == "" {
+			ext = ".bin"
+		}
+	}
+
+	rel := filepath.Join(t.JobID, t.ID)
+	if err = m.store(ctx, t, rel, ext, contentType, buf); err != nil {
+		return "", 0, err
+	}
+
+	return rel, int64(len(buf)), nil
+}
+
+// store writes an image and its metadata into <storage>/<rel>/
+func (m *Manager) store(ctx context.Context, t *imageTask, rel, ext, contentType string, buf []byte) (err error) {
+	_, span := m.tracer.Start(ctx, "store image", trace.WithAttributes(
+		attribute.String("image.path", rel),
+		attribute.Int("image.bytes", len(buf)),
+	))
+	defer span.End()
+
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(otelCodes.Error, "Failed storing image")
+		}
+	}()
+
+	dir := filepath.Join(m.storageDir, rel)
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	if err = os.WriteFile(filepath.Join(dir, corpus.ImageBase+ext), buf, 0600); err != nil {
+		return err
+	}
+
+	ref := crawler.ImageRef{
+		Alt:        t.Alt,
+		Title:      t.Title,
+		Figcaption: t.Figcaption,
+		PageURL:    t.PageURL,
+		Extractor:  t.Extractor,
+	}
+
+	sum := sha256.Sum256(buf)
+	return corpus.WriteMetadata(dir, &corpus.Metadata{
+		ID:          t.JobID + "-" + t.ID,
+		Source:      string(t.Kind),
+		SourceURL:   t.URL,
+		ContentType: contentType,
+		Size:        int64(len(buf)),
+		SHA256:      hex.EncodeToString(sum[:]),
+		Retrieved:   time.Now().UTC(),
+		Attributes:  ref.Attributes(),
+	})
+}
@@ -0,0 +1,194 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"golang.org/x/exp/slog"
+)
+
+// ExportOptions say where a batch run's metrics go. Either or both of PushURL and
+// Textfile may be set; with neither, the Exporter does nothing
+type ExportOptions struct {
+	// PushURL is a Pushgateway (or anything accepting its API) to PUT metrics to
+	PushURL string
+
+	// Job is the job label metrics are pushed under
+	Job string
+
+	// Textfile is a file for node_exporter's textfile collector. It's replaced
+	// atomically, so it should end in .prom and be in the collector's directory
+	Textfile string
+
+	// Interval is how often Run exports while the run is going. 0 only exports at Finish
+	Interval time.Duration
+}
+
+// Exporter exports the metrics of a batch command, which has no server to be scraped.
+// Only this package's metrics are exported, plus a summary of the run at Finish
+type Exporter struct {
+	logger *slog.Logger
+	opts   ExportOptions
+	start  time.Time
+	client *http.Client
+}
+
+// NewExporter creates an exporter for a run starting now
+func NewExporter(logger *slog.Logger, opts ExportOptions) *Exporter {
+	return &Exporter{
+		logger: logger,
+		opts:   opts,
+		start:  time.Now(),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Enabled reports whether metrics are exported anywhere
+func (e *Exporter) Enabled() bool {
+	return e.opts.PushURL != "" || e.opts.Textfile != ""
+}
+
+// Run exports every interval until ctx is done. Failures are logged, not returned,
+// so a flaky Pushgateway never fails the run
+func (e *Exporter) Run(ctx context.Context) {
+	if !e.Enabled() || e.opts.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(e.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.export(ctx, ours); err != nil {
+				e.logger.WarnContext(ctx, "failed exporting metrics", "err", err)
+			}
+		}
+	}
+}
+
+// Finish exports the final metrics along with how the run went: runErr is the error
+// the run failed with, nil if it succeeded
+func (e *Exporter) Finish(ctx context.Context, runErr error) error {
+	if !e.Enabled() {
+		return nil
+	}
+
+	reg := prometheus.NewRegistry()
+	success := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "run_success",
+		Help:      "1 if the run succeeded, 0 if it failed",
+	})
+	duration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "run_duration_seconds",
+		Help:      "How long the run took",
+	})
+	finished := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "run_finished_timestamp_seconds",
+		Help:      "Unix time the run finished",
+	})
+	reg.MustRegister(success, duration, finished)
+
+	if runErr == nil {
+		success.Set(1)
+	}
+
+	now := time.Now()
+	duration.Set(now.Sub(e.start).Seconds())
+	finished.Set(float64(now.Unix()))
+
+	err := e.export(ctx, prometheus.Gatherers{ours, reg})
+	if err != nil {
+		e.logger.ErrorContext(ctx, "failed exporting final metrics", "err", err)
+	}
+
+	return err
+}
+
+func (e *Exporter) export(ctx context.Context, g prometheus.Gatherer) error {
+	var pushErr, fileErr error
+	if e.opts.PushURL != "" {
+		pushErr = push.New(e.opts.PushURL, e.opts.Job).
+			Client(e.client).
+			Gatherer(g).
+			PushContext(ctx)
+	}
+
+	if e.opts.Textfile != "" {
+		fileErr = writeTextfile(e.opts.Textfile, g)
+	}
+
+	switch {
+	case pushErr != nil && fileErr != nil:
+		return fmt.Errorf("pushing: %v; writing textfile: %w", pushErr, fileErr)
+	case pushErr != nil:
+		return fmt.Errorf("pushing: %w", pushErr)
+	case fileErr != nil:
+		return fmt.Errorf("writing textfile: %w", fileErr)
+	}
+
+	return nil
+}
+
+// writeTextfile writes next to path and renames over it, so node_exporter never reads
+// a partial file
+func writeTextfile(path string, g prometheus.Gatherer) error {
+	families, err := g.Gather()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	enc := expfmt.NewEncoder(f, expfmt.FmtText)
+	for _, mf := range families {
+		if err = enc.Encode(mf); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err = f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// ours gathers this package's metrics from the default registry, leaving out the Go
+// runtime and process collectors, which mean nothing once a batch run is over
+var ours = prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	kept := families[:0]
+	for _, mf := range families {
+		if strings.HasPrefix(mf.GetName(), namespace+"_") {
+			kept = append(kept, mf)
+		}
+	}
+
+	return kept, err
+})
@@ -0,0 +1,92 @@
+// Package metrics holds the Prometheus collectors the crawler, downloads and job
+// workers report to. They're registered with the default registry, so whichever
+// binary serves promhttp.Handler exposes them
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "imgscrape"
+
+// Reasons an image is rejected
+const (
+	ReasonTooLarge  = "too_large"
+	ReasonNotImage  = "not_image"
+	ReasonBadStatus = "bad_status"
+)
+
+// Queues and worker kinds
+const (
+	QueueJobs   = "jobs"
+	QueueImages = "images"
+)
+
+var (
+	PagesFetched = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pages_fetched_total",
+		Help:      "Pages crawled, by result (ok or failed)",
+	}, []string{"result"})
+
+	ImagesDiscovered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "images_discovered_total",
+		Help:      "Distinct images found, by the extractor that found them",
+	}, []string{"extractor"})
+
+	ImagesDownloaded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "images_downloaded_total",
+		Help:      "Images downloaded and stored, by source",
+	}, []string{"source"})
+
+	ImagesRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "images_rejected_total",
+		Help:      "Image responses rejected, by reason (too_large, not_image or bad_status)",
+	}, []string{"reason"})
+
+	DownloadBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "download_bytes_total",
+		Help:      "Bytes of image bodies read",
+	})
+
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Outgoing HTTP requests, by host and status code (\"error\" if there was no response)",
+	}, []string{"host", "code"})
+
+	HTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time until the response headers of outgoing HTTP requests arrived, by host",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"host"})
+
+	Retries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retries_total",
+		Help:      "Failed attempts queued to be tried again, by queue",
+	}, []string{"queue"})
+
+	QueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "Jobs and image tasks outstanding across every server, by queue and state (queued or running)",
+	}, []string{"queue", "state"})
+
+	WorkersInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "workers_in_flight",
+		Help:      "Workers in this process busy with a claimed job or image task, by queue",
+	}, []string{"queue"})
+)
+
+// Rejected counts an image rejected for reason
+func Rejected(reason string) {
+	ImagesRejected.WithLabelValues(reason).Inc()
+}
@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type transport struct {
+	base http.RoundTripper
+}
+
+// Transport wraps base so every request is counted and timed by host in HTTPRequests
+// and HTTPDuration. Pass nil for base to use http.DefaultTransport. Put it under any
+// caching transport so only requests that actually go out are counted
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return transport{base: base}
+}
+
+func (t transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	start := time.Now()
+
+	resp, err := t.base.RoundTrip(req)
+	HTTPDuration.WithLabelValues(host).Observe(time.Since(start).Seconds())
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+
+	HTTPRequests.WithLabelValues(host, code).Inc()
+	return resp, err
+}
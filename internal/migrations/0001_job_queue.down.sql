@@ -0,0 +1,2 @@
+DROP TABLE image_tasks;
+DROP TABLE scrape_jobs;
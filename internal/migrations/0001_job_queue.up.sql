@@ -0,0 +1,64 @@
+-- scrape jobs submitted through the ScrapeService. Workers claim queued jobs with
+-- SELECT ... FOR UPDATE SKIP LOCKED and hold them by bumping heartbeat_at
+CREATE TABLE scrape_jobs (
+    id            TEXT PRIMARY KEY,
+    kind          TEXT NOT NULL CHECK (kind IN ('crawl', 'iiif')),
+    state         TEXT NOT NULL DEFAULT 'queued'
+                  CHECK (state IN ('queued', 'running', 'succeeded', 'failed', 'canceled')),
+    spec          JSONB NOT NULL,
+    error         TEXT NOT NULL DEFAULT '',
+
+    pages_done    BIGINT NOT NULL DEFAULT 0,
+    pages_failed  BIGINT NOT NULL DEFAULT 0,
+    images_found  BIGINT NOT NULL DEFAULT 0,
+    images_failed BIGINT NOT NULL DEFAULT 0,
+
+    attempts      INT NOT NULL DEFAULT 0,
+    max_attempts  INT NOT NULL DEFAULT 3,
+    run_after     TIMESTAMPTZ NOT NULL DEFAULT now(),
+    locked_by     TEXT,
+    heartbeat_at  TIMESTAMPTZ,
+
+    -- set once every image task has been queued; the job succeeds when they're all finished
+    expanded_at   TIMESTAMPTZ,
+
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    started_at    TIMESTAMPTZ,
+    finished_at   TIMESTAMPTZ
+);
+
+CREATE INDEX scrape_jobs_claim_idx ON scrape_jobs (run_after) WHERE state = 'queued';
+CREATE INDEX scrape_jobs_lease_idx ON scrape_jobs (heartbeat_at) WHERE state = 'running' AND locked_by IS NOT NULL;
+CREATE INDEX scrape_jobs_created_idx ON scrape_jobs (created_at DESC);
+
+-- one task per image a job found, downloaded by the image workers
+CREATE TABLE image_tasks (
+    id            BIGSERIAL PRIMARY KEY,
+    job_id        TEXT NOT NULL REFERENCES scrape_jobs (id) ON DELETE CASCADE,
+    url           TEXT NOT NULL,
+    page_url      TEXT NOT NULL DEFAULT '',
+    alt           TEXT NOT NULL DEFAULT '',
+    title         TEXT NOT NULL DEFAULT '',
+    figcaption    TEXT NOT NULL DEFAULT '',
+    extractor     TEXT NOT NULL DEFAULT '',
+
+    state         TEXT NOT NULL DEFAULT 'queued'
+                  CHECK (state IN ('queued', 'running', 'done', 'failed', 'canceled')),
+    error         TEXT NOT NULL DEFAULT '',
+    path          TEXT NOT NULL DEFAULT '',
+
+    attempts      INT NOT NULL DEFAULT 0,
+    max_attempts  INT NOT NULL DEFAULT 3,
+    run_after     TIMESTAMPTZ NOT NULL DEFAULT now(),
+    locked_by     TEXT,
+    heartbeat_at  TIMESTAMPTZ,
+
+    found_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+    finished_at   TIMESTAMPTZ,
+
+    UNIQUE (job_id, url)
+);
+
+CREATE INDEX image_tasks_claim_idx ON image_tasks (run_after) WHERE state = 'queued';
+CREATE INDEX image_tasks_lease_idx ON image_tasks (heartbeat_at) WHERE state = 'running';
+CREATE INDEX image_tasks_job_idx ON image_tasks (job_id, id);
@@ -0,0 +1,5 @@
+DROP TABLE job_events;
+
+ALTER TABLE scrape_jobs
+    DROP COLUMN events,
+    DROP COLUMN images_downloaded;
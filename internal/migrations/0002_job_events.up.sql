@@ -0,0 +1,23 @@
+-- events is the last seq handed out to the job's events. Bumping it locks the job
+-- row, so a job's events commit in seq order and clients can resume from a seq
+-- without missing any
+ALTER TABLE scrape_jobs
+    ADD COLUMN events            BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN images_downloaded BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE job_events (
+    job_id     TEXT NOT NULL REFERENCES scrape_jobs (id) ON DELETE CASCADE,
+    seq        BIGINT NOT NULL,
+    type       TEXT NOT NULL CHECK (type IN (
+                   'page_fetched', 'page_failed',
+                   'image_discovered', 'image_downloaded', 'image_rejected', 'image_failed',
+                   'job_state'
+               )),
+    url        TEXT NOT NULL DEFAULT '',
+    path       TEXT NOT NULL DEFAULT '',
+    error      TEXT NOT NULL DEFAULT '',
+    state      TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+
+    PRIMARY KEY (job_id, seq)
+);
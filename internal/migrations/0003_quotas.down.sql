@@ -0,0 +1,4 @@
+DROP TABLE caller_usage;
+DROP TABLE caller_quotas;
+
+ALTER TABLE scrape_jobs DROP COLUMN caller;
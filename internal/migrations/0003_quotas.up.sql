@@ -0,0 +1,26 @@
+-- who submitted each job, so quotas can count a caller's active jobs
+ALTER TABLE scrape_jobs ADD COLUMN caller TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX scrape_jobs_caller_active_idx ON scrape_jobs (caller) WHERE state IN ('queued', 'running');
+
+-- per-caller overrides of the server's default limits. NULL takes the default and
+-- 0 means unlimited
+CREATE TABLE caller_quotas (
+    subject             TEXT PRIMARY KEY,
+    requests_per_second DOUBLE PRECISION,
+    burst               INT,
+    concurrent_jobs     INT,
+    images_per_day      BIGINT,
+    bytes_per_day       BIGINT,
+    updated_at          TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- images downloaded per caller per UTC day
+CREATE TABLE caller_usage (
+    subject TEXT NOT NULL,
+    day     DATE NOT NULL,
+    images  BIGINT NOT NULL DEFAULT 0,
+    bytes   BIGINT NOT NULL DEFAULT 0,
+
+    PRIMARY KEY (subject, day)
+);
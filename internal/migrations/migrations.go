@@ -0,0 +1,323 @@
+// Package migrations embeds the versioned SQL schema and applies it. Files are named
+// NNNN_name.up.sql and NNNN_name.down.sql; applied versions are recorded in
+// schema_migrations, and every run holds a Postgres advisory lock so concurrent
+// servers starting up don't race each other
+package migrations
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/exp/slog"
+)
+
+//go:embed *.sql
+var files embed.FS
+
+// lockKey is the pg_advisory_lock key every migration run takes
+const lockKey = 0x696d6773637261 // "imgscra"
+
+var ErrUnknownCommand = errors.New("unknown migrate command")
+
+// Migration is one version of the schema
+type Migration struct {
+	Version int64
+	Name    string
+	up      string
+	down    string
+}
+
+// Status is a migration and when it was applied, if it was
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Migrator applies the embedded migrations to a database
+type Migrator struct {
+	logger     *slog.Logger
+	db         *sqlx.DB
+	migrations []Migration
+}
+
+// New creates a migrator. db needs permission to create tables
+func New(logger *slog.Logger, db *sqlx.DB) (*Migrator, error) {
+	migrations, err := load(files)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{logger: logger, db: db, migrations: migrations}, nil
+}
+
+func load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*Migration{}
+	for _, e := range entries {
+		name := e.Name()
+		var up bool
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			up, name = true, strings.TrimSuffix(name, ".up.sql")
+		case strings.HasSuffix(name, ".down.sql"):
+			name = strings.TrimSuffix(name, ".down.sql")
+		default:
+			continue
+		}
+
+		prefix, label, ok := strings.Cut(name, "_")
+		version, err := strconv.ParseInt(prefix, 10, 64)
+		if !ok || err != nil || version < 1 {
+			return nil, fmt.Errorf("migration %s isn't named NNNN_name.(up|down).sql", e.Name())
+		}
+
+		buf, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: label}
+			byVersion[version] = m
+		} else if m.Name != label {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, m.Name, label)
+		}
+
+		if up {
+			m.up = string(buf)
+		} else {
+			m.down = string(buf)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.Version, m.Name)
+		}
+
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Up applies every pending migration, in order, each in its own transaction.
+// It returns how many were applied
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	var n int
+	err := m.locked(ctx, func(conn *sqlx.Conn, applied map[int64]time.Time) error {
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+
+			l := m.logger.With("version", mig.Version, "name", mig.Name)
+			l.InfoContext(ctx, "applying migration")
+
+			err := inTx(ctx, conn, mig.up,
+				`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, mig.Version, mig.Name,
+			)
+			if err != nil {
+				l.ErrorContext(ctx, "failed applying migration", "err", err)
+				return fmt.Errorf("migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+
+			n++
+		}
+
+		return nil
+	})
+
+	return n, err
+}
+
+// Down reverts the most recently applied steps migrations. It returns how many were reverted
+func (m *Migrator) Down(ctx context.Context, steps int) (int, error) {
+	var n int
+	err := m.locked(ctx, func(conn *sqlx.Conn, applied map[int64]time.Time) error {
+		for i := len(m.migrations) - 1; i >= 0 && n < steps; i-- {
+			mig := m.migrations[i]
+			if _, ok := applied[mig.Version]; !ok {
+				continue
+			}
+
+			if mig.down == "" {
+				return fmt.Errorf("migration %d_%s can't be reverted; it has no down file", mig.Version, mig.Name)
+			}
+
+			l := m.logger.With("version", mig.Version, "name", mig.Name)
+			l.InfoContext(ctx, "reverting migration")
+
+			err := inTx(ctx, conn, mig.down, `DELETE FROM schema_migrations WHERE version = $1`, mig.Version)
+			if err != nil {
+				l.ErrorContext(ctx, "failed reverting migration", "err", err)
+				return fmt.Errorf("migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+
+			n++
+		}
+
+		return nil
+	})
+
+	return n, err
+}
+
+// Status lists every embedded migration and when it was applied
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var statuses []Status
+	err := m.locked(ctx, func(_ *sqlx.Conn, applied map[int64]time.Time) error {
+		statuses = make([]Status, len(m.migrations))
+		for i, mig := range m.migrations {
+			statuses[i].Migration = mig
+			if t, ok := applied[mig.Version]; ok {
+				statuses[i].AppliedAt = &t
+			}
+		}
+
+		return nil
+	})
+
+	return statuses, err
+}
+
+// Command runs a migrate subcommand: "up", "down [steps]" (default 1) or "status",
+// writing a summary to w
+func (m *Migrator) Command(ctx context.Context, w io.Writer, args ...string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: expected up | down [steps] | status", ErrUnknownCommand)
+	}
+
+	switch args[0] {
+	case "up":
+		n, err := m.Up(ctx)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "applied %d migration(s)\n", n)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("down takes a positive number of steps, got %q", args[1])
+			}
+		}
+
+		n, err := m.Down(ctx, steps)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "reverted %d migration(s)\n", n)
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+
+			fmt.Fprintf(tw, "%04d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+
+		return tw.Flush()
+	default:
+		return fmt.Errorf("%w %q: expected up | down [steps] | status", ErrUnknownCommand, args[0])
+	}
+
+	return nil
+}
+
+// locked runs fn on a single connection holding the advisory lock, after making sure
+// schema_migrations exists, with the versions applied so far
+func (m *Migrator) locked(ctx context.Context, fn func(*sqlx.Conn, map[int64]time.Time) error) error {
+	conn, err := m.db.Connx(ctx)
+	if err != nil {
+		m.logger.ErrorContext(ctx, "failed getting a connection to migrate with", "err", err)
+		return err
+	}
+	defer conn.Close()
+
+	// session level, so it has to be released on the same connection
+	if _, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockKey); err != nil {
+		m.logger.ErrorContext(ctx, "failed taking the migration lock", "err", err)
+		return err
+	}
+
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, lockKey); err != nil {
+			m.logger.Error("failed releasing the migration lock", "err", err)
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    BIGINT PRIMARY KEY,
+		name       TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		m.logger.ErrorContext(ctx, "failed creating schema_migrations", "err", err)
+		return err
+	}
+
+	var rows []struct {
+		Version   int64     `db:"version"`
+		AppliedAt time.Time `db:"applied_at"`
+	}
+
+	if err = conn.SelectContext(ctx, &rows, `SELECT version, applied_at FROM schema_migrations`); err != nil {
+		m.logger.ErrorContext(ctx, "failed reading applied migrations", "err", err)
+		return err
+	}
+
+	applied := make(map[int64]time.Time, len(rows))
+	for _, r := range rows {
+		applied[r.Version] = r.AppliedAt
+	}
+
+	return fn(conn, applied)
+}
+
+// inTx runs a migration's SQL and its bookkeeping statement in one transaction
+func inTx(ctx context.Context, conn *sqlx.Conn, script, record string, args ...any) error {
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,282 @@
+// Package quota enforces per-caller limits on the scrape server: request rates,
+// concurrent jobs, and images and bytes downloaded per UTC day. Defaults come from
+// the server's flags and can be overridden per caller in the caller_quotas table
+package quota
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/exp/slog"
+)
+
+// how long a caller's limits are cached before caller_quotas is read again
+const cacheTTL = 30 * time.Second
+
+// submitLockClass namespaces the per-caller advisory locks ReserveJob takes
+const submitLockClass = 0x6a6f6273 // "jobs"
+
+// Limits are a caller's quotas. Zero means unlimited
+type Limits struct {
+	RequestsPerSecond float64
+	Burst             int
+	ConcurrentJobs    int
+	ImagesPerDay      int64
+	BytesPerDay       int64
+}
+
+// ExceededError is returned when a caller is over a quota
+type ExceededError struct {
+	// Quota is which quota, e.g. "images per day"
+	Quota string
+	Used  int64
+	Max   int64
+
+	// RetryAfter is roughly when the quota frees up
+	RetryAfter time.Duration
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("%s quota exceeded: %d of %d", e.Quota, e.Used, e.Max)
+}
+
+type cached struct {
+	limits  Limits
+	expires time.Time
+}
+
+// Store reads quotas and usage from Postgres
+type Store struct {
+	logger   *slog.Logger
+	reader   *sqlx.DB
+	defaults Limits
+
+	mu    sync.Mutex
+	cache map[string]cached
+}
+
+// New creates a store handing out defaults to callers without overrides. With a nil
+// reader every caller gets the defaults
+func New(logger *slog.Logger, reader *sqlx.DB, defaults Limits) *Store {
+	return &Store{
+		logger:   logger,
+		reader:   reader,
+		defaults: defaults,
+		cache:    map[string]cached{},
+	}
+}
+
+// Limits returns subject's limits. If they can't be read, the defaults are
+// returned so a database hiccup doesn't lock everyone out
+func (s *Store) Limits(ctx context.Context, subject string) Limits {
+	now := time.Now()
+
+	s.mu.Lock()
+	c, ok := s.cache[subject]
+	s.mu.Unlock()
+	if ok && now.Before(c.expires) {
+		return c.limits
+	}
+
+	if s.reader == nil {
+		return s.defaults
+	}
+
+	var row struct {
+		RequestsPerSecond sql.NullFloat64 `db:"requests_per_second"`
+		Burst             sql.NullInt32   `db:"burst"`
+		ConcurrentJobs    sql.NullInt32   `db:"concurrent_jobs"`
+		ImagesPerDay      sql.NullInt64   `db:"images_per_day"`
+		BytesPerDay       sql.NullInt64   `db:"bytes_per_day"`
+	}
+
+	limits := s.defaults
+	err := s.reader.GetContext(ctx, &row,
+		`SELECT requests_per_second, burst, concurrent_jobs, images_per_day, bytes_per_day
+		FROM caller_quotas WHERE subject = $1`,
+		subject,
+	)
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		// cached all the same, so an outage isn't made worse by a query per request
+		s.logger.WarnContext(ctx, "failed reading caller quotas; using defaults", "subject", subject, "err", err)
+	default:
+		if row.RequestsPerSecond.Valid {
+			limits.RequestsPerSecond = row.RequestsPerSecond.Float64
+		}
+
+		if row.Burst.Valid {
+			limits.Burst = int(row.Burst.Int32)
+		}
+
+		if row.ConcurrentJobs.Valid {
+			limits.ConcurrentJobs = int(row.ConcurrentJobs.Int32)
+		}
+
+		if row.ImagesPerDay.Valid {
+			limits.ImagesPerDay = row.ImagesPerDay.Int64
+		}
+
+		if row.BytesPerDay.Valid {
+			limits.BytesPerDay = row.BytesPerDay.Int64
+		}
+	}
+
+	s.mu.Lock()
+	s.cache[subject] = cached{limits: limits, expires: now.Add(cacheTTL)}
+	s.mu.Unlock()
+
+	return limits
+}
+
+// ReserveJob checks subject is under its concurrent job quota before a job is inserted
+// in tx. It holds a lock per caller until tx ends, so submissions of the same caller
+// take turns and can't all pass the check before any of them is inserted
+func (s *Store) ReserveJob(ctx context.Context, tx *sqlx.Tx, subject string) error {
+	limits := s.Limits(ctx, subject)
+	if limits.ConcurrentJobs <= 0 {
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1, hashtext($2))`, submitLockClass, subject); err != nil {
+		return err
+	}
+
+	var active int64
+	err := tx.GetContext(ctx, &active,
+		`SELECT count(*) FROM scrape_jobs WHERE caller = $1 AND state IN ('queued', 'running')`,
+		subject,
+	)
+	if err != nil {
+		return err
+	}
+
+	if active >= int64(limits.ConcurrentJobs) {
+		return &ExceededError{
+			Quota:      "concurrent jobs",
+			Used:       active,
+			Max:        int64(limits.ConcurrentJobs),
+			RetryAfter: time.Minute,
+		}
+	}
+
+	return nil
+}
+
+// CheckDaily checks subject hasn't downloaded its quota of images or bytes today.
+// It only reads usage, so it's a cheap early rejection; downloads themselves are
+// counted by ReserveImage
+func (s *Store) CheckDaily(ctx context.Context, subject string) error {
+	return s.checkDaily(ctx, subject, s.Limits(ctx, subject))
+}
+
+func (s *Store) checkDaily(ctx context.Context, subject string, limits Limits) error {
+	if s.reader == nil || limits.ImagesPerDay <= 0 && limits.BytesPerDay <= 0 {
+		return nil
+	}
+
+	var u usage
+	err := s.reader.GetContext(ctx, &u,
+		`SELECT images, bytes FROM caller_usage WHERE subject = $1 AND day = (now() AT TIME ZONE 'UTC')::date`,
+		subject,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if exceeded := limits.exceeded(u, time.Now()); exceeded != nil {
+		return exceeded
+	}
+
+	return nil
+}
+
+// ReserveImage counts an image against subject's daily quota before it's downloaded.
+// The check and the increment are one statement, so concurrent downloads of the
+// same caller can't all pass the check and then all be counted. Bytes aren't known
+// until the download finishes, so the bytes quota can be overshot by the images
+// being downloaded when it's reached.
+//
+// day is the UTC day to count against, from Today. An image that isn't downloaded
+// after all should be given back with ReleaseImage
+func (s *Store) ReserveImage(ctx context.Context, db sqlx.QueryerContext, subject, day string) error {
+	limits := s.Limits(ctx, subject)
+
+	var images int64
+	err := sqlx.GetContext(ctx, db, &images,
+		`INSERT INTO caller_usage AS u (subject, day, images, bytes)
+		VALUES ($1, $2::date, 1, 0)
+		ON CONFLICT (subject, day) DO UPDATE SET images = u.images + 1
+		WHERE ($3 <= 0 OR u.images + 1 <= $3) AND ($4 <= 0 OR u.bytes < $4)
+		RETURNING images`,
+		subject, day, limits.ImagesPerDay, limits.BytesPerDay,
+	)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	// nothing was updated, so the caller is over one of the quotas. This read is
+	// only for the error message, so it doesn't matter if usage has moved since
+	var u usage
+	if err = sqlx.GetContext(ctx, db, &u, `SELECT images, bytes FROM caller_usage WHERE subject = $1 AND day = $2::date`, subject, day); err != nil {
+		return err
+	}
+
+	if exceeded := limits.exceeded(u, time.Now()); exceeded != nil {
+		return exceeded
+	}
+
+	// a ReleaseImage got in between the two statements
+	return &ExceededError{Quota: "images per day", Used: u.Images, Max: limits.ImagesPerDay, RetryAfter: time.Second}
+}
+
+// ReleaseImage gives back an image ReserveImage counted for day that wasn't downloaded
+func (s *Store) ReleaseImage(ctx context.Context, db sqlx.ExecerContext, subject, day string) error {
+	_, err := db.ExecContext(ctx,
+		`UPDATE caller_usage SET images = images - 1 WHERE subject = $1 AND day = $2::date AND images > 0`,
+		subject, day,
+	)
+
+	return err
+}
+
+// Today is the UTC day usage is counted against, as a Postgres date
+func Today() string {
+	return time.Now().UTC().Format("2006-01-02")
+}
+
+type usage struct {
+	Images int64 `db:"images"`
+	Bytes  int64 `db:"bytes"`
+}
+
+// exceeded returns which daily quota u has used up, if any
+func (l Limits) exceeded(u usage, now time.Time) *ExceededError {
+	retry := untilTomorrow(now)
+	if l.ImagesPerDay > 0 && u.Images >= l.ImagesPerDay {
+		return &ExceededError{Quota: "images per day", Used: u.Images, Max: l.ImagesPerDay, RetryAfter: retry}
+	}
+
+	if l.BytesPerDay > 0 && u.Bytes >= l.BytesPerDay {
+		return &ExceededError{Quota: "bytes per day", Used: u.Bytes, Max: l.BytesPerDay, RetryAfter: retry}
+	}
+
+	return nil
+}
+
+// untilTomorrow is how long until the next UTC midnight, when daily quotas reset
+func untilTomorrow(now time.Time) time.Duration {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC).Sub(now)
+}
@@ -0,0 +1,85 @@
+package quota
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestExceeded(t *testing.T) {
+	now := time.Date(2024, 3, 1, 18, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		limits    Limits
+		usage     usage
+		wantQuota string // "" for not exceeded
+	}{
+		{name: "unlimited", usage: usage{Images: 1 << 40, Bytes: 1 << 60}},
+		{name: "under both", limits: Limits{ImagesPerDay: 10, BytesPerDay: 100}, usage: usage{Images: 9, Bytes: 99}},
+		{name: "images at max", limits: Limits{ImagesPerDay: 10, BytesPerDay: 100}, usage: usage{Images: 10}, wantQuota: "images per day"},
+		{name: "bytes at max", limits: Limits{ImagesPerDay: 10, BytesPerDay: 100}, usage: usage{Bytes: 100}, wantQuota: "bytes per day"},
+		{name: "bytes over max", limits: Limits{BytesPerDay: 100}, usage: usage{Bytes: 150}, wantQuota: "bytes per day"},
+		{name: "both over reports images", limits: Limits{ImagesPerDay: 10, BytesPerDay: 100}, usage: usage{Images: 11, Bytes: 101}, wantQuota: "images per day"},
+		{name: "only bytes limited", limits: Limits{BytesPerDay: 100}, usage: usage{Images: 1 << 40}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := tc.limits.exceeded(tc.usage, now)
+			if tc.wantQuota == "" {
+				if got != nil {
+					t.Fatalf("got %v, want no quota exceeded", got)
+				}
+				return
+			}
+
+			if got == nil || got.Quota != tc.wantQuota {
+				t.Fatalf("got %v, want %s exceeded", got, tc.wantQuota)
+			}
+
+			if got.RetryAfter != 6*time.Hour {
+				t.Fatalf("retry after %v, want until midnight UTC", got.RetryAfter)
+			}
+		})
+	}
+}
+
+func TestUntilTomorrow(t *testing.T) {
+	tests := []struct {
+		now  time.Time
+		want time.Duration
+	}{
+		{time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), 24 * time.Hour},
+		{time.Date(2024, 3, 1, 23, 59, 59, 0, time.UTC), time.Second},
+		{time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC), 12 * time.Hour},
+		{time.Date(2024, 12, 31, 18, 0, 0, 0, time.UTC), 6 * time.Hour},
+		// 20:00 in UTC-5 is 01:00 UTC the next day
+		{time.Date(2024, 3, 1, 20, 0, 0, 0, time.FixedZone("EST", -5*60*60)), 23 * time.Hour},
+	}
+
+	for _, tc := range tests {
+		if got := untilTomorrow(tc.now); got != tc.want {
+			t.Errorf("untilTomorrow(%v) = %v, want %v", tc.now, got, tc.want)
+		}
+	}
+}
+
+func TestLimitsWithoutDatabase(t *testing.T) {
+	defaults := Limits{RequestsPerSecond: 1, Burst: 2, ImagesPerDay: 3}
+	s := New(nil, nil, defaults)
+
+	if got := s.Limits(context.Background(), "team-a"); got != defaults {
+		t.Fatalf("got %+v, want the defaults %+v", got, defaults)
+	}
+
+	if err := s.CheckDaily(context.Background(), "team-a"); err != nil {
+		t.Fatalf("CheckDaily without usage to read: %v", err)
+	}
+}
+
+func TestToday(t *testing.T) {
+	if _, err := time.Parse("2006-01-02", Today()); err != nil {
+		t.Fatalf("Today() = %q isn't a date: %v", Today(), err)
+	}
+}
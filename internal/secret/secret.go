@@ -0,0 +1,109 @@
+// Package secret reads secrets like database passwords from somewhere other than the
+// command line, where they'd show up in ps output and shell history
+package secret
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Provider looks up secrets by name in a secret store
+type Provider interface {
+	Secret(ctx context.Context, name string) (string, error)
+}
+
+// ProviderFunc adapts a function to a Provider
+type ProviderFunc func(ctx context.Context, name string) (string, error)
+
+func (f ProviderFunc) Secret(ctx context.Context, name string) (string, error) {
+	return f(ctx, name)
+}
+
+// Env reads the secret from the environment variable name
+var Env = ProviderFunc(func(_ context.Context, name string) (string, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s isn't set", name)
+	}
+
+	return v, nil
+})
+
+// File reads the secret from the file name, like the ones Docker and Kubernetes
+// mount secrets as. A trailing newline isn't part of the secret
+var File = ProviderFunc(func(_ context.Context, name string) (string, error) {
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(buf), "\r\n"), nil
+})
+
+var (
+	mu        sync.RWMutex
+	providers = map[string]Provider{
+		"env":  Env,
+		"file": File,
+	}
+)
+
+// Register makes p resolve references with scheme, as in scheme:name. env and file
+// are registered already, and registering a scheme again replaces its provider
+func Register(scheme string, p Provider) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	providers[scheme] = p
+}
+
+// Lookup resolves a reference like env:DB_PASSWORD or file:/run/secrets/db with the
+// provider registered for its scheme
+func Lookup(ctx context.Context, ref string) (string, error) {
+	scheme, name, ok := strings.Cut(ref, ":")
+	if !ok || name == "" {
+		return "", fmt.Errorf("secret reference %q isn't scheme:name", ref)
+	}
+
+	mu.RLock()
+	p := providers[scheme]
+	mu.RUnlock()
+
+	if p == nil {
+		return "", fmt.Errorf("no secret provider for %q", scheme)
+	}
+
+	v, err := p.Secret(ctx, name)
+	if err != nil {
+		return "", fmt.Errorf("failed reading secret %s: %w", ref, err)
+	}
+
+	return v, nil
+}
+
+// Resolve returns whichever of a secret given as value, in the file file or as the
+// reference ref (see Lookup) is set. Setting more than one is an error, because it
+// can't be told which one is meant. Nothing set is "", as a blank value would be
+func Resolve(ctx context.Context, value, file, ref string) (string, error) {
+	set := 0
+	for _, s := range []string{value, file, ref} {
+		if s != "" {
+			set++
+		}
+	}
+
+	switch {
+	case set > 1:
+		return "", errors.New("only one of the secret, its file or its reference can be set")
+	case file != "":
+		return Lookup(ctx, "file:"+file)
+	case ref != "":
+		return Lookup(ctx, ref)
+	default:
+		return value, nil
+	}
+}
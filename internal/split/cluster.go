@@ -0,0 +1,233 @@
+package split
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math/bits"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"github.com/AnthonyHewins/imgscrape/internal/corpus"
+)
+
+// AttrDHash is the sidecar attribute an image's perceptual hash is kept in, as 16 hex digits
+const AttrDHash = "dhash"
+
+// DefaultMaxDistance is how many of the 64 hash bits near-duplicates may differ in
+// when near-duplicate is used without a distance. Resizes and recompression usually
+// change fewer than 5; unrelated images differ in about 32
+const DefaultMaxDistance = 6
+
+// maxMaxDistance bounds the distance so the hash can still be split into bands wide
+// enough to keep the comparison from going quadratic
+const maxMaxDistance = 15
+
+// DHash is the difference hash of img: the image shrunk to 9x8 gray pixels, one bit
+// per pixel for whether it's brighter than its right neighbor. It doesn't change
+// with scale or compression and changes little with small edits
+func DHash(img image.Image) uint64 {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 {
+		return 0
+	}
+
+	// average each of the 9x8 cells, sampling at most about 16x16 pixels of it
+	var gray [8][9]float64
+	for y := 0; y < 8; y++ {
+		y0, y1 := b.Min.Y+y*h/8, b.Min.Y+(y+1)*h/8
+		if y1 == y0 {
+			y1++
+		}
+
+		for x := 0; x < 9; x++ {
+			x0, x1 := b.Min.X+x*w/9, b.Min.X+(x+1)*w/9
+			if x1 == x0 {
+				x1++
+			}
+
+			var sum float64
+			var n int
+			for py := y0; py < y1 && py < b.Max.Y; py += (y1-y0)/16 + 1 {
+				for px := x0; px < x1 && px < b.Max.X; px += (x1-x0)/16 + 1 {
+					r, g, bl, _ := img.At(px, py).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+					n++
+				}
+			}
+
+			gray[y][x] = sum / float64(n)
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if gray[y][x] > gray[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+
+	return hash
+}
+
+// HashItems fills in the dhash attribute of every item missing one by decoding its
+// image, in parallel. It returns the indexes of the items it hashed, so their sidecars
+// can be written back, and how many images couldn't be decoded; those keep no hash.
+// JPEG, PNG and GIF are decoded
+func HashItems(items []corpus.Item) (hashed []int, failed int) {
+	var todo []int
+	for i := range items {
+		if _, ok := parseDHash(&items[i].Meta); !ok {
+			todo = append(todo, i)
+		}
+	}
+
+	hashes := make([]*uint64, len(todo))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range next {
+				if h, err := hashFile(items[todo[j]].ImagePath); err == nil {
+					hashes[j] = &h
+				}
+			}
+		}()
+	}
+
+	for j := range todo {
+		next <- j
+	}
+	close(next)
+	wg.Wait()
+
+	for j, i := range todo {
+		if hashes[j] == nil {
+			failed++
+			continue
+		}
+
+		m := &items[i].Meta
+		if m.Attributes == nil {
+			m.Attributes = map[string]string{}
+		}
+
+		m.Attributes[AttrDHash] = fmt.Sprintf("%016x", *hashes[j])
+		hashed = append(hashed, i)
+	}
+
+	return hashed, failed
+}
+
+func hashFile(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return 0, err
+	}
+
+	return DHash(img), nil
+}
+
+func parseDHash(m *corpus.Metadata) (uint64, bool) {
+	s, ok := m.Attributes[AttrDHash]
+	if !ok || len(s) != 16 {
+		return 0, false
+	}
+
+	h, err := strconv.ParseUint(s, 16, 64)
+	return h, err == nil
+}
+
+// NearDuplicates clusters items whose dhash attributes (see HashItems) are at most
+// maxDistance bits apart, transitively, and returns each item's cluster: the
+// smallest ID in it. Items without a hash aren't in the result. Since clusters grow and
+// merge as items are added, a cluster's key can change between runs over a growing corpus
+func NearDuplicates(items []corpus.Item, maxDistance int) (map[string]string, error) {
+	if maxDistance < 0 || maxDistance > maxMaxDistance {
+		return nil, fmt.Errorf("near-duplicate distance must be 0 to %d bits", maxMaxDistance)
+	}
+
+	var ids []string
+	var hashes []uint64
+	for i := range items {
+		if h, ok := parseDHash(&items[i].Meta); ok {
+			ids = append(ids, items[i].Meta.ID)
+			hashes = append(hashes, h)
+		}
+	}
+
+	parent := make([]int, len(ids))
+	for i := range parent {
+		parent[i] = i
+	}
+
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+
+		return parent[i]
+	}
+
+	// split the hash into maxDistance+1 bands: hashes that close must match exactly in at
+	// least one, so only hashes sharing a band are compared
+	bands := maxDistance + 1
+	type bucket struct {
+		band  int
+		value uint64
+	}
+
+	for band := 0; band < bands; band++ {
+		lo, hi := band*64/bands, (band+1)*64/bands
+		mask := (uint64(1)<<(hi-lo) - 1) << lo
+		if hi-lo == 64 {
+			mask = ^uint64(0)
+		}
+
+		buckets := map[bucket][]int{}
+		for i, h := range hashes {
+			k := bucket{band: band, value: h & mask}
+			for _, j := range buckets[k] {
+				if bits.OnesCount64(h^hashes[j]) <= maxDistance {
+					if a, b := find(i), find(j); a != b {
+						parent[a] = b
+					}
+				}
+			}
+
+			buckets[k] = append(buckets[k], i)
+		}
+	}
+
+	smallest := map[int]string{}
+	for i, id := range ids {
+		root := find(i)
+		if s, ok := smallest[root]; !ok || id < s {
+			smallest[root] = id
+		}
+	}
+
+	clusters := make(map[string]string, len(ids))
+	for i, id := range ids {
+		clusters[id] = smallest[find(i)]
+	}
+
+	return clusters, nil
+}
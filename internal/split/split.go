@@ -0,0 +1,202 @@
+package split
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/AnthonyHewins/imgscrape/internal/corpus"
+)
+
+// Ratio is a named split and its share of the groups, e.g. train=0.8
+type Ratio struct {
+	Name   string
+	Weight float64
+}
+
+// ParseRatios parses a comma separated list like "train=0.8,val=0.1,test=0.1".
+// Weights are normalized, so "train=8,val=1,test=1" is equivalent
+func ParseRatios(s string) ([]Ratio, error) {
+	var ratios []Ratio
+	var total float64
+	seen := map[string]bool{}
+	for _, part := range strings.Split(s, ",") {
+		name, weight, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid split ratio %q; expected name=weight", part)
+		}
+
+		if seen[name] {
+			return nil, fmt.Errorf("split %s specified more than once", name)
+		}
+		seen[name] = true
+
+		w, err := strconv.ParseFloat(weight, 64)
+		if err != nil || w < 0 || math.IsNaN(w) || math.IsInf(w, 0) {
+			return nil, fmt.Errorf("invalid weight for split %s: %q", name, weight)
+		}
+
+		total += w
+		ratios = append(ratios, Ratio{Name: name, Weight: w})
+	}
+
+	if total == 0 {
+		return nil, fmt.Errorf("split ratios sum to 0")
+	}
+
+	for i := range ratios {
+		ratios[i].Weight /= total
+	}
+
+	return ratios, nil
+}
+
+// Grouper returns the key an item is grouped under. Every item sharing a key lands in the same split
+type Grouper func(m *corpus.Metadata) string
+
+// GroupBy returns a grouper by name for items:
+//
+//	"object"                  // the upstream object ID (GLA DepictSTMSObjectID), so every view of an artwork stays together
+//	"domain"                  // the host of the source URL
+//	"checksum"                // the image checksum, so exact duplicates stay together
+//	"near-duplicate[:<bits>]" // clusters of images whose dhash attributes differ in at most bits bits (DefaultMaxDistance if omitted); see HashItems
+//	"attr:<key>"              // any sidecar attribute
+//	"id"                      // no grouping at all
+//
+// Keys are prefixed with the grouper, as in object=123. Items with an empty group key
+// fall back to their own ID as id:<ID>, which no grouper's key can be mistaken for
+func GroupBy(name string, items []corpus.Item) (Grouper, error) {
+	var g Grouper
+	switch {
+	case name == "object":
+		g = func(m *corpus.Metadata) string { return m.GroupID }
+	case name == "domain":
+		g = func(m *corpus.Metadata) string {
+			u, err := url.Parse(m.SourceURL)
+			if err != nil {
+				return ""
+			}
+
+			return strings.ToLower(u.Hostname())
+		}
+	case name == "checksum":
+		g = func(m *corpus.Metadata) string { return m.SHA256 }
+	case name == "near-duplicate" || strings.HasPrefix(name, "near-duplicate:"):
+		distance := DefaultMaxDistance
+		if _, bits, ok := strings.Cut(name, ":"); ok {
+			var err error
+			if distance, err = strconv.Atoi(bits); err != nil {
+				return nil, fmt.Errorf("invalid near-duplicate distance %q", bits)
+			}
+		}
+
+		clusters, err := NearDuplicates(items, distance)
+		if err != nil {
+			return nil, err
+		}
+
+		g = func(m *corpus.Metadata) string { return clusters[m.ID] }
+	case strings.HasPrefix(name, "attr:") && len(name) > len("attr:"):
+		key := strings.TrimPrefix(name, "attr:")
+		g = func(m *corpus.Metadata) string { return m.Attributes[key] }
+	case name == "id":
+		g = func(m *corpus.Metadata) string { return "" }
+	default:
+		return nil, fmt.Errorf("invalid group by %q; use object, domain, checksum, near-duplicate[:<bits>], attr:<key> or id", name)
+	}
+
+	return func(m *corpus.Metadata) string {
+		if key := g(m); key != "" {
+			return name + "=" + key
+		}
+
+		return "id:" + m.ID
+	}, nil
+}
+
+// Assignment is the split a single item was put in
+type Assignment struct {
+	ID    string `json:"id"`
+	Group string `json:"group"`
+	Split string `json:"split"`
+}
+
+// Count is how many groups and items went to a split
+type Count struct {
+	Split  string  `json:"split"`
+	Target float64 `json:"target"`
+	Groups int     `json:"groups"`
+	Items  int     `json:"items"`
+	Actual float64 `json:"actual"`
+}
+
+// Summary reports how the corpus was divided
+type Summary struct {
+	Seed   int64   `json:"seed"`
+	Groups int     `json:"groups"`
+	Items  int     `json:"items"`
+	Splits []Count `json:"splits"`
+}
+
+// Assign puts every group into a split. A group's split only depends on the seed and
+// its key, so adding or removing items doesn't move existing groups between splits as
+// long as the grouper keys them the same way. All of them do except near-duplicate: an
+// item can join a cluster with a smaller ID, or bridge two clusters, which changes the
+// cluster's key and so possibly its split
+func Assign(items []corpus.Item, group Grouper, ratios []Ratio, seed int64) ([]Assignment, *Summary) {
+	assignments := make([]Assignment, len(items))
+	groups := map[string]string{}
+	groupCounts := make(map[string]int, len(ratios))
+	itemCounts := make(map[string]int, len(ratios))
+
+	for i := range items {
+		m := &items[i].Meta
+		key := group(m)
+
+		name, ok := groups[key]
+		if !ok {
+			name = pick(ratios, seed, key)
+			groups[key] = name
+			groupCounts[name]++
+		}
+
+		itemCounts[name]++
+		assignments[i] = Assignment{ID: m.ID, Group: key, Split: name}
+	}
+
+	sort.SliceStable(assignments, func(i, j int) bool { return assignments[i].ID < assignments[j].ID })
+
+	s := &Summary{Seed: seed, Groups: len(groups), Items: len(items), Splits: make([]Count, len(ratios))}
+	for i, r := range ratios {
+		c := Count{Split: r.Name, Target: r.Weight, Groups: groupCounts[r.Name], Items: itemCounts[r.Name]}
+		if len(items) > 0 {
+			c.Actual = float64(c.Items) / float64(len(items))
+		}
+
+		s.Splits[i] = c
+	}
+
+	return assignments, s
+}
+
+// pick hashes the seed and group key into [0, 1) and walks the cumulative ratios
+func pick(ratios []Ratio, seed int64, key string) string {
+	sum := sha256.Sum256([]byte(strconv.FormatInt(seed, 10) + ":" + key))
+	x := float64(binary.BigEndian.Uint64(sum[:8])>>11) / (1 << 53)
+
+	var cumulative float64
+	for _, r := range ratios {
+		cumulative += r.Weight
+		if x < cumulative {
+			return r.Name
+		}
+	}
+
+	// floating point rounding can leave the cumulative sum just under 1
+	return ratios[len(ratios)-1].Name
+}
@@ -0,0 +1,74 @@
+// Package tracing instruments outgoing HTTP with OpenTelemetry client spans
+package tracing
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ResendCountKey is the semantic convention for how many times a request has been
+// sent before, set on client spans of retried attempts
+const ResendCountKey = attribute.Key("http.resend_count")
+
+type attemptKey struct{}
+
+// WithAttempt records that requests made with ctx are part of the given attempt,
+// counting from 1, so their client spans say which retry they belong to
+func WithAttempt(ctx context.Context, attempt int) context.Context {
+	return context.WithValue(ctx, attemptKey{}, attempt)
+}
+
+// Transport wraps base so every request gets a client span with its method, URL and
+// status, the bytes of the response read, and its attempt (see WithAttempt). The trace
+// context is propagated in the request headers. Pass nil for base to use
+// http.DefaultTransport
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return otelhttp.NewTransport(attrTransport{base: base})
+}
+
+// attrTransport runs inside otelhttp's span and adds what it doesn't record
+type attrTransport struct {
+	base http.RoundTripper
+}
+
+func (t attrTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	span := trace.SpanFromContext(req.Context())
+	if attempt, ok := req.Context().Value(attemptKey{}).(int); ok && attempt > 1 {
+		span.SetAttributes(ResendCountKey.Int(attempt - 1))
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || !span.IsRecording() {
+		return resp, err
+	}
+
+	resp.Body = &countingBody{ReadCloser: resp.Body, span: span}
+	return resp, nil
+}
+
+// countingBody keeps the span's read byte count current. It's updated on every read
+// because otelhttp ends the span before closing the body
+type countingBody struct {
+	io.ReadCloser
+	span trace.Span
+	n    int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.n += int64(n)
+		b.span.SetAttributes(otelhttp.ReadBytesKey.Int64(b.n))
+	}
+
+	return n, err
+}